@@ -0,0 +1,217 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+/*
+BulkController 根据目标集群的反馈，动态调整 bulk 的大小和同时发送 bulk 请求的 worker 数量。
+调整策略是 AIMD（加性增、乘性减）：
+  - 出现 429/拒绝或者请求失败时，bulk 大小和活跃 worker 数量都减半；
+  - 耗时超过目标值时，bulk 大小减少四分之一，活跃 worker 数量减一；
+  - 连续几次都正常时，bulk 大小加一个步长，活跃 worker 数量加一。
+
+所有的 worker 都会启动（数量为 --workers），但同一时间只有 workers 个可以发送 bulk 请求，其余的在 Acquire 中等待。
+*/
+type BulkController struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	size    int
+	minSize int
+	maxSize int
+	step    int
+
+	workers    int
+	minWorkers int
+	maxWorkers int
+	inflight   int
+
+	targetLatency time.Duration
+	healthy       int
+}
+
+/*连续多少次正常的 bulk 之后才增加活跃 worker 的数量，避免来回抖动。*/
+const bulkControllerGrowAfter = 5
+
+/*根据配置创建控制器，没有开启 --adaptive_bulk 时返回 nil，nil 的控制器所有方法都直接返回。*/
+func NewBulkController(c *Config) *BulkController {
+	if !c.AdaptiveBulk {
+		return nil
+	}
+
+	minSize := c.AdaptiveMinBulkSizeInMB * 1024 * 1024
+	maxSize := c.AdaptiveMaxBulkSizeInMB * 1024 * 1024
+	if minSize <= 0 {
+		minSize = 1024 * 1024
+	}
+	if maxSize < minSize {
+		maxSize = minSize
+	}
+
+	maxWorkers := c.Workers
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+	minWorkers := c.AdaptiveMinWorkers
+	if minWorkers < 1 {
+		minWorkers = 1
+	}
+	if minWorkers > maxWorkers {
+		minWorkers = maxWorkers
+	}
+
+	b := &BulkController{
+		size:          clampInt(c.BulkSizeInMB*1024*1024, minSize, maxSize),
+		minSize:       minSize,
+		maxSize:       maxSize,
+		step:          minSize,
+		workers:       maxWorkers,
+		minWorkers:    minWorkers,
+		maxWorkers:    maxWorkers,
+		targetLatency: c.AdaptiveTargetLatency,
+	}
+	b.cond = sync.NewCond(&b.lock)
+
+	log.Infof("adaptive bulk enabled, bulk size: %s [%s - %s], workers: %d [%d - %d], target latency: %v",
+		formatBytes(b.size), formatBytes(minSize), formatBytes(maxSize), b.workers, minWorkers, maxWorkers, b.targetLatency)
+	return b
+}
+
+/*把 v 限制在 [min, max] 之间。*/
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+/*当前的 bulk 大小，单位字节。*/
+func (b *BulkController) BulkSizeInBytes() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.size
+}
+
+/*发送 bulk 请求之前调用，活跃 worker 的数量已经达到上限时阻塞等待。*/
+func (b *BulkController) Acquire() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	for b.inflight >= b.workers {
+		b.cond.Wait()
+	}
+	b.inflight++
+	b.lock.Unlock()
+}
+
+/*bulk 请求结束后调用，释放一个活跃 worker 的名额。*/
+func (b *BulkController) Release() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	b.inflight--
+	b.lock.Unlock()
+	b.cond.Broadcast()
+}
+
+/*
+根据一次 bulk 请求的结果调整 bulk 大小和活跃 worker 数量，docs 是请求中发送的文档数。
+latency 是客户端统计的请求耗时，response.Took 是服务端统计的耗时，优先使用服务端的耗时来判断集群是否繁忙。
+DoRequest 对任何状态码都不返回错误，所以整个请求失败（没有 items，返回了 error 或者错误的状态码）时也按照失败处理。
+*/
+func (b *BulkController) Observe(latency time.Duration, docs int, response *BulkResponse, err error) {
+	if b == nil {
+		return
+	}
+
+	rejected, total := 0, 0
+	took := latency
+	if response != nil {
+		rejected, total = response.RejectedCount(docs)
+		if response.Took > 0 {
+			took = time.Duration(response.Took) * time.Millisecond
+		}
+		if err == nil && rejected == 0 && len(response.Items) == 0 && (response.Error != nil || response.Status >= 300) {
+			err = fmt.Errorf("status %d, %v", response.Status, response.Error)
+		}
+	}
+
+	b.lock.Lock()
+	oldSize, oldWorkers := b.size, b.workers
+	var reason string
+
+	switch {
+	case err != nil || rejected > 0:
+		b.size = clampInt(b.size/2, b.minSize, b.maxSize)
+		b.workers = clampInt(b.workers/2, b.minWorkers, b.maxWorkers)
+		b.healthy = 0
+		if err != nil {
+			reason = "bulk request failed: " + err.Error()
+		} else {
+			reason = fmt.Sprintf("rejected %d of %d items", rejected, total)
+		}
+	case b.targetLatency > 0 && took > b.targetLatency:
+		b.size = clampInt(b.size*3/4, b.minSize, b.maxSize)
+		b.workers = clampInt(b.workers-1, b.minWorkers, b.maxWorkers)
+		b.healthy = 0
+		reason = fmt.Sprintf("took %v exceeds target %v", took, b.targetLatency)
+	default:
+		b.healthy++
+		b.size = clampInt(b.size+b.step, b.minSize, b.maxSize)
+		if b.healthy >= bulkControllerGrowAfter {
+			b.workers = clampInt(b.workers+1, b.minWorkers, b.maxWorkers)
+			b.healthy = 0
+		}
+		reason = fmt.Sprintf("took %v", took)
+	}
+	newSize, newWorkers := b.size, b.workers
+	b.lock.Unlock()
+
+	/*活跃 worker 的数量增加之后，唤醒在 Acquire 中等待的 worker*/
+	b.cond.Broadcast()
+
+	if newWorkers != oldWorkers || newSize < oldSize {
+		log.Infof("adaptive bulk: %s, bulk size %s -> %s, workers %d -> %d", reason, formatBytes(oldSize), formatBytes(newSize), oldWorkers, newWorkers)
+	} else if newSize != oldSize {
+		log.Debugf("adaptive bulk: %s, bulk size %s -> %s, workers %d", reason, formatBytes(oldSize), formatBytes(newSize), newWorkers)
+	}
+}
+
+/*把字节数格式化成易读的字符串，例如 5.0MB。*/
+func formatBytes(n int) string {
+	switch {
+	case n >= 1024*1024*1024:
+		return fmt.Sprintf("%.1fGB", float64(n)/1024/1024/1024)
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1fMB", float64(n)/1024/1024)
+	case n >= 1024:
+		return fmt.Sprintf("%.1fKB", float64(n)/1024)
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const mb = 1024 * 1024
+
+func newTestBulkController() *BulkController {
+	return NewBulkController(&Config{
+		AdaptiveBulk:            true,
+		BulkSizeInMB:            8,
+		AdaptiveMinBulkSizeInMB: 1,
+		AdaptiveMaxBulkSizeInMB: 16,
+		Workers:                 8,
+		AdaptiveMinWorkers:      1,
+		AdaptiveTargetLatency:   time.Second,
+	})
+}
+
+func TestBulkControllerObserve(t *testing.T) {
+	tests := []struct {
+		name     string
+		latency  time.Duration
+		response *BulkResponse
+		err      error
+		times    int
+		size     int
+		workers  int
+	}{
+		{"request error", 0, nil, errors.New("timeout"), 1, 4 * mb, 4},
+		{"rejected items", 0, &BulkResponse{Items: bulkItems(201, 429)}, nil, 1, 4 * mb, 4},
+		{"whole request rejected", 0, &BulkResponse{Status: 429}, nil, 1, 4 * mb, 4},
+		{"whole request failed", 0, &BulkResponse{Status: 500, Error: "oops"}, nil, 1, 4 * mb, 4},
+		{"server took too long", 0, &BulkResponse{Took: 2000, Items: bulkItems(201)}, nil, 1, 6 * mb, 7},
+		{"client latency too long", 2 * time.Second, &BulkResponse{Items: bulkItems(201)}, nil, 1, 6 * mb, 7},
+		{"healthy", 100 * time.Millisecond, &BulkResponse{Took: 50, Items: bulkItems(201)}, nil, 1, 9 * mb, 8},
+		{"shrink to the minimum", 0, &BulkResponse{Status: 429}, nil, 10, 1 * mb, 1},
+		{"grow to the maximum", 0, &BulkResponse{Took: 50, Items: bulkItems(201)}, nil, 20, 16 * mb, 8},
+	}
+
+	for _, tt := range tests {
+		b := newTestBulkController()
+		for i := 0; i < tt.times; i++ {
+			b.Observe(tt.latency, 2, tt.response, tt.err)
+		}
+		if b.size != tt.size || b.workers != tt.workers {
+			t.Errorf("%s: size %s, workers %d, expected %s, %d", tt.name, formatBytes(b.size), b.workers, formatBytes(tt.size), tt.workers)
+		}
+	}
+}
+
+func TestBulkControllerGrowWorkers(t *testing.T) {
+	b := newTestBulkController()
+	b.Observe(0, 2, &BulkResponse{Status: 429}, nil)
+	healthy := &BulkResponse{Took: 50, Items: bulkItems(201)}
+	for i := 0; i < bulkControllerGrowAfter-1; i++ {
+		b.Observe(0, 1, healthy, nil)
+	}
+	if b.workers != 4 {
+		t.Fatalf("workers grew before %d healthy requests: %d", bulkControllerGrowAfter, b.workers)
+	}
+	b.Observe(0, 1, healthy, nil)
+	if b.workers != 5 {
+		t.Errorf("workers = %d, expected 5", b.workers)
+	}
+}
+
+func TestNewBulkController(t *testing.T) {
+	if b := NewBulkController(&Config{Workers: 4}); b != nil {
+		t.Errorf("expected nil controller without --adaptive_bulk")
+	}
+	var disabled *BulkController
+	disabled.Observe(0, 1, nil, errors.New("x"))
+	disabled.Acquire()
+	disabled.Release()
+
+	b := NewBulkController(&Config{AdaptiveBulk: true, BulkSizeInMB: 100, AdaptiveMaxBulkSizeInMB: 0, Workers: 0, AdaptiveMinWorkers: 3})
+	if b.size != mb || b.minSize != mb || b.maxSize != mb || b.workers != 1 || b.minWorkers != 1 {
+		t.Errorf("controller = %+v", b)
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+/*
+BenchRecorder 实现 --benchmark，记录每个 bulk 请求的耗时、响应中的 took、发送的字节数和被拒绝的条目，
+每隔 --benchmark_interval 输出这段时间的吞吐和耗时的 p50/p90/p99/max，结束时输出整个过程的统计。
+吞吐的百分位数按每秒写入的文档数计算，耗时的百分位数按每个 bulk 请求计算。
+--benchmark_output 把每次的统计以 JSON 的形式逐行写入文件，方便对比不同的集群配置。
+*/
+type BenchRecorder struct {
+	interval time.Duration
+	output   *os.File
+	enc      *json.Encoder
+
+	lock        sync.Mutex
+	start       time.Time
+	windowStart time.Time
+	window      benchWindow
+	total       benchWindow
+	perSecond   []int64 /*每秒写入的文档数，下标为从开始计算的秒数*/
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+/*一段时间内的 bulk 请求*/
+type benchWindow struct {
+	requests  int
+	docs      int
+	bytes     int64
+	rejected  int
+	failed    int /*失败的条目，不包括 rejected*/
+	errors    int
+	latencies []float64 /*毫秒*/
+	tooks     []float64 /*毫秒*/
+}
+
+/*输出的统计，Interval 是相对开始的时间段，例如 10s-20s，整个过程为 total*/
+type benchReport struct {
+	Interval      string           `json:"interval"`
+	Seconds       float64          `json:"seconds"`
+	Requests      int              `json:"requests"`
+	Docs          int              `json:"docs"`
+	Bytes         int64            `json:"bytes"`
+	Rejected      int              `json:"rejected"`
+	Failed        int              `json:"failed"`
+	Errors        int              `json:"errors"`
+	DocsPerSecond float64          `json:"docs_per_second"`
+	MBPerSecond   float64          `json:"mb_per_second"`
+	Throughput    benchPercentiles `json:"throughput"`
+	Latency       benchPercentiles `json:"latency_ms"`
+	Took          benchPercentiles `json:"took_ms"`
+}
+
+type benchPercentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+/*没有 --benchmark 时返回 nil。*/
+func NewBenchRecorder(config *Config) (*BenchRecorder, error) {
+	if !config.Benchmark {
+		return nil, nil
+	}
+	b := &BenchRecorder{interval: config.BenchmarkInterval, stop: make(chan struct{}), done: make(chan struct{})}
+	if len(config.BenchmarkOutput) > 0 {
+		f, err := os.Create(config.BenchmarkOutput)
+		if err != nil {
+			return nil, err
+		}
+		b.output = f
+		b.enc = json.NewEncoder(f)
+	}
+	return b, nil
+}
+
+/*
+开始计时，按照 --benchmark_interval 定期输出，interval 为 0 时只在结束时输出。
+--repeat_times 的每一轮都会调用，只有第一次生效，统计覆盖所有轮次。
+*/
+func (b *BenchRecorder) Start() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	if !b.start.IsZero() {
+		b.lock.Unlock()
+		return
+	}
+	b.start = time.Now()
+	b.windowStart = b.start
+	b.lock.Unlock()
+
+	go func() {
+		defer close(b.done)
+		if b.interval <= 0 {
+			<-b.stop
+			return
+		}
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.stop:
+				return
+			case <-ticker.C:
+				b.reportWindow()
+			}
+		}
+	}()
+}
+
+/*
+记录一次 bulk 请求，整个请求失败时记为 error，文档不计入吞吐。
+只有状态码为 2xx 的条目计入写入的文档数，429 记为 rejected，其他失败的条目（例如 mapping 冲突）记为 failed。
+*/
+func (b *BenchRecorder) Record(latency time.Duration, bytes int, docs int, response *BulkResponse, err error) {
+	if b == nil {
+		return
+	}
+
+	written, rejected, failedDocs, took := 0, 0, 0, 0
+	if response != nil {
+		rejected, _ = response.RejectedCount(docs)
+		took = response.Took
+	}
+	/*整个请求返回 429 时所有文档记为 rejected，不记为 error*/
+	failed := err != nil || response == nil || len(response.Items) == 0 && response.Status >= 300 && rejected == 0
+	if !failed && len(response.Items) > 0 {
+		written = response.SucceededCount()
+		failedDocs = len(response.Items) - written - rejected
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, w := range []*benchWindow{&b.window, &b.total} {
+		w.requests++
+		w.docs += written
+		w.bytes += int64(bytes)
+		w.rejected += rejected
+		w.failed += failedDocs
+		if failed {
+			w.errors++
+		} else if len(response.Items) > 0 {
+			w.tooks = append(w.tooks, float64(took))
+		}
+		w.latencies = append(w.latencies, float64(latency)/float64(time.Millisecond))
+	}
+
+	second := int(time.Since(b.start) / time.Second)
+	for len(b.perSecond) <= second {
+		b.perSecond = append(b.perSecond, 0)
+	}
+	b.perSecond[second] += int64(written)
+}
+
+/*输出当前时间段的统计，开始下一个时间段*/
+func (b *BenchRecorder) reportWindow() {
+	b.lock.Lock()
+	now := time.Now()
+	report := b.report(b.window, b.windowStart, now)
+	report.Interval = fmt.Sprintf("%v-%v", b.windowStart.Sub(b.start).Round(time.Second), now.Sub(b.start).Round(time.Second))
+	b.window = benchWindow{}
+	b.windowStart = now
+	b.lock.Unlock()
+
+	b.write(report)
+}
+
+/*停止定期输出，输出最后一个时间段和整个过程的统计，所有轮次结束之后调用一次。*/
+func (b *BenchRecorder) Stop() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	started := !b.start.IsZero()
+	b.lock.Unlock()
+	if !started {
+		if b.output != nil {
+			b.output.Close()
+		}
+		return
+	}
+	close(b.stop)
+	<-b.done
+
+	if b.interval > 0 {
+		b.lock.Lock()
+		pending := b.window.requests > 0
+		b.lock.Unlock()
+		if pending {
+			b.reportWindow()
+		}
+	}
+
+	b.lock.Lock()
+	report := b.report(b.total, b.start, time.Now())
+	report.Interval = "total"
+	b.lock.Unlock()
+	b.write(report)
+
+	if b.output != nil {
+		b.output.Close()
+	}
+}
+
+/*计算 [from, to) 之间的统计，调用方持有锁*/
+func (b *BenchRecorder) report(w benchWindow, from, to time.Time) benchReport {
+	seconds := to.Sub(from).Seconds()
+	r := benchReport{
+		Seconds:  math.Round(seconds*1000) / 1000,
+		Requests: w.requests,
+		Docs:     w.docs,
+		Bytes:    w.bytes,
+		Rejected: w.rejected,
+		Failed:   w.failed,
+		Errors:   w.errors,
+		Latency:  percentiles(w.latencies),
+		Took:     percentiles(w.tooks),
+	}
+	if seconds > 0 {
+		r.DocsPerSecond = math.Round(float64(w.docs)/seconds*100) / 100
+		r.MBPerSecond = math.Round(float64(w.bytes)/1024/1024/seconds*100) / 100
+	}
+
+	/*只使用完整的秒计算吞吐的百分位数，不到一秒时使用已有的数据*/
+	first := int(from.Sub(b.start) / time.Second)
+	last := int(to.Sub(b.start) / time.Second)
+	if last <= first {
+		last = first + 1
+	}
+	var perSecond []float64
+	for i := first; i < last; i++ {
+		n := int64(0)
+		if i < len(b.perSecond) {
+			n = b.perSecond[i]
+		}
+		perSecond = append(perSecond, float64(n))
+	}
+	r.Throughput = percentiles(perSecond)
+	return r
+}
+
+func (b *BenchRecorder) write(r benchReport) {
+	log.Infof("benchmark [%s] requests: %d, docs: %d, %.2f docs/s (p50: %.0f, p90: %.0f, p99: %.0f, max: %.0f), %.2f MB/s, "+
+		"latency p50: %.0fms, p90: %.0fms, p99: %.0fms, max: %.0fms, took p50: %.0fms, p90: %.0fms, p99: %.0fms, max: %.0fms, rejected: %d, failed: %d, errors: %d",
+		r.Interval, r.Requests, r.Docs, r.DocsPerSecond, r.Throughput.P50, r.Throughput.P90, r.Throughput.P99, r.Throughput.Max, r.MBPerSecond,
+		r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max, r.Took.P50, r.Took.P90, r.Took.P99, r.Took.Max, r.Rejected, r.Failed, r.Errors)
+	if b.enc != nil {
+		if err := b.enc.Encode(r); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+/*按照 nearest-rank 计算百分位数，values 为空时都是 0*/
+func percentiles(values []float64) benchPercentiles {
+	if len(values) == 0 {
+		return benchPercentiles{}
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := func(p float64) float64 {
+		i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return sorted[i]
+	}
+	return benchPercentiles{P50: rank(50), P90: rank(90), P99: rank(99), Max: sorted[len(sorted)-1]}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []float64
+		expected benchPercentiles
+	}{
+		{"empty", nil, benchPercentiles{}},
+		{"one value", []float64{7}, benchPercentiles{P50: 7, P90: 7, P99: 7, Max: 7}},
+		{"unsorted", []float64{5, 1, 4, 2, 3}, benchPercentiles{P50: 3, P90: 5, P99: 5, Max: 5}},
+		{"ten values", []float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, benchPercentiles{P50: 5, P90: 9, P99: 10, Max: 10}},
+	}
+
+	for _, tt := range tests {
+		if got := percentiles(tt.values); got != tt.expected {
+			t.Errorf("%s: got %+v, expected %+v", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func bulkItems(statuses ...int) []map[string]Action {
+	var items []map[string]Action
+	for _, status := range statuses {
+		items = append(items, map[string]Action{"index": {Status: status}})
+	}
+	return items
+}
+
+func TestBenchRecorderRecord(t *testing.T) {
+	tests := []struct {
+		name     string
+		response *BulkResponse
+		err      error
+		expected benchWindow
+	}{
+		{"all created", &BulkResponse{Took: 5, Items: bulkItems(201, 201, 200)}, nil, benchWindow{docs: 3}},
+		{"rejected and failed items", &BulkResponse{Took: 5, Items: bulkItems(201, 429, 400, 409)}, nil, benchWindow{docs: 1, rejected: 1, failed: 2}},
+		{"whole request rejected", &BulkResponse{Status: 429}, nil, benchWindow{rejected: 4}},
+		{"whole request failed", &BulkResponse{Status: 500, Error: "oops"}, nil, benchWindow{errors: 1}},
+		{"request error", nil, errors.New("timeout"), benchWindow{errors: 1}},
+	}
+
+	for _, tt := range tests {
+		b := &BenchRecorder{start: time.Now()}
+		b.Record(10*time.Millisecond, 100, 4, tt.response, tt.err)
+		w := b.total
+		if w.requests != 1 || w.bytes != 100 || w.docs != tt.expected.docs || w.rejected != tt.expected.rejected ||
+			w.failed != tt.expected.failed || w.errors != tt.expected.errors {
+			t.Errorf("%s: got %+v, expected %+v", tt.name, w, tt.expected)
+		}
+		if b.perSecond[0] != int64(tt.expected.docs) {
+			t.Errorf("%s: per second docs = %d", tt.name, b.perSecond[0])
+		}
+	}
+}
+
+func TestBenchRecorderRepeatRounds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esm-bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "bench.json")
+
+	b, err := NewBenchRecorder(&Config{Benchmark: true, BenchmarkOutput: output})
+	if err != nil {
+		t.Fatal(err)
+	}
+	/*--repeat_times 的每一轮都会调用 Start，最后只调用一次 Stop*/
+	for round := 0; round < 2; round++ {
+		b.Start()
+		b.Record(time.Millisecond, 10, 1, &BulkResponse{Items: bulkItems(201)}, nil)
+	}
+	b.Stop()
+
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"docs":2`) {
+		t.Errorf("output = %s", data)
+	}
+
+	/*没有开始时 Stop 直接返回*/
+	idle, _ := NewBenchRecorder(&Config{Benchmark: true})
+	idle.Stop()
+}
@@ -38,6 +38,7 @@ func (c *Migrator) NewBulkWorker(docCount *int, pb *pb.ProgressBar, wg *sync.Wai
 	bulkItemSize := 0                  /*是每个批量操作的文档数*/
 	mainBuf := bytes.Buffer{}          /*mainBuf是缓冲区*/
 	docBuf := bytes.Buffer{}           /*docBuf是缓冲区*/
+	childBuf := bytes.Buffer{}         /*childBuf 缓存子文档，每次 bulk 时追加在 mainBuf 之后，保证同一个 bulk 中父文档在子文档之前写入*/
 	docEnc := json.NewEncoder(&docBuf) /*是json.Encoder类型的变量，用于将文档编码为json格式*/
 
 	idleDuration := 5 * time.Second            /*是定时器idleTimeout的周期*/
@@ -58,6 +59,8 @@ READ_DOCS:
 		/*接受来自c.DocChan的数据并将其存储在docI中*/
 		case docI, open := <-c.DocChan:
 			var err error
+			/*在修改文档之前释放它占用的缓存*/
+			c.releaseDoc(docI)
 			log.Trace("read doc from channel,", docI)
 
 			/*
@@ -92,6 +95,10 @@ READ_DOCS:
 			*/
 			tempDestIndexName = docI["_index"].(string)
 			tempTargetTypeName = docI["_type"].(string)
+			if len(tempTargetTypeName) == 0 {
+				/*生成的文档和 CSV 文档没有 _type，使用目标集群默认的 type*/
+				tempTargetTypeName = c.TargetTypeName
+			}
 
 			/*根据配置文件的设置来确定数据迁移的目标索引名称*/
 			if c.Config.TargetIndexName != "" {
@@ -99,6 +106,17 @@ READ_DOCS:
 				tempDestIndexName = c.Config.TargetIndexName
 			}
 
+			/*配置文件中为源索引单独指定的目标索引名称和字段重命名，优先于全局的配置*/
+			renameFields := c.Config.RenameFields
+			if ic := c.Config.indexConfig(docI["_index"].(string)); ic != nil {
+				if len(ic.DestIndex) > 0 {
+					tempDestIndexName = ic.DestIndex
+				}
+				if len(ic.Rename) > 0 {
+					renameFields = ic.Rename
+				}
+			}
+
 			/*根据配置文件的设置来确定数据迁移的目标类型名称*/
 			if c.Config.OverrideTypeName != "" {
 				/*程序会检查配置文件中是否设置了目标类型名称，如果设置了，则将该名称赋值给变量tempTargetTypeName*/
@@ -106,10 +124,17 @@ READ_DOCS:
 			}
 
 			doc := Document{
-				Index:  tempDestIndexName,                        /*文档的所属索引*/
-				Type:   tempTargetTypeName,                       /*文档的所属类型*/
-				source: docI["_source"].(map[string]interface{}), /*源数据信息存储在source字段中*/
-				Id:     docI["_id"].(string),                     /*Id表示文档的唯一标识*/
+				Index: tempDestIndexName,    /*文档的所属索引*/
+				Type:  tempTargetTypeName,   /*文档的所属类型*/
+				Id:    docI["_id"].(string), /*Id表示文档的唯一标识*/
+			}
+
+			/*源数据信息存储在source字段中，不需要修改 _source 时 scroll 直接传过来原始的 JSON，原样写入 bulk 请求*/
+			switch source := docI["_source"].(type) {
+			case map[string]interface{}:
+				doc.source = source
+			case json.RawMessage:
+				doc.rawSource = source
 			}
 
 			/*如果 c.Config.RegenerateID 为 true，则会将 doc.Id 设置为空字符串，否则保留原有的 ID。*/
@@ -121,10 +146,10 @@ READ_DOCS:
 				用来实现对字段进行重命名的功能。
 				首先，代码会判断配置文件中是否有设置需要重命名的字段，如果有，
 			*/
-			if c.Config.RenameFields != "" {
+			if renameFields != "" {
 
-				/* c.Config.RenameFields 是一个用都好分割的字符串，例如：_type:type, name:myname ，每个子字符串表示一个需重命名的字段。*/
-				kvs := strings.Split(c.Config.RenameFields, ",")
+				/* renameFields 是一个用都好分割的字符串，例如：_type:type, name:myname ，每个子字符串表示一个需重命名的字段。*/
+				kvs := strings.Split(renameFields, ",")
 
 				/*这段代码会逐一处理每个子字符串，将其拆分成需要重命名的旧字段和新字段，然后对每个旧字段进行重命名。*/
 				for _, i := range kvs {
@@ -160,6 +185,32 @@ READ_DOCS:
 				}
 			}
 
+			/*
+				1.x 到 5.x 的子文档带有 _parent，1.x 在 fields 中返回。
+				目标是 6.x 及以上版本时，由 c.Join 翻译成 join 字段，否则原样写入 parent。
+			*/
+			if parent, ok := docI["_parent"].(string); ok && parent != "" {
+				doc.Parent = parent
+			} else if fields, ok := docI["fields"].(map[string]interface{}); ok {
+				if parent, ok := fields["_parent"].(string); ok && parent != "" {
+					doc.Parent = parent
+				}
+			}
+			isChild := len(doc.Parent) > 0
+			c.Join.Apply(&doc, docI["_type"].(string))
+			c.TypeSplitter.Apply(&doc, tempDestIndexName, docI["_type"].(string))
+
+			/*
+				开启 --preserve_version 时，使用源文档的 _version 作为 external 版本号写入目标，
+				目标中已有的版本号不小于源文档的版本号时，ES 会返回 409，不会用旧的文档覆盖新的文档。
+			*/
+			if c.Config.PreserveVersion {
+				if version, ok := parseInt64(docI["_version"]); ok {
+					doc.Version = version
+					doc.VersionType = "external"
+				}
+			}
+
 			// if channel is closed flush and gtfo
 			if !open {
 				goto WORKER_DONE
@@ -171,30 +222,26 @@ READ_DOCS:
 				continue
 			}
 
-			// encode the doc and and the _source field for a bulk request
-			/*
-				将文档编码为 Elasticsearch 批量请求的形式。
-				具体来说，它将文档以 index 操作的形式编码为一个 map[string]Document，然后使用 docEnc 对象将它编码为 JSON 格式，此时包括文档源数据。
-				首先，创建一个 map[string]Document 类型的变量 post，其中 key 为 "index"，value 为文档对象。
-			*/
-			post := map[string]Document{
-				"index": doc,
-			}
-			/*
-				使用 docEnc 对象将 post 变量进行编码，生成一个 Elasticsearch 批量请求中的一部分。
-			*/
-			if err = docEnc.Encode(post); err != nil {
-				log.Error(err)
+			/*update、upsert 和 delete 都需要根据 ID 找到目标中的文档，没有 ID 的文档只能跳过*/
+			if len(doc.Id) == 0 && c.Config.OpType != "index" && c.Config.OpType != "create" {
+				log.Errorf("document without id can't be used with op_type %s: %+v", c.Config.OpType, doc)
+				continue
 			}
+
+			// encode the doc and and the _source field for a bulk request
 			/*
-				将文档源数据使用 docEnc 对象进行编码，也作为 Elasticsearch 批量请求中的一部分。
+				将文档编码为 Elasticsearch 批量请求的形式，操作类型由 --op_type 决定。
 			*/
-			if err = docEnc.Encode(doc.source); err != nil {
+			if err = c.encodeBulkItem(docEnc, doc); err != nil {
 				log.Error(err)
 			}
 
-			/*mainBuf是一个字节缓冲区，用于存储待发送的文档*/
-			mainBuf.Write(docBuf.Bytes())
+			/*mainBuf是一个字节缓冲区，用于存储待发送的文档，子文档先放到 childBuf 中*/
+			if isChild {
+				childBuf.Write(docBuf.Bytes())
+			} else {
+				mainBuf.Write(docBuf.Bytes())
+			}
 			// reset for next document
 			bulkItemSize++
 			(*docCount)++
@@ -203,7 +250,7 @@ READ_DOCS:
 			/*
 				当mainBuf的大小mainBuf.Len()加上待处理文档的大小docBuf.Len()大于 Elasticsearch 所允许的最大值时，将触发goto CLEAN_BUFFER，即清空当前缓冲区。
 			*/
-			if mainBuf.Len()+docBuf.Len() > (c.Config.BulkSizeInMB * 1024 * 1024) {
+			if mainBuf.Len()+childBuf.Len()+docBuf.Len() > c.bulkSizeInBytes() {
 				goto CLEAN_BUFFER
 			}
 
@@ -223,8 +270,11 @@ READ_DOCS:
 
 		/*CLEAN_BUFFER的标签的作用是在执行完一次批量操作后清空缓冲区并进入下一轮的批量操作。*/
 	CLEAN_BUFFER:
-		/*c.TargetESAPI.Bulk(&mainBuf)将缓冲区中的数据批量插入到目标 Elasticsearch 中*/
-		c.TargetESAPI.Bulk(&mainBuf)
+		/*子文档追加在父文档之后*/
+		mainBuf.Write(childBuf.Bytes())
+		childBuf.Reset()
+		/*c.doBulk(&mainBuf) 按照全局的限速等待之后，将缓冲区中的数据批量插入到目标 Elasticsearch 中*/
+		c.doBulk(&mainBuf, bulkItemSize)
 		/*然后打印一条日志表示已清空缓冲区并执行了批量插入操作*/
 		log.Trace("clean buffer, and execute bulk insert")
 		/*接着，程序会更新批量操作的大小计数器，并将其重置为0，以便开启新的一轮批量插入。*/
@@ -248,11 +298,13 @@ WORKER_DONE:
 		/*在成功插入数据后，将 bulkItemSize 计数器加1*/
 		bulkItemSize++
 	}
+	mainBuf.Write(childBuf.Bytes())
+	childBuf.Reset()
 	/*
 		通过调用 Bulk 方法来批量插入数据,
 		Bulk 方法在执行插入操作时，会读取 mainBuf 中的数据，每次读取一个完整的请求，然后发送给 Elasticsearch。
 	*/
-	c.TargetESAPI.Bulk(&mainBuf)
+	c.doBulk(&mainBuf, bulkItemSize)
 	log.Trace("bulk insert")
 	/*这段代码中的 pb 表示进度条对象，通过调用 pb.Add 方法来更新进度条的已完成进度。*/
 	pb.Add(bulkItemSize)
@@ -260,3 +312,123 @@ WORKER_DONE:
 	/*最后，通过调用 wg.Done() 来告知主线程当前协程已完成任务*/
 	wg.Done()
 }
+
+/*
+发送一次 bulk 请求。
+在发送之前，从全局的限速器中取走对应数量的令牌，所有 bulk worker 共用同一组限速器，所以限制的是整体的吞吐，而不是单个 worker 的吞吐；
+开启了 --adaptive_bulk 时，还需要从 BulkController 获取活跃 worker 的名额，请求结束后把耗时和响应交给它来调整 bulk 大小和并发；
+开启了 --benchmark 时，请求的耗时、字节数和响应交给 BenchRecorder 统计。
+*/
+func (c *Migrator) doBulk(mainBuf *bytes.Buffer, docs int) {
+	if mainBuf.Len() == 0 {
+		return
+	}
+
+	c.BulkDocsLimiter.Wait(docs)
+	c.BulkBytesLimiter.Wait(mainBuf.Len())
+
+	c.BulkController.Acquire()
+	defer c.BulkController.Release()
+
+	size := mainBuf.Len()
+	start := time.Now()
+	response, err := c.TargetESAPI.Bulk(mainBuf)
+	latency := time.Since(start)
+	c.BulkController.Observe(latency, docs, response, err)
+	c.BulkStats.Add(response, err, docs)
+	c.Bench.Record(latency, size, docs, response, err)
+}
+
+/*
+按照 --op_type 把一个文档编码成 bulk 请求中的一个条目：
+  - index/create：操作行之后是完整的 _source；
+  - update：操作行之后是 {"doc": _source}，只合并字段到已存在的文档，文档不存在时返回 404；
+  - upsert：在 update 的基础上加上 doc_as_upsert，文档不存在时使用 _source 新建；
+  - delete：只有操作行，没有请求体。
+
+原始的 _source（rawSource）不会被解码，json.RawMessage 编码时只做紧凑化。
+*/
+func (c *Migrator) encodeBulkItem(enc *json.Encoder, doc Document) error {
+	opType := c.Config.OpType
+	if opType == "upsert" {
+		opType = "update"
+	}
+	if len(opType) == 0 {
+		opType = "index"
+	}
+
+	if err := enc.Encode(map[string]Document{opType: doc}); err != nil {
+		return err
+	}
+
+	var source interface{} = doc.source
+	if doc.rawSource != nil {
+		source = doc.rawSource
+	}
+
+	switch c.Config.OpType {
+	case "delete":
+		return nil
+	case "update":
+		return enc.Encode(map[string]interface{}{"doc": source})
+	case "upsert":
+		return enc.Encode(map[string]interface{}{"doc": source, "doc_as_upsert": true})
+	}
+	return enc.Encode(source)
+}
+
+/*当前的 bulk 大小，单位字节，开启了 --adaptive_bulk 时由 BulkController 决定。*/
+func (c *Migrator) bulkSizeInBytes() int {
+	if c.BulkController != nil {
+		return c.BulkController.BulkSizeInBytes()
+	}
+	return c.Config.BulkSizeInMB * 1024 * 1024
+}
+
+/*
+统计 bulk 响应中被拒绝的条目数，返回被拒绝的数量和总数，docs 是请求中发送的文档数。
+整个请求返回 429 时响应中没有 items，认为发送的 docs 个条目都被拒绝；否则统计状态码为 429 的条目，
+也就是 es_rejected_execution_exception，写入队列已满。
+*/
+func (r *BulkResponse) RejectedCount(docs int) (rejected int, total int) {
+	if r.Status == 429 && len(r.Items) == 0 {
+		return docs, docs
+	}
+	total = len(r.Items)
+	for _, item := range r.Items {
+		for _, action := range item {
+			if action.Status == 429 {
+				rejected++
+			}
+		}
+	}
+	return rejected, total
+}
+
+/*统计 bulk 响应中写入成功的条目数，也就是状态码为 2xx 的条目。*/
+func (r *BulkResponse) SucceededCount() (succeeded int) {
+	for _, item := range r.Items {
+		for _, action := range item {
+			if action.Status >= 200 && action.Status < 300 {
+				succeeded++
+			}
+		}
+	}
+	return succeeded
+}
+
+/*把 JSON 解码得到的数字转换成 int64，兼容 UseNumber 得到的 json.Number 和默认的 float64。*/
+func parseInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	case float64:
+		return int64(n), true
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	}
+	return 0, false
+}
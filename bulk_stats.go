@@ -0,0 +1,144 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+BulkStats 按照结果统计 bulk 中每个条目的执行情况，例如 created、updated、noop、deleted、not_found、conflict、failed，
+所有的 bulk worker 共用同一个实例。
+*/
+type BulkStats struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+func NewBulkStats() *BulkStats {
+	return &BulkStats{counts: map[string]int{}}
+}
+
+/*
+根据 bulk 条目的操作类型和响应判断它的结果。
+5.x 及以上版本的响应中带有 result 字段，直接使用；1.x/2.x 没有这个字段，只能根据状态码推断。
+*/
+func bulkItemOutcome(op string, action Action) string {
+	switch {
+	case action.Status == 409:
+		return "conflict"
+	case action.Status == 429:
+		return "rejected"
+	case action.Status == 404 && (op == "update" || op == "delete"):
+		return "not_found"
+	case action.Status >= 300 || action.Error != nil:
+		return "failed"
+	case len(action.Result) > 0:
+		return action.Result
+	case action.Status == 201:
+		return "created"
+	case op == "delete":
+		return "deleted"
+	}
+	return "updated"
+}
+
+/*统计一次 bulk 的响应，整个请求失败时，把这次 bulk 中的 docs 个条目都记为 failed。*/
+func (s *BulkStats) Add(response *BulkResponse, err error, docs int) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err != nil || response == nil || len(response.Items) == 0 && response.Status >= 300 {
+		s.counts["failed"] += docs
+		return
+	}
+
+	for _, item := range response.Items {
+		for op, action := range item {
+			s.counts[bulkItemOutcome(op, action)]++
+		}
+	}
+}
+
+/*直接累加某个结果的数量，例如 reindex 任务完成之后汇总它的 created、updated。*/
+func (s *BulkStats) AddCount(outcome string, n int) {
+	if s == nil || n <= 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counts[outcome] += n
+}
+
+/*把另一个统计（例如单个索引任务的统计）累加到当前统计中。*/
+func (s *BulkStats) Merge(other *BulkStats) {
+	if s == nil || other == nil {
+		return
+	}
+
+	other.lock.Lock()
+	counts := map[string]int{}
+	for k, v := range other.counts {
+		counts[k] = v
+	}
+	other.lock.Unlock()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, v := range counts {
+		s.counts[k] += v
+	}
+}
+
+/*某个结果的数量，例如 Count("failed")。*/
+func (s *BulkStats) Count(outcome string) int {
+	if s == nil {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.counts[outcome]
+}
+
+/*按照结果名称排序输出，例如 created: 10, conflict: 2。*/
+func (s *BulkStats) String() string {
+	if s == nil {
+		return ""
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var keys []string
+	for k := range s.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s: %d", k, s.counts[k]))
+	}
+	return strings.Join(parts, ", ")
+}
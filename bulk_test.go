@@ -0,0 +1,78 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestEncodeBulkItem(t *testing.T) {
+	decoded := Document{Index: "logs", Type: "_doc", Id: "1", source: map[string]interface{}{"a": 1}}
+	raw := Document{Index: "logs", Type: "_doc", Id: "1", rawSource: json.RawMessage(`{ "a" : 1 }`)}
+	versioned := Document{Index: "logs", Id: "1", Version: 3, VersionType: "external", source: map[string]interface{}{"a": 1}}
+
+	tests := []struct {
+		opType   string
+		doc      Document
+		expected string
+	}{
+		{"", decoded, `{"index":{"_index":"logs","_type":"_doc","_id":"1"}}` + "\n" + `{"a":1}` + "\n"},
+		{"index", raw, `{"index":{"_index":"logs","_type":"_doc","_id":"1"}}` + "\n" + `{"a":1}` + "\n"},
+		{"index", versioned, `{"index":{"_index":"logs","_id":"1","version":3,"version_type":"external"}}` + "\n" + `{"a":1}` + "\n"},
+		{"create", decoded, `{"create":{"_index":"logs","_type":"_doc","_id":"1"}}` + "\n" + `{"a":1}` + "\n"},
+		{"update", raw, `{"update":{"_index":"logs","_type":"_doc","_id":"1"}}` + "\n" + `{"doc":{"a":1}}` + "\n"},
+		{"upsert", decoded, `{"update":{"_index":"logs","_type":"_doc","_id":"1"}}` + "\n" + `{"doc":{"a":1},"doc_as_upsert":true}` + "\n"},
+		{"delete", decoded, `{"delete":{"_index":"logs","_type":"_doc","_id":"1"}}` + "\n"},
+	}
+
+	for _, tt := range tests {
+		c := &Migrator{Config: &Config{OpType: tt.opType}}
+		var buf bytes.Buffer
+		if err := c.encodeBulkItem(json.NewEncoder(&buf), tt.doc); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.expected {
+			t.Errorf("op_type %q: got %s, expected %s", tt.opType, buf.String(), tt.expected)
+		}
+	}
+}
+
+func TestBulkResponseCounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		response  BulkResponse
+		rejected  int
+		total     int
+		succeeded int
+	}{
+		{"all succeeded", BulkResponse{Items: bulkItems(201, 200)}, 0, 2, 2},
+		{"mixed", BulkResponse{Items: bulkItems(201, 429, 409, 429)}, 2, 4, 1},
+		{"whole request rejected", BulkResponse{Status: 429}, 4, 4, 0},
+	}
+
+	for _, tt := range tests {
+		rejected, total := tt.response.RejectedCount(4)
+		if rejected != tt.rejected || total != tt.total {
+			t.Errorf("%s: rejected %d of %d, expected %d of %d", tt.name, rejected, total, tt.rejected, tt.total)
+		}
+		if succeeded := tt.response.SucceededCount(); succeeded != tt.succeeded {
+			t.Errorf("%s: succeeded %d, expected %d", tt.name, succeeded, tt.succeeded)
+		}
+	}
+}
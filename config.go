@@ -0,0 +1,439 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	goflags "github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+IndexConfig 是配置文件中 indices 下为单个源索引指定的配置，覆盖全局的同名选项。
+索引名称支持通配符，例如 logs-*。
+*/
+type IndexConfig struct {
+	Query         string
+	QueryFile     string
+	Fields        string
+	ExcludeFields string
+	Rename        string
+	DestIndex     string
+}
+
+/*配置文件中 indices 下每个索引支持的配置项，名称和命令行参数保持一致。*/
+var indexConfigKeys = []string{"query", "query_file", "fields", "exclude_fields", "rename", "dest_index"}
+
+/*
+解析命令行参数和 --config 指定的配置文件。
+配置文件中的顶层配置项使用命令行参数的长名称，例如 source、dest_auth、workers，
+加载时被转换成命令行参数放在真正的命令行参数之前，所以命令行参数的优先级更高；
+map 类型的参数（例如 index_query_file）两边的配置会合并。
+*/
+func parseConfig(c *Config) error {
+	parser := goflags.NewParser(c, goflags.Default)
+	if _, err := parser.Parse(); err != nil {
+		return err
+	}
+	if len(c.ConfigFile) == 0 {
+		return nil
+	}
+
+	file := c.ConfigFile
+	args, indices, err := loadConfigFile(file, parser)
+	if err != nil {
+		return err
+	}
+
+	*c = Config{}
+	parser = goflags.NewParser(c, goflags.Default)
+	if _, err := parser.ParseArgs(append(args, os.Args[1:]...)); err != nil {
+		return err
+	}
+	c.Indices = indices
+	return nil
+}
+
+/*
+读取 YAML 或 JSON 格式的配置文件（JSON 是 YAML 的子集，使用同一个解析器），转换成命令行参数。
+所有未知的配置项会一次性报告出来，而不是遇到第一个就退出。
+*/
+func loadConfigFile(file string, parser *goflags.Parser) ([]string, map[string]*IndexConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, nil, fmt.Errorf("invalid config file %s: %v", file, err)
+	}
+
+	var keys []string
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var args []string
+	var problems []string
+	var indices map[string]*IndexConfig
+	for _, key := range keys {
+		value := raw[key]
+
+		if key == "indices" {
+			indices, err = parseIndexConfigs(value)
+			if err != nil {
+				problems = append(problems, err.Error())
+			}
+			continue
+		}
+
+		if key == "config" {
+			problems = append(problems, "config can't be nested in config file")
+			continue
+		}
+
+		opt := parser.FindOptionByLongName(key)
+		if opt == nil {
+			problems = append(problems, "unknown key: "+key)
+			continue
+		}
+
+		optArgs, err := configValueToArgs(key, value, reflect.TypeOf(opt.Value()).Kind())
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		args = append(args, optArgs...)
+	}
+
+	if len(problems) > 0 {
+		return nil, nil, fmt.Errorf("invalid config file %s:\n  %s", file, strings.Join(problems, "\n  "))
+	}
+	return args, indices, nil
+}
+
+/*
+把配置文件中的一个值转换成命令行参数：
+  - bool 为 true 时转换成 --key，为 false 时忽略；
+  - map 转换成多个 --key=k:v；
+  - 列表对于可重复的参数转换成多个 --key=v，其余的使用逗号拼接，例如 fields: [title, user.*]。
+*/
+func configValueToArgs(key string, value interface{}, kind reflect.Kind) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if kind != reflect.Bool {
+			return []string{fmt.Sprintf("--%s=%v", key, v)}, nil
+		}
+		if v {
+			return []string{"--" + key}, nil
+		}
+		return nil, nil
+	case map[interface{}]interface{}:
+		if kind != reflect.Map {
+			return nil, fmt.Errorf("%s expects a single value, not a map", key)
+		}
+		var args []string
+		for k, item := range v {
+			args = append(args, fmt.Sprintf("--%s=%v:%v", key, k, configScalar(item)))
+		}
+		sort.Strings(args)
+		return args, nil
+	case []interface{}:
+		if kind == reflect.Map {
+			return nil, fmt.Errorf("%s expects a map, ie: key: value", key)
+		}
+		var items []string
+		for _, item := range v {
+			items = append(items, configScalar(item))
+		}
+		if kind == reflect.Slice {
+			var args []string
+			for _, item := range items {
+				args = append(args, fmt.Sprintf("--%s=%s", key, item))
+			}
+			return args, nil
+		}
+		return []string{fmt.Sprintf("--%s=%s", key, strings.Join(items, ","))}, nil
+	}
+	if kind == reflect.Map {
+		return nil, fmt.Errorf("%s expects a map, ie: key: value", key)
+	}
+	return []string{fmt.Sprintf("--%s=%v", key, value)}, nil
+}
+
+/*把列表中的单个值转换成字符串，列表会使用逗号拼接。*/
+func configScalar(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		var items []string
+		for _, item := range list {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+/*解析配置文件中的 indices，每个索引只支持 indexConfigKeys 中的配置项。*/
+func parseIndexConfigs(value interface{}) (map[string]*IndexConfig, error) {
+	entries, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("indices expects a map of index name to index config")
+	}
+
+	var problems []string
+	indices := map[string]*IndexConfig{}
+	for name, v := range entries {
+		index := fmt.Sprint(name)
+		settings, ok := v.(map[interface{}]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("indices.%s expects a map", index))
+			continue
+		}
+
+		ic := &IndexConfig{}
+		for k, item := range settings {
+			key := fmt.Sprint(k)
+			str := configScalar(item)
+			switch key {
+			case "query":
+				ic.Query = str
+			case "query_file":
+				ic.QueryFile = str
+			case "fields":
+				ic.Fields = str
+			case "exclude_fields":
+				ic.ExcludeFields = str
+			case "rename":
+				ic.Rename = str
+			case "dest_index":
+				ic.DestIndex = str
+			default:
+				problems = append(problems, fmt.Sprintf("unknown key: indices.%s.%s, options: %s", index, key, strings.Join(indexConfigKeys, ",")))
+			}
+		}
+		indices[index] = ic
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, errors.New(strings.Join(problems, "\n  "))
+	}
+	return indices, nil
+}
+
+/*根据源索引名称找到配置文件中对应的配置，先精确匹配，再按最具体的通配符匹配，没有时返回 nil。*/
+func (c *Config) indexConfig(name string) *IndexConfig {
+	if len(c.Indices) == 0 {
+		return nil
+	}
+	var patterns []string
+	for pattern := range c.Indices {
+		patterns = append(patterns, pattern)
+	}
+	if pattern, ok := matchIndexPattern(patterns, name); ok {
+		return c.Indices[pattern]
+	}
+	return nil
+}
+
+/*是否有影响 scroll 请求的配置，有的话这个索引需要单独 scroll。*/
+func (ic *IndexConfig) hasScrollOverride() bool {
+	return ic != nil && (len(ic.Query) > 0 || len(ic.QueryFile) > 0 || len(ic.Fields) > 0 || len(ic.ExcludeFields) > 0)
+}
+
+/*
+在连接任何集群之前检查参数，把所有互相冲突的参数一次性报告出来。
+*/
+func (c *Config) Validate() error {
+	var problems []string
+
+	if len(c.SourceEs) == 0 && len(c.DumpInputFile) == 0 && c.GenerateDocs == 0 {
+		problems = append(problems, "no input, type --help for more details")
+	}
+	if len(c.TargetEs) == 0 && len(c.DumpOutFile) == 0 {
+		problems = append(problems, "no output, type --help for more details")
+	}
+	if len(c.SourceEs) > 0 && len(c.DumpInputFile) > 0 {
+		problems = append(problems, "source and input_file can't be used together")
+	}
+	if len(c.TargetEs) > 0 && len(c.DumpOutFile) > 0 {
+		problems = append(problems, "dest and output_file can't be used together")
+	}
+	if len(c.SourceEs) > 0 && c.SourceEs == c.TargetEs && c.SourceIndexNames == c.TargetIndexName {
+		problems = append(problems, "migration output is the same as the input")
+	}
+
+	/*除了 index 和 create，其余的操作类型都依赖原有的文档 ID，并且只能用于写入目标 Elasticsearch*/
+	if c.OpType != "index" && c.OpType != "create" {
+		if c.RegenerateID || c.RepeatOutputTimes > 1 {
+			problems = append(problems, fmt.Sprintf("op_type %s requires the original document id, can't be used with regenerate_id or repeat_times", c.OpType))
+		}
+	}
+	if c.OpType != "index" && len(c.TargetEs) == 0 {
+		problems = append(problems, fmt.Sprintf("op_type %s only works with destination elasticsearch", c.OpType))
+	}
+
+	/*
+		external 版本控制需要写入文档，并且版本号属于原来的文档 ID。
+		delete 使用源文档的版本号时，目标中版本号相同的文档会返回 409 而不会被删除，所以也不支持。
+	*/
+	if c.PreserveVersion {
+		if c.OpType != "index" {
+			problems = append(problems, fmt.Sprintf("preserve_version only works with op_type index, not %s", c.OpType))
+		}
+		if c.RegenerateID || c.RepeatOutputTimes > 1 {
+			problems = append(problems, "preserve_version requires the original document id, can't be used with regenerate_id or repeat_times")
+		}
+	}
+
+	if c.SplitTypes && len(c.JoinRelations) > 0 {
+		problems = append(problems, "split_types puts parents and children into different indices, can't be used with join_relations")
+	}
+
+	if c.AdaptiveBulk && c.AdaptiveMinBulkSizeInMB > c.AdaptiveMaxBulkSizeInMB {
+		problems = append(problems, "adaptive_min_bulk_size should not be greater than adaptive_max_bulk_size")
+	}
+
+	if c.PerIndex && (len(c.SourceEs) == 0 || len(c.TargetEs) == 0) {
+		problems = append(problems, "per_index only works from source elasticsearch to dest elasticsearch")
+	}
+
+	if c.DryRun && (len(c.SourceEs) == 0 || len(c.TargetEs) == 0) {
+		problems = append(problems, "dry_run only works from source elasticsearch to dest elasticsearch")
+	}
+
+	/*reindex-from-remote 由目标集群读取和写入文档，esm 对文档的处理都不会生效*/
+	if c.ReindexRemote {
+		if len(c.SourceEs) == 0 || len(c.TargetEs) == 0 {
+			problems = append(problems, "reindex_remote only works from source elasticsearch to dest elasticsearch")
+		}
+		if c.OpType != "index" && c.OpType != "create" {
+			problems = append(problems, fmt.Sprintf("reindex_remote only works with op_type index or create, not %s", c.OpType))
+		}
+		if c.RegenerateID || c.RepeatOutputTimes > 1 || c.SplitTypes || len(c.JoinRelations) > 0 || c.PerIndex || len(c.SpillDir) > 0 {
+			problems = append(problems, "reindex_remote can't be used with regenerate_id, repeat_times, split_types, join_relations, per_index or spill_dir")
+		}
+		if c.SampleRate < 1 || c.MaxDocs > 0 || len(c.MaskFields) > 0 {
+			problems = append(problems, "reindex_remote can't be used with sample_rate, max_docs or mask")
+		}
+	}
+
+	/*生成的文档没有 _id，mapping 来自源集群或者 --generate_mapping 文件*/
+	if c.GenerateDocs > 0 {
+		if len(c.DumpInputFile) > 0 {
+			problems = append(problems, "generate_docs can't be used with input_file")
+		}
+		if len(c.SourceEs) == 0 && len(c.GenerateMapping) == 0 {
+			problems = append(problems, "generate_docs needs the mapping from source or generate_mapping")
+		}
+		if len(c.SourceEs) > 0 && len(c.GenerateMapping) > 0 {
+			problems = append(problems, "source and generate_mapping can't be used together")
+		}
+		if len(c.GenerateMapping) > 0 && len(c.TargetIndexName) == 0 {
+			problems = append(problems, "generate_mapping needs dest_index to write the generated documents")
+		}
+		if c.OpType != "index" && c.OpType != "create" {
+			problems = append(problems, fmt.Sprintf("generated documents have no id, op_type %s can't be used with generate_docs", c.OpType))
+		}
+		if c.ReindexRemote || c.PerIndex || c.DryRun {
+			problems = append(problems, "generate_docs can't be used with reindex_remote, per_index or dry_run")
+		}
+		if c.GenerateCardinality < 1 || c.GenerateArraySize < 1 {
+			problems = append(problems, "generate_cardinality and generate_array_size should be at least 1")
+		}
+		if _, _, err := parseGenerateDateRange(c.GenerateDateRange); err != nil {
+			problems = append(problems, err.Error())
+		}
+	} else if c.GenerateDocs < 0 {
+		problems = append(problems, "generate_docs should not be negative")
+	} else if len(c.GenerateMapping) > 0 {
+		problems = append(problems, "generate_mapping only works with generate_docs")
+	}
+
+	if c.Benchmark {
+		if len(c.TargetEs) == 0 || c.ReindexRemote {
+			problems = append(problems, "benchmark only works with bulk requests to dest elasticsearch, not with output_file or reindex_remote")
+		}
+		if c.BenchmarkInterval < 0 {
+			problems = append(problems, "benchmark_interval should not be negative")
+		}
+	} else if len(c.BenchmarkOutput) > 0 {
+		problems = append(problems, "benchmark_output only works with benchmark")
+	}
+
+	if c.SampleRate <= 0 || c.SampleRate > 1 {
+		problems = append(problems, "sample_rate should be greater than 0 and not greater than 1")
+	}
+	if c.MaxDocs < 0 {
+		problems = append(problems, "max_docs should not be negative")
+	}
+
+	for field, policy := range c.MaskFields {
+		if _, err := parseMaskPolicy(policy); err != nil {
+			problems = append(problems, fmt.Sprintf("mask %s: %v", field, err))
+		}
+	}
+
+	/*CSV 的输入没有 _index，文档写入 --dest_index*/
+	if c.InputFileType == "csv" || c.OutputFileType == "csv" {
+		if _, err := newCSVFormat(c); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if c.InputFileType == "csv" && len(c.TargetEs) > 0 && len(c.TargetIndexName) == 0 {
+		problems = append(problems, "csv input needs dest_index to write the documents")
+	}
+	for column, t := range c.CsvColumnTypes {
+		if !csvColumnTypes[t] {
+			problems = append(problems, fmt.Sprintf("unknown type %s of csv column %s, options: string,long,double,boolean,json,array", t, column))
+		}
+	}
+	if c.OutputFileType == "csv" && len(c.DumpOutFile) == 0 {
+		problems = append(problems, "output_file_type csv only works with output_file")
+	}
+
+	if len(c.SpillDir) > 0 && c.SpillSegmentSizeInMB < 1 {
+		problems = append(problems, "spill_segment_size should be at least 1")
+	}
+	if len(c.SpillDir) > 0 && c.SpillMaxSizeInMB > 0 && c.SpillMaxSizeInMB < c.SpillSegmentSizeInMB {
+		problems = append(problems, "spill_max_size should not be less than spill_segment_size")
+	}
+
+	for name, ic := range c.Indices {
+		if len(ic.QueryFile) > 0 {
+			if _, ok := c.IndexQueryFiles[name]; ok {
+				problems = append(problems, fmt.Sprintf("query file of index %s is set by both index_query_file and indices.%s.query_file", name, name))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	goflags "github.com/jessevdk/go-flags"
+)
+
+/*和命令行一样解析参数，未指定的参数使用默认值*/
+func parseTestConfig(t *testing.T, args ...string) *Config {
+	c := &Config{}
+	if _, err := goflags.NewParser(c, goflags.None).ParseArgs(args); err != nil {
+		t.Fatalf("parse %v: %v", args, err)
+	}
+	return c
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		problem string
+	}{
+		{"valid migration", []string{"-s", "http://a:9200", "-d", "http://b:9200", "-x", "src"}, ""},
+		{"no input", []string{"-d", "http://b:9200"}, "no input"},
+		{"no output", []string{"-s", "http://a:9200"}, "no output"},
+		{"same input and output", []string{"-s", "http://a:9200", "-d", "http://a:9200", "-x", "a", "-y", "a"}, "same as the input"},
+		{"preserve version with index", []string{"-s", "http://a:9200", "-d", "http://b:9200", "--preserve_version"}, ""},
+		{"preserve version with delete", []string{"-s", "http://a:9200", "-d", "http://b:9200", "--preserve_version", "--op_type=delete"}, "preserve_version only works with op_type index"},
+		{"preserve version with create", []string{"-s", "http://a:9200", "-d", "http://b:9200", "--preserve_version", "--op_type=create"}, "preserve_version only works with op_type index"},
+		{"preserve version with regenerate id", []string{"-s", "http://a:9200", "-d", "http://b:9200", "--preserve_version", "--regenerate_id"}, "requires the original document id"},
+		{"delete without target", []string{"-s", "http://a:9200", "-o", "out.json", "--op_type=delete"}, "only works with destination elasticsearch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := parseTestConfig(t, tt.args...).Validate()
+			if len(tt.problem) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.problem) {
+				t.Errorf("got %v, expected %q", err, tt.problem)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		args     []string
+		indices  map[string]*IndexConfig
+		problems []string
+	}{
+		{
+			name: "yaml",
+			content: `source: http://a:9200
+workers: 4
+copy_settings: true
+copy_mappings: false
+fields: [title, user.*]
+mask:
+  user.email: email
+  ssn: redact
+indices:
+  logs-*:
+    query: "status:200"
+    exclude_fields: [raw, html]
+`,
+			args:    []string{"--copy_settings", "--fields=title,user.*", "--mask=ssn:redact", "--mask=user.email:email", "--source=http://a:9200", "--workers=4"},
+			indices: map[string]*IndexConfig{"logs-*": {Query: "status:200", ExcludeFields: "raw,html"}},
+		},
+		{
+			name:    "json",
+			content: `{"dest": "http://b:9200", "dest_index": "logs", "bulk_size": 10}`,
+			args:    []string{"--bulk_size=10", "--dest=http://b:9200", "--dest_index=logs"},
+		},
+		{
+			name: "problems",
+			content: `sources: http://a:9200
+config: other.yml
+workers: {a: 1}
+mask: [x]
+indices:
+  logs:
+    dest: x
+`,
+			problems: []string{"unknown key: sources", "config can't be nested", "workers expects a single value", "mask expects a map", "unknown key: indices.logs.dest"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "esm-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			f.WriteString(tt.content)
+			f.Close()
+
+			args, indices, err := loadConfigFile(f.Name(), goflags.NewParser(&Config{}, goflags.None))
+			if len(tt.problems) > 0 {
+				for _, problem := range tt.problems {
+					if err == nil || !strings.Contains(err.Error(), problem) {
+						t.Errorf("got %v, expected %q", err, problem)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args = %q, expected %q", args, tt.args)
+			}
+			if !reflect.DeepEqual(indices, tt.indices) {
+				t.Errorf("indices = %+v, expected %+v", indices, tt.indices)
+			}
+		})
+	}
+}
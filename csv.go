@@ -0,0 +1,465 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cheggaaa/pb"
+	log "github.com/cihub/seelog"
+)
+
+/*--csv_type 支持的列类型，没有指定的列是 string*/
+var csvColumnTypes = map[string]bool{"string": true, "long": true, "double": true, "boolean": true, "json": true, "array": true}
+
+/*CSV 的分隔符和引号，标准库 encoding/csv 的引号固定为 "，所以这里自己实现读写*/
+type csvFormat struct {
+	delimiter rune
+	quote     rune
+}
+
+/*解析 --csv_delimiter 和 --csv_quote，分隔符可以写成 \t 或者 tab。*/
+func newCSVFormat(config *Config) (csvFormat, error) {
+	delimiter := config.CsvDelimiter
+	if delimiter == `\t` || delimiter == "tab" {
+		delimiter = "\t"
+	}
+	f := csvFormat{}
+	if utf8.RuneCountInString(delimiter) != 1 {
+		return f, fmt.Errorf("csv_delimiter should be a single character, not %q", config.CsvDelimiter)
+	}
+	if utf8.RuneCountInString(config.CsvQuote) != 1 {
+		return f, fmt.Errorf("csv_quote should be a single character, not %q", config.CsvQuote)
+	}
+	f.delimiter, _ = utf8.DecodeRuneInString(delimiter)
+	f.quote, _ = utf8.DecodeRuneInString(config.CsvQuote)
+	if f.delimiter == f.quote || f.delimiter == '\n' || f.delimiter == '\r' {
+		return f, fmt.Errorf("invalid csv_delimiter %q", config.CsvDelimiter)
+	}
+	return f, nil
+}
+
+/*
+csvReader 按照 RFC 4180 读取记录：以引号开头的字段可以包含分隔符和换行，字段中的引号写成两个引号。
+line 是当前记录结束的行号，用于输出错误。
+*/
+type csvReader struct {
+	r      *bufio.Reader
+	format csvFormat
+	line   int
+}
+
+func newCSVReader(r io.Reader, format csvFormat) *csvReader {
+	return &csvReader{r: bufio.NewReader(r), format: format}
+}
+
+/*读取一条记录，文件结束时返回 io.EOF。*/
+func (r *csvReader) Read() ([]string, error) {
+	var record []string
+	var field strings.Builder
+	started, inQuotes, quoted := false, false, false
+	for {
+		ch, _, err := r.r.ReadRune()
+		if err == io.EOF {
+			if !started {
+				return nil, io.EOF
+			}
+			if inQuotes {
+				return nil, fmt.Errorf("line %d: unterminated quoted field", r.line+1)
+			}
+			r.line++
+			return append(record, field.String()), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		started = true
+
+		if inQuotes {
+			if ch == r.format.quote {
+				next, _, err := r.r.ReadRune()
+				if err == nil && next == r.format.quote {
+					field.WriteRune(ch)
+					continue
+				}
+				if err == nil {
+					r.r.UnreadRune()
+				}
+				inQuotes = false
+				continue
+			}
+			if ch == '\n' {
+				r.line++
+			}
+			field.WriteRune(ch)
+			continue
+		}
+
+		switch ch {
+		case r.format.quote:
+			if field.Len() == 0 && !quoted {
+				inQuotes, quoted = true, true
+			} else {
+				field.WriteRune(ch)
+			}
+		case r.format.delimiter:
+			record = append(record, field.String())
+			field.Reset()
+			quoted = false
+		case '\r':
+			if next, _, err := r.r.ReadRune(); err == nil && next != '\n' {
+				r.r.UnreadRune()
+			}
+			fallthrough
+		case '\n':
+			r.line++
+			return append(record, field.String()), nil
+		default:
+			field.WriteRune(ch)
+		}
+	}
+}
+
+/*写入一条记录，包含分隔符、引号、换行或者首尾空格的字段加上引号。*/
+func (f csvFormat) writeRecord(w *bufio.Writer, record []string) error {
+	for i, value := range record {
+		if i > 0 {
+			w.WriteRune(f.delimiter)
+		}
+		if strings.ContainsRune(value, f.delimiter) || strings.ContainsRune(value, f.quote) || strings.ContainsAny(value, "\r\n") ||
+			len(value) > 0 && (value[0] == ' ' || value[len(value)-1] == ' ') {
+			q := string(f.quote)
+			value = q + strings.Replace(value, q, q+q, -1) + q
+		}
+		if _, err := w.WriteString(value); err != nil {
+			return err
+		}
+	}
+	_, err := w.WriteString("\n")
+	return err
+}
+
+/*
+--input_file_type=csv：第一行是列名（--csv_no_header 时列名为 col1、col2...），每一行生成一个文档，写入 --dest_index。
+列名中的 . 表示嵌套的字段，例如 user.name；--csv_id_column 指定的列作为文档的 _id，不写入 _source；
+空的单元格不写入文档，其他的值按照 --csv_type 转换类型，转换失败的行输出错误后跳过。
+*/
+func (m *Migrator) readCSVFile(f io.Reader, bar *pb.ProgressBar) {
+	format, err := newCSVFormat(m.Config)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	r := newCSVReader(f, format)
+
+	var columns []string
+	if !m.Config.CsvNoHeader {
+		header, err := r.Read()
+		if err != nil {
+			if err != io.EOF {
+				log.Error(err)
+			}
+			return
+		}
+		for _, name := range header {
+			columns = append(columns, strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		}
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Error(err)
+			break
+		}
+		if len(record) == 1 && len(record[0]) == 0 {
+			continue
+		}
+		doc, err := m.csvDocument(columns, record)
+		if err != nil {
+			log.Errorf("line %d: %v", r.line, err)
+			continue
+		}
+		m.sendDoc(doc)
+		bar.Increment()
+	}
+}
+
+/*把一行转换成文档，文档没有 _type，写入时使用 --type_override 或者目标集群默认的 type。*/
+func (m *Migrator) csvDocument(columns []string, record []string) (map[string]interface{}, error) {
+	if columns != nil && len(record) > len(columns) {
+		return nil, fmt.Errorf("%d fields, but the header has %d columns", len(record), len(columns))
+	}
+
+	id := ""
+	source := map[string]interface{}{}
+	for i, value := range record {
+		name := fmt.Sprintf("col%d", i+1)
+		if columns != nil {
+			name = columns[i]
+		}
+		if len(m.Config.CsvIdColumn) > 0 && name == m.Config.CsvIdColumn {
+			id = value
+			continue
+		}
+		if len(value) == 0 || len(name) == 0 {
+			continue
+		}
+		v, err := m.csvValue(value, m.Config.CsvColumnTypes[name])
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", name, err)
+		}
+		setFieldPath(source, name, v)
+	}
+
+	return map[string]interface{}{
+		"_index":  m.Config.TargetIndexName,
+		"_type":   "",
+		"_id":     id,
+		"_source": source,
+	}, nil
+}
+
+/*按照 --csv_type 转换单元格的值*/
+func (m *Migrator) csvValue(value, columnType string) (interface{}, error) {
+	switch columnType {
+	case "long":
+		return strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	case "double":
+		return strconv.ParseFloat(strings.TrimSpace(value), 64)
+	case "boolean":
+		return strconv.ParseBool(strings.TrimSpace(value))
+	case "json":
+		var v interface{}
+		err := DecodeJson(value, &v)
+		return v, err
+	case "array":
+		items := []interface{}{}
+		for _, item := range strings.Split(value, m.Config.CsvArraySeparator) {
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return value, nil
+}
+
+/*按照 . 分隔的路径写入嵌套的对象，路径上已经有非对象的值时直接使用完整的名称*/
+func setFieldPath(doc map[string]interface{}, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	node := doc
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := node[part].(map[string]interface{})
+		if !ok {
+			if _, exists := node[part]; exists {
+				doc[path] = value
+				return
+			}
+			child = map[string]interface{}{}
+			node[part] = child
+		}
+		node = child
+	}
+	node[parts[len(parts)-1]] = value
+}
+
+/*
+--output_file_type=csv：每个文档写一行，列由 --csv_fields 指定，嵌套的字段使用 . 分隔的路径，_id、_index、_type 也可以作为列；
+没有指定时使用 _id 和第一个文档中的所有字段，后面的文档中多出的字段会提示出来。
+标量的数组使用 --csv_array_separator 连接，对象和对象的数组输出为 JSON。
+追加到已有的文件时不再写入列名。
+*/
+type csvDumpWriter struct {
+	format    csvFormat
+	columns   []string
+	inferred  bool /*列来自第一个文档*/
+	header    bool
+	separator string
+	missing   map[string]bool
+}
+
+func (c *Migrator) newCSVDumpWriter(header bool) (*csvDumpWriter, error) {
+	format, err := newCSVFormat(c.Config)
+	if err != nil {
+		return nil, err
+	}
+	return &csvDumpWriter{
+		format:    format,
+		columns:   splitFieldList(c.Config.CsvFields),
+		header:    header && !c.Config.CsvNoHeader,
+		separator: c.Config.CsvArraySeparator,
+		missing:   map[string]bool{},
+	}, nil
+}
+
+func (cw *csvDumpWriter) Write(w *bufio.Writer, doc map[string]interface{}) error {
+	source, _ := doc["_source"].(map[string]interface{})
+	if raw, ok := doc["_source"].(json.RawMessage); ok {
+		if err := DecodeJsonBytes(raw, &source); err != nil {
+			return err
+		}
+	}
+
+	flat := map[string]interface{}{}
+	flattenFields(source, "", flat)
+	if cw.columns == nil {
+		cw.inferred = true
+		cw.columns = []string{"_id"}
+		var names []string
+		for name := range flat {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		cw.columns = append(cw.columns, names...)
+	} else if cw.inferred {
+		cw.warnMissing(flat)
+	}
+
+	if cw.header {
+		cw.header = false
+		if err := cw.format.writeRecord(w, cw.columns); err != nil {
+			return err
+		}
+	}
+
+	record := make([]string, len(cw.columns))
+	for i, column := range cw.columns {
+		var v interface{}
+		switch column {
+		case "_id", "_index", "_type":
+			v = doc[column]
+		default:
+			var ok bool
+			if v, ok = flat[column]; !ok {
+				v = fieldPathValue(source, column)
+			}
+		}
+		s, err := cw.format.cell(v, cw.separator)
+		if err != nil {
+			return err
+		}
+		record[i] = s
+	}
+	return cw.format.writeRecord(w, record)
+}
+
+/*没有通过 --csv_fields 指定列时，提示第一个文档之后出现的新字段，每个字段只提示一次*/
+func (cw *csvDumpWriter) warnMissing(flat map[string]interface{}) {
+	for name := range flat {
+		if cw.missing[name] {
+			continue
+		}
+		found := false
+		for _, column := range cw.columns {
+			if column == name || strings.HasPrefix(name, column+".") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			cw.missing[name] = true
+			log.Warnf("field %s is not in the csv columns, use --csv_fields to select the columns", name)
+		}
+	}
+}
+
+/*把嵌套的对象展开成 . 分隔的路径，数组作为一个值*/
+func flattenFields(node map[string]interface{}, prefix string, flat map[string]interface{}) {
+	for name, v := range node {
+		if child, ok := v.(map[string]interface{}); ok && len(child) > 0 {
+			flattenFields(child, prefix+name+".", flat)
+			continue
+		}
+		flat[prefix+name] = v
+	}
+}
+
+/*按照 . 分隔的路径读取字段，路径指向对象时返回整个对象*/
+func fieldPathValue(doc map[string]interface{}, path string) interface{} {
+	var node interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = m[part]
+	}
+	return node
+}
+
+/*单元格的值，null 为空，标量的数组用 separator 连接，对象和对象的数组输出为 JSON*/
+func (f csvFormat) cell(v interface{}, separator string) (string, error) {
+	switch value := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case json.Number, bool, int, int64:
+		return fmt.Sprint(value), nil
+	case []interface{}:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				b, err := json.Marshal(value)
+				return string(b), err
+			}
+			s, err := f.cell(item, separator)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, separator), nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+/*从 DocChan 读取文档写入 CSV，和 NewFileDumpWorker 一样跳过 404 和缺少元数据的文档*/
+func (c *Migrator) writeCSVFile(w *bufio.Writer, bar *pb.ProgressBar, header bool) {
+	cw, err := c.newCSVDumpWriter(header)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for docI := range c.DocChan {
+		c.releaseDoc(docI)
+		if status, ok := docI["status"]; ok && status.(int) == 404 {
+			log.Error("error: ", docI["response"])
+			continue
+		}
+		if _, ok := docI["_source"]; !ok {
+			continue
+		}
+		if err := cw.Write(w, docI); err != nil {
+			log.Error(err)
+		}
+		bar.Increment()
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCSVReaderRead(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		format   csvFormat
+		expected [][]string
+		valid    bool
+	}{
+		{"simple", "a,b\n1,2\n", csvFormat{',', '"'}, [][]string{{"a", "b"}, {"1", "2"}}, true},
+		{"no trailing newline", "a,b\r\n1,", csvFormat{',', '"'}, [][]string{{"a", "b"}, {"1", ""}}, true},
+		{"quoted", "\"a,b\",\"say \"\"hi\"\"\"\n", csvFormat{',', '"'}, [][]string{{"a,b", `say "hi"`}}, true},
+		{"newline in quotes", "\"1\n2\",x\n", csvFormat{',', '"'}, [][]string{{"1\n2", "x"}}, true},
+		{"quote inside field", "a\"b,c\n", csvFormat{',', '"'}, [][]string{{`a"b`, "c"}}, true},
+		{"tab and single quote", "'a\tb'\tc\n", csvFormat{'\t', '\''}, [][]string{{"a\tb", "c"}}, true},
+		{"unterminated quote", "\"abc\n", csvFormat{',', '"'}, nil, false},
+	}
+
+	for _, tt := range tests {
+		r := newCSVReader(strings.NewReader(tt.input), tt.format)
+		var records [][]string
+		var err error
+		for {
+			var record []string
+			if record, err = r.Read(); err != nil {
+				break
+			}
+			records = append(records, record)
+		}
+		if (err == io.EOF) != tt.valid {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(records, tt.expected) {
+			t.Errorf("%s: got %q, expected %q", tt.name, records, tt.expected)
+		}
+	}
+}
+
+func TestCSVWriteRecord(t *testing.T) {
+	format := csvFormat{';', '"'}
+	record := []string{"plain", "a;b", `say "hi"`, "two\nlines", " padded", ""}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := format.writeRecord(w, record); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	got, err := newCSVReader(&buf, format).Read()
+	if err != nil || !reflect.DeepEqual(got, record) {
+		t.Errorf("round trip = %q, %v, expected %q", got, err, record)
+	}
+}
+
+func TestSetFieldPath(t *testing.T) {
+	doc := map[string]interface{}{}
+	setFieldPath(doc, "name", "a")
+	setFieldPath(doc, "user.name", "b")
+	setFieldPath(doc, "user.address.city", "c")
+	setFieldPath(doc, "name.first", "d")
+
+	expected := map[string]interface{}{
+		"name":       "a",
+		"name.first": "d",
+		"user": map[string]interface{}{
+			"name":    "b",
+			"address": map[string]interface{}{"city": "c"},
+		},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("got %v, expected %v", doc, expected)
+	}
+}
+
+func TestCSVValue(t *testing.T) {
+	m := &Migrator{Config: &Config{CsvArraySeparator: "|"}}
+	tests := []struct {
+		value, columnType string
+		expected          interface{}
+		valid             bool
+	}{
+		{"abc", "", "abc", true},
+		{" 42 ", "long", int64(42), true},
+		{"4.5", "double", 4.5, true},
+		{"true", "boolean", true, true},
+		{"a|b", "array", []interface{}{"a", "b"}, true},
+		{"x", "long", nil, false},
+		{"yes", "boolean", nil, false},
+	}
+
+	for _, tt := range tests {
+		got, err := m.csvValue(tt.value, tt.columnType)
+		if (err == nil) != tt.valid {
+			t.Errorf("%q as %s: unexpected error %v", tt.value, tt.columnType, err)
+			continue
+		}
+		if tt.valid && !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%q as %s: got %#v, expected %#v", tt.value, tt.columnType, got, tt.expected)
+		}
+	}
+}
+
+func TestCSVDocument(t *testing.T) {
+	m := &Migrator{Config: &Config{TargetIndexName: "customers", CsvIdColumn: "id", CsvColumnTypes: map[string]string{"age": "long"}}}
+
+	doc, err := m.csvDocument([]string{"id", "user.name", "age", "note"}, []string{"7", "bob", "30", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"_index":  "customers",
+		"_type":   "",
+		"_id":     "7",
+		"_source": map[string]interface{}{"user": map[string]interface{}{"name": "bob"}, "age": int64(30)},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("got %v, expected %v", doc, expected)
+	}
+
+	if _, err := m.csvDocument([]string{"id"}, []string{"1", "2"}); err == nil {
+		t.Errorf("expected error for extra fields")
+	}
+	if _, err := m.csvDocument([]string{"age"}, []string{"old"}); err == nil {
+		t.Errorf("expected error for invalid long")
+	}
+	if doc, _ := m.csvDocument(nil, []string{"x"}); !reflect.DeepEqual(doc["_source"], map[string]interface{}{"col1": "x"}) {
+		t.Errorf("without header: %v", doc)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+/*
+DocBuffer 统计 DocChan 中缓存的文档数量和大小，并按照 --buffer_size 限制缓存的总字节数。
+--buffer_count 只能限制文档的数量，文档很大时仍然可能耗尽内存，
+所以读取端写入 DocChan 之前先通过 Acquire 占用文档的大小，缓存满了就阻塞，写入端从 DocChan 取出文档之后通过 Release 释放。
+limit 为 0 时不限制大小，只做统计。
+*/
+type DocBuffer struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	bytes int64
+	docs  int64
+}
+
+func NewDocBuffer(limit int64) *DocBuffer {
+	b := &DocBuffer{limit: limit}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+/*
+占用 size 字节的缓存，缓存已满时阻塞，直到写入端释放出足够的空间。
+缓存为空时总是允许写入，避免单个超过限制的文档永远无法写入。
+*/
+func (b *DocBuffer) Acquire(size int) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	for b.limit > 0 && b.docs > 0 && b.bytes+int64(size) > b.limit {
+		b.cond.Wait()
+	}
+	b.bytes += int64(size)
+	b.docs++
+	b.lock.Unlock()
+}
+
+/*和 Acquire 相同，但缓存已满时不等待，直接返回 false。*/
+func (b *DocBuffer) TryAcquire(size int) bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.limit > 0 && b.docs > 0 && b.bytes+int64(size) > b.limit {
+		return false
+	}
+	b.bytes += int64(size)
+	b.docs++
+	return true
+}
+
+/*释放一个文档占用的缓存，唤醒等待的读取端。*/
+func (b *DocBuffer) Release(size int) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	b.bytes -= int64(size)
+	b.docs--
+	b.lock.Unlock()
+	b.cond.Broadcast()
+}
+
+/*当前缓存的字节数和文档数。*/
+func (b *DocBuffer) Stats() (int64, int64) {
+	if b == nil {
+		return 0, 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.bytes, b.docs
+}
+
+/*通过 expvar 输出的指标，访问 http://localhost:6060/debug/vars 查看。*/
+func (b *DocBuffer) Vars() interface{} {
+	bytes, docs := b.Stats()
+	return map[string]int64{
+		"bytes":       bytes,
+		"docs":        docs,
+		"limit_bytes": b.limit,
+	}
+}
+
+func (b *DocBuffer) String() string {
+	bytes, docs := b.Stats()
+	if b.limit > 0 {
+		return fmt.Sprintf("%d docs, %.1fMB of %.1fMB", docs, float64(bytes)/1024/1024, float64(b.limit)/1024/1024)
+	}
+	return fmt.Sprintf("%d docs, %.1fMB", docs, float64(bytes)/1024/1024)
+}
+
+/*每隔 interval 在日志中输出一次缓存的使用情况，缓存为空时不输出。*/
+func (b *DocBuffer) Report(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, docs := b.Stats(); docs > 0 {
+			log.Infof("buffered documents: %s", b)
+		}
+	}
+}
+
+/*
+所有的读取端（scroll、文件）都通过这个方法写入 DocChan，--sample_rate、--max_docs 和 --mask 也在这里生效。
+开启 --spill_dir 时，DocChan 或者缓存已满的文档写入磁盘队列，不阻塞读取端；否则一直等待到可以写入为止。
+磁盘队列中还有文档时，新的文档也写入磁盘队列，保证文档的顺序不变。
+*/
+func (c *Migrator) sendDoc(doc map[string]interface{}) {
+	/*没有被采样选中，或者索引已经达到 --max_docs 的文档直接丢弃*/
+	if !c.Sampler.Accept(doc) {
+		return
+	}
+	/*脱敏在写入 DocChan 之前完成，磁盘队列、bulk 和导出文件中都不会出现原始的值*/
+	c.Masker.Apply(doc)
+	if c.Spill != nil {
+		if c.Spill.Empty() && c.tryPushDoc(doc) {
+			return
+		}
+		err := c.Spill.Put(doc)
+		if err == nil {
+			return
+		}
+		log.Error("failed to spill document to disk: ", err)
+	}
+	c.pushDoc(doc)
+}
+
+/*写入 DocChan 之前先占用缓存，缓存满了会阻塞。*/
+func (c *Migrator) pushDoc(doc map[string]interface{}) {
+	c.DocBuffer.Acquire(docSize(doc))
+	c.DocChan <- doc
+}
+
+/*不阻塞地写入 DocChan，缓存或者 DocChan 已满时返回 false。*/
+func (c *Migrator) tryPushDoc(doc map[string]interface{}) bool {
+	size := docSize(doc)
+	if !c.DocBuffer.TryAcquire(size) {
+		return false
+	}
+	select {
+	case c.DocChan <- doc:
+		return true
+	default:
+		c.DocBuffer.Release(size)
+		return false
+	}
+}
+
+/*从 DocChan 取出文档后释放它占用的缓存，必须在修改文档之前调用，保证和 sendDoc 计算出的大小一致。*/
+func (c *Migrator) releaseDoc(doc map[string]interface{}) {
+	if doc == nil {
+		return
+	}
+	c.DocBuffer.Release(docSize(doc))
+}
+
+/*
+估算文档编码成 JSON 之后的字节数，用于限制缓存大小，不需要完全精确。
+原始的 _source（json.RawMessage）直接使用它的长度。
+*/
+func docSize(v interface{}) int {
+	switch t := v.(type) {
+	case nil:
+		return 4
+	case json.RawMessage:
+		return len(t)
+	case string:
+		return len(t) + 2
+	case json.Number:
+		return len(t)
+	case bool:
+		return 5
+	case map[string]interface{}:
+		size := 2
+		for k, item := range t {
+			size += len(k) + 4 + docSize(item)
+		}
+		return size
+	case []interface{}:
+		size := 2
+		for _, item := range t {
+			size += docSize(item) + 1
+		}
+		return size
+	}
+	return 8
+}
@@ -16,7 +16,11 @@ limitations under the License.
 
 package main
 
-import "sync"
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
 
 /* 定义了一个 Indexes 的结构体，以空接口为值的 map 类型。 */
 type Indexes map[string]interface{}
@@ -27,6 +31,11 @@ type Document struct {
 	Id      string                 `json:"_id,omitempty"`     /*文档的唯一标识符。*/
 	source  map[string]interface{} `json:"_source,omitempty"` /*文档的数据，以 map[string]interface{} 类型存储。*/
 	Routing string                 `json:"routing,omitempty"` /*在 Elasticsearch 6.x 之后，只支持 routing 字段进行路由操作，这个字段表示文档的路由值。*/
+	Parent  string                 `json:"parent,omitempty"`  /*1.x 到 5.x 子文档的父文档 ID，目标为 6.x 及以上版本时会被翻译成 join 字段。*/
+	Version     int64              `json:"version,omitempty"`      /*开启 --preserve_version 时，表示源文档的版本号。*/
+	VersionType string             `json:"version_type,omitempty"` /*开启 --preserve_version 时为 external，目标中已有的版本号不小于 Version 时拒绝写入。*/
+	rawSource   json.RawMessage    /*不需要修改 _source 时，源文档原始的 _source，直接写入 bulk 请求，此时 source 为 nil。*/
+}
 
 /* 定义了 Elasticsearch 组件 Scroll API 返回结果的结构体。 */
 type Scroll struct {
@@ -104,12 +113,20 @@ type ClusterHealth struct {
 }
 
 // {"took":23,"errors":true,"items":[{"create":{"_index":"mybank3","_type":"my_doc2","_id":"AWz8rlgUkzP-cujdA_Fv","status":409,"error":{"type":"version_conflict_engine_exception","reason":"[AWz8rlgUkzP-cujdA_Fv]: version conflict, document already exists (current version [1])","index_uuid":"w9JZbJkfSEWBI-uluWorgw","shard":"0","index":"mybank3"}}},{"create":{"_index":"mybank3","_type":"my_doc4","_id":"AWz8rpF2kzP-cujdA_Fx","status":400,"error":{"type":"illegal_argument_exception","reason":"Rejecting mapping update to [mybank3] as the final mapping would have more than 1 type: [my_doc2, my_doc4]"}}},{"create":{"_index":"mybank3","_type":"my_doc1","_id":"AWz8rjpJkzP-cujdA_Fu","status":400,"error":{"type":"illegal_argument_exception","reason":"Rejecting mapping update to [mybank3] as the final mapping would have more than 1 type: [my_doc2, my_doc1]"}}},{"create":{"_index":"mybank3","_type":"my_doc3","_id":"AWz8rnbckzP-cujdA_Fw","status":400,"error":{"type":"illegal_argument_exception","reason":"Rejecting mapping update to [mybank3] as the final mapping would have more than 1 type: [my_doc2, my_doc3]"}}},{"create":{"_index":"mybank3","_type":"my_doc5","_id":"AWz8rrsEkzP-cujdA_Fy","status":400,"error":{"type":"illegal_argument_exception","reason":"Rejecting mapping update to [mybank3] as the final mapping would have more than 1 type: [my_doc2, my_doc5]"}}},{"create":{"_index":"mybank3","_type":"doc","_id":"3","status":400,"error":{"type":"illegal_argument_exception","reason":"Rejecting mapping update to [mybank3] as the final mapping would have more than 1 type: [my_doc2, doc]"}}}]}
+/*索引主分片的统计信息，来自 _stats/docs,store。*/
+type IndexStats struct {
+	DocsCount        int64 /*主分片中的文档数*/
+	StoreSizeInBytes int64 /*主分片的存储大小，单位字节*/
+}
+
 /*定义 BulkResponse 结构的 Go 代码，用于解析 Elasticsearch 的 Bulk API 的响应结果。*/
 type BulkResponse struct {
 	Took   int                 `json:"took,omitempty"`	/*总共用时*/
 	Errors bool                `json:"errors,omitempty"`/*是否存在错误*/
 	Items  []map[string]Action `json:"items,omitempty"` /*Items 字段是一个由 map[string]Action 组成的切片，其中 map 的键表示操作类型（如 "create"），
 														Action 是该操作的具体信息，包括索引名、文档类型、文档ID、响应状态码及错误信息等。*/
+	Status int                 `json:"status,omitempty"`/*整个 bulk 请求失败时（例如 429 队列已满）返回的状态码*/
+	Error  interface{}         `json:"error,omitempty"` /*整个 bulk 请求失败时返回的错误信息*/
 }
 
 /*表示 Elasticsearch 中执行操作时的结果。*/
@@ -118,25 +135,53 @@ type Action struct {
 	Type   string      `json:"_type,omitempty"`		/*表示文档的类型，一般不建议使用，已经在 Elasticsearch 7.x 版本中去除。*/
 	Id     string      `json:"_id,omitempty"`		/*表示操作执行的目标文档的 ID。*/
 	Status int         `json:"status,omitempty"`	/*表示操作执行的状态码。*/
+	Result string      `json:"result,omitempty"`	/*表示操作的结果，如 created、updated、noop、deleted、not_found，5.x 及以上版本才有。*/
 	Error  interface{} `json:"error,omitempty"`		/*表示操作执行时的错误信息，如果操作成功，则该字段为 nil。*/
 }
 
 type Migrator struct {
 	FlushLock   sync.Mutex					/*FlushLock 字段是一个互斥锁，用于同步批量写入操作。*/
 	DocChan     chan map[string]interface{}	/*DocChan 字段是一个channel，用于传递待迁移的文档数据。*/
+	DocBuffer   *DocBuffer	/*DocBuffer 统计 DocChan 中缓存的文档数量和字节数，并按照 --buffer_size 限制缓存的大小。*/
+	Spill       *SpillQueue	/*Spill 是开启 --spill_dir 时 DocChan 前面的磁盘队列，为 nil 时直接写入 DocChan。*/
 	SourceESAPI ESAPI	/*SourceESAPI 和 TargetESAPI 是两个字段，类型均为 ESAPI。它们是源 Elasticsearch 和目标 Elasticsearch 的 API 接口，用于实现数据的复制。*/
 	TargetESAPI ESAPI
 	SourceAuth  *Auth	/*SourceAuth 和 TargetAuth 是两个字段，类型均为 Auth。表示源 Elasticsearch 和目标 Elasticsearch 的认证信息。*/
 	TargetAuth  *Auth
 	Config      *Config	/*Config 是一个指向 Config 结构体的指针，表示迁移任务的一些配置信息，如索引名称、文档类型、批量写入数据大小等。*/
+	SourceFilter *SourceFilter	/*SourceFilter 是客户端的 _source 过滤器，只有源集群不支持服务端过滤时才会设置。*/
+	IndexSourceFilters map[string]*SourceFilter	/*IndexSourceFilters 是配置文件中单独配置了字段的索引使用的客户端 _source 过滤器，key 为索引名称。*/
+	BulkDocsLimiter  *RateLimiter	/*BulkDocsLimiter 和 BulkBytesLimiter 是所有 bulk worker 共用的限速器，分别按文档数和字节数限速，nil 表示不限速。*/
+	BulkBytesLimiter *RateLimiter
+	ScrollLimiter    *RateLimiter	/*ScrollLimiter 是所有 scroll 共用的限速器，按请求数限速，nil 表示不限速。*/
+	BulkController   *BulkController	/*BulkController 根据目标集群的反馈动态调整 bulk 大小和活跃 worker 数量，nil 表示使用固定的配置。*/
+	TypeSplitter     *TypeSplitter	/*TypeSplitter 把多 type 的索引拆分成每个 type 一个索引，只有开启 --split_types 时才会设置。*/
+	Join             *JoinTranslator	/*Join 把 _parent 父子关系翻译成 join 字段，只有目标是 6.x 及以上版本时才会设置。*/
+	TargetTypeName   string	/*TargetTypeName 是 --type_override 或者目标集群默认的 type，生成的文档和 CSV 文档没有 _type，写入时使用它。*/
+	IndexRefreshSettings map[string]interface{}	/*IndexRefreshSettings 是迁移之前目标索引的 refresh_interval，key 为目标索引名称，迁移完成后需要恢复。*/
+	BulkStats        *BulkStats	/*BulkStats 按照结果（created、updated、noop、conflict 等）统计 bulk 中每个条目的执行情况。*/
+	Sampler          *DocSampler	/*Sampler 实现 --sample_rate 和 --max_docs，nil 表示迁移全部文档。*/
+	Masker           *Masker	/*Masker 按照 --mask 对 _source 脱敏，nil 表示不脱敏。*/
+	Bench            *BenchRecorder	/*Bench 记录 --benchmark 的 bulk 耗时和吞吐，nil 表示不记录。*/
+	ScrollErrors     int32	/*ScrollErrors 是读取源文档时出错的次数，大于 0 表示有文档没有迁移，使用 atomic 读写。*/
 }
 
 type Config struct {
 	
+	/*ConfigFile：YAML 或 JSON 格式的配置文件，配置项的名称和命令行参数的长名称一致，命令行参数优先；*/
+	ConfigFile          string `long:"config"  description:"load options from yaml or json config file, command line options take precedence, ie: job.yml"`
+	/*CheckConfig：只检查参数和配置文件是否正确，不执行迁移；*/
+	CheckConfig         bool   `long:"check_config"  description:"validate the options and config file, then exit"`
+	/*Indices：配置文件中为单独的源索引指定的配置，只能通过配置文件设置；*/
+	Indices             map[string]*IndexConfig `no-flag:"true"`
 	/*SourceEs：源 Elasticsearch 实例的地址；*/
 	SourceEs            string `short:"s" long:"source"  description:"source elasticsearch instance, ie: http://localhost:9200"`
 	/*Query：在源 Elasticsearch 实例上的查询；*/
 	Query               string `short:"q" long:"query"  description:"query against source elasticsearch instance, filter data before migrate, ie: name:medcl"`
+	/*QueryFile：Query DSL 文件，文件中的查询会作为 scroll 请求体中的 query，支持 bool、range、terms、exists、nested 等任意查询；*/
+	QueryFile           string `long:"query_file"  description:"query dsl file against source elasticsearch instance, ie: filter.json"`
+	/*IndexQueryFiles：为单独的源索引指定 Query DSL 文件，索引名称支持通配符，可以重复指定；*/
+	IndexQueryFiles     map[string]string `long:"index_query_file"  description:"query dsl file for specified source index, can be repeated, ie: orders:orders.json"`
 	/*TargetEs：目标 Elasticsearch 实例的地址；*/
 	TargetEs            string `short:"d" long:"dest"    description:"destination elasticsearch instance, ie: http://localhost:9201"`
 	/*SourceEsAuthStr：源 Elasticsearch 实例的 HTTP Basic 认证信息；*/
@@ -147,14 +192,28 @@ type Config struct {
 	DocBufferCount      int    `short:"c" long:"count"   description:"number of documents at a time: ie \"size\" in the scroll request" default:"10000"`
 	/*BufferCount：内存中的缓存文档数量；*/
 	BufferCount         int    `long:"buffer_count"   description:"number of buffered documents in memory" default:"1000000"`
+	/*BufferSizeInMB：内存中缓存的文档的最大大小，单位 MB，缓存满了之后读取端会等待，0 表示不限制*/
+	BufferSizeInMB      int    `long:"buffer_size"   description:"max size in MB of buffered documents in memory, readers wait when it is full, 0 means unlimited" default:"0"`
+	/*SpillDir：内存缓存满了之后把文档写入这个目录下的临时分段文件，scroll 不再等待 bulk，迁移结束后自动删除*/
+	SpillDir            string `long:"spill_dir"   description:"spill documents to segment files under this directory when the memory buffer is full, so scroll doesn't wait for bulk"`
+	/*SpillMaxSizeInMB：磁盘队列的最大大小，单位 MB，超过之后读取端会等待，0 表示不限制*/
+	SpillMaxSizeInMB    int    `long:"spill_max_size"   description:"max size in MB of spilled documents on disk, readers wait when it is full, 0 means unlimited" default:"10240"`
+	/*SpillSegmentSizeInMB：磁盘队列每个分段文件的大小，单位 MB，读取完一个分段就删除*/
+	SpillSegmentSizeInMB int   `long:"spill_segment_size"   description:"size in MB of each spill segment file" default:"64"`
 	/*Workers：并发的 bulk Workers 数量；*/
 	Workers             int    `short:"w" long:"workers" description:"concurrency number for bulk workers" default:"1"`
 	/*BulkSizeInMB：每次 bulk 操作中的文档数量；*/
 	BulkSizeInMB        int    `short:"b" long:"bulk_size" description:"bulk size in MB" default:"5"`
 	/*ScrollTime：每次 scroll 的时间间隔；*/
 	ScrollTime          string `short:"t" long:"time"    description:"scroll time" default:"10m"`
-	/*ScrollSliceSize：sliced scroll 的大小，需要>1才能生效；*/
-	ScrollSliceSize     int    `long:"sliced_scroll_size"    description:"size of sliced scroll, to make it work, the size should be > 1" default:"1"`
+	/*ScrollSliceSize：sliced scroll 的大小，需要>1才能生效；auto 表示根据主分片数量和文档数量自动选择，并且不超过集群的 search.max_open_scroll_context；*/
+	ScrollSliceSize     SliceSize `long:"sliced_scroll_size"    description:"size of sliced scroll, to make it work, the size should be > 1, auto picks slices per index by primary shards and document count" default:"1"`
+	/*DryRun：只输出迁移计划，包括目标索引名称、创建索引和更新 mapping 的请求体、--force 会删除的索引、文档数和预计的 bulk 请求数，不写入任何数据*/
+	DryRun              bool   `long:"dry_run"   description:"print the migration plan: destination indices, settings and mappings to send, indices --force would delete, document counts and estimated bulk requests, without writing anything"`
+	/*MergeMappingRules：多个源索引合并到一个目标索引时，类型冲突的字段在合并后的 mapping 中使用的类型，字段名称支持通配符，可以重复指定*/
+	MergeMappingRules   map[string]string `long:"merge_mapping_rule"   description:"type of a conflicting field in the merged mapping when -y merges multiple indices, field names support wildcards, can be repeated, ie: status:keyword, *_id:keyword"`
+	/*SkipPreflight：跳过迁移开始之前的版本兼容性、磁盘空间、字段数量、scroll 限制和插件检查*/
+	SkipPreflight       bool   `long:"skip_preflight"   description:"skip the preflight checks of versions, disk space, field limits, scroll limits and plugins before migration"`
 	/*RecreateIndex：是否在复制之前删除目标索引；*/
 	RecreateIndex       bool   `short:"f" long:"force"   description:"delete destination index before copying"`
 	/*CopyAllIndexes：是否包含复制起始点为.和_的索引；*/
@@ -184,7 +243,23 @@ type Config struct {
 		InputFileType：数据迁移程序中输入文件的数据类型，
 		包括四种选项：dump（Elasticsearch dump数据）、json_line（json格式，一行一个document）、json_array（json格式，整个文件是一个数组）、log_line（每行一个document的log格式）。
 	*/
-	InputFileType       string `long:"input_file_type"                 description:"the data type of input file, options: dump, json_line, json_array, log_line" default:"dump" `
+	InputFileType       string `long:"input_file_type"                 description:"the data type of input file, options: dump, json_line, json_array, log_line, csv" default:"dump" `
+	/*OutputFileType：输出文件的格式，dump 每行一个文档的 JSON，csv 每行一个文档的字段*/
+	OutputFileType      string `long:"output_file_type"                 description:"the data type of output file, options: dump, csv" default:"dump" choice:"dump" choice:"csv"`
+	/*CsvDelimiter：CSV 的分隔符，\t 或 tab 表示制表符*/
+	CsvDelimiter        string `long:"csv_delimiter"  description:"field delimiter of csv input and output, \\t or tab for tab" default:","`
+	/*CsvQuote：CSV 的引号，字段中的引号写成两个引号*/
+	CsvQuote            string `long:"csv_quote"  description:"quote character of csv input and output" default:"\""`
+	/*CsvNoHeader：CSV 没有列名，输入的列名为 col1、col2...，输出时不写入列名*/
+	CsvNoHeader         bool   `long:"csv_no_header"  description:"csv input has no header row, columns are named col1, col2..., or don't write the header row to csv output"`
+	/*CsvColumnTypes：CSV 输入的列类型，没有指定的列为 string，可以重复指定*/
+	CsvColumnTypes      map[string]string `long:"csv_type"  description:"type of csv input columns, can be repeated, options: string,long,double,boolean,json,array, ie: age:long, tags:array"`
+	/*CsvIdColumn：CSV 输入中作为文档 _id 的列，不写入 _source*/
+	CsvIdColumn         string `long:"csv_id_column"  description:"csv input column used as the document id"`
+	/*CsvFields：CSV 输出的列，嵌套的字段使用 . 分隔的路径，默认为 _id 和第一个文档的所有字段*/
+	CsvFields           string `long:"csv_fields"  description:"columns of csv output, nested fields as dotted paths, _id, _index and _type are allowed, default is _id and all fields of the first document, ie: _id,user.name,tags"`
+	/*CsvArraySeparator：CSV 输出时连接数组的值，输入时 array 类型的列按照它拆分*/
+	CsvArraySeparator   string `long:"csv_array_separator"  description:"separator to join array values in csv output and split array columns of csv input" default:"|"`
 	/*SourceProxy：设置源  Elasticsearch  http 连接使用的代理，例如设置为http://127.0.0.1:8080*/
 	SourceProxy         string `long:"source_proxy"            description:"set proxy to source http connections, ie: http://127.0.0.1:8080"`
 	/*TargetProxy：设置目标  Elasticsearch  http 连接使用的代理，例如设置为http://127.0.0.1:8080*/
@@ -192,9 +267,35 @@ type Config struct {
 	/*Refresh：迁移完成后是否刷新索引。*/
 	Refresh             bool   `long:"refresh"                 description:"refresh after migration finished"`
 	/*Fields：需要迁移的源 Elasticsearch 中的字段，以逗号隔开，例如：col1,col2,col3...。*/
-	Fields              string `long:"fields"                 description:"filter source fields, comma separated, ie: col1,col2,col3,..." `
+	Fields              string `long:"fields"                 description:"filter source fields, comma separated, wildcards supported, ie: col1,col2,user.*,..." `
+	/*ExcludeFields：需要从 _source 中排除的字段，以逗号隔开，支持通配符，例如：raw_html,attachment.*。*/
+	ExcludeFields       string `long:"exclude_fields"         description:"exclude source fields, comma separated, wildcards supported, ie: raw_html,attachment.*" `
+	/*MaxDocs：每个索引最多迁移的文档数，所有索引都达到之后提前结束 scroll，0 表示不限制*/
+	MaxDocs             int     `long:"max_docs"               description:"max documents to migrate per index, scrolling stops early when all indices reach it, 0 means unlimited" default:"0"`
+	/*SampleRate：随机采样的比例，5.x 及以上使用 random_score 查询在服务端采样，1.x/2.x 和文件输入在客户端采样*/
+	SampleRate          float64 `long:"sample_rate"            description:"fraction of documents to migrate by random sampling, ie: 0.05" default:"1"`
+	/*SampleSeed：采样的随机种子，相同的种子选出相同的文档，不指定时随机生成并输出到日志*/
+	SampleSeed          int64   `long:"sample_seed"            description:"seed of random sampling, the same seed picks the same documents, random if not set"`
+	/*SplitTypes：把多 type 的索引拆分成每个 type 一个索引，用于迁移到只支持单个 type 的 6.x/7.x*/
+	SplitTypes          bool   `long:"split_types"            description:"split multi-type index into one index per type"`
+	/*SplitTypesPattern：拆分之后的索引名称，{index} 为索引名称，{type} 为 type 名称*/
+	SplitTypesPattern   string `long:"split_types_pattern"    description:"index name pattern for split types, ie: {index}-{type}" default:"{index}-{type}"`
+	/*SplitTypesIndex：手动指定 type 对应的索引名称，key 可以是 type 或者 索引/type，可以重复指定，优先于 SplitTypesPattern*/
+	SplitTypesIndex     map[string]string `long:"split_types_index"  description:"destination index for specified type, can be repeated, ie: user:users, orders/order:orders"`
+	/*TypeField：拆分之后把原来的 type 保存到这个字段中*/
+	TypeField           string `long:"type_field"             description:"keep the original type name in this field when split types, ie: type"`
+	/*JoinField：目标是 6.x 及以上版本时，_parent 父子关系会被翻译成 join 字段，这里指定 join 字段的名称*/
+	JoinField           string `long:"join_field"             description:"join field name used to translate _parent relationships for 6.x+ target" default:"join"`
+	/*JoinRelations：手动指定父子关系，格式为 父类型:子类型1,子类型2，可以重复指定，默认从源索引 mapping 的 _parent 中获取*/
+	JoinRelations       map[string]string `long:"join_relations"  description:"parent child relations for join field, can be repeated, ie: question:answer,comment"`
+	/*PreserveVersion：保留源文档的版本号，scroll 时请求 version，bulk 时使用 external 版本控制，重复执行时不会用旧的文档覆盖目标中更新的文档*/
+	PreserveVersion     bool   `long:"preserve_version"       description:"preserve document versions with external versioning, re-runs never overwrite newer target documents"`
 	/*将源 Elasticsearch 中的字段重命名，并以键值对的形式进行指定，例如：_type:type, name:myname。*/
 	RenameFields        string `long:"rename"                 description:"rename source fields, comma separated, ie: _type:type, name:myname" `
+	/*MaskFields：字段的脱敏策略，字段路径支持通配符，可以重复指定，策略：redact、hmac、truncate:N、email、phone、shift_date:DAYS*/
+	MaskFields          map[string]string `long:"mask"           description:"mask source field values before bulk or dump, field paths support wildcards, can be repeated, policies: redact,hmac,truncate:N,email,phone,shift_date:DAYS, ie: user.email:email, *.ssn:redact"`
+	/*MaskKey：hmac、email、phone 和 shift_date 使用的密钥，相同的密钥得到相同的结果，不指定时随机生成*/
+	MaskKey             string `long:"mask_key"               description:"secret key of hmac, fake email/phone and date shifting, the same key gives the same masked values across runs, random if not set"`
 	/*LogstashEndpoint：目标Logstash的TCP地址，例如：127.0.0.1:5055*/
 	LogstashEndpoint    string `short:"l"  long:"logstash_endpoint"    description:"target logstash tcp endpoint, ie: 127.0.0.1:5055" `
 	/*LogstashSecEndpoint：目标Logstash的TCP地址是否启用了TLS安全协议*/
@@ -202,12 +303,59 @@ type Config struct {
 
 	/*将源 Elasticsearch 的数据重复输出N次到目标 Elasticsearch，与参数regenerate_id配合使用可扩大数据量*/
 	RepeatOutputTimes         int  `long:"repeat_times"            description:"repeat the data from source N times to dest output, use align with parameter regenerate_id to amplify the data size "`
+	/*OpType：bulk 的操作类型，index 会覆盖已存在的文档，create 跳过已存在的文档，update 只合并字段到已存在的文档，upsert 合并字段且文档不存在时新建，delete 删除目标中相同 ID 的文档*/
+	OpType                    string `long:"op_type"   description:"bulk operation type, options: index,create,update,upsert,delete" default:"index" choice:"index" choice:"create" choice:"update" choice:"upsert" choice:"delete"`
 	/*RegenerateID：为目标 Elasticsearch 中的document重新生成ID，会覆盖掉原有的document ID*/
 	RegenerateID              bool `short:"r" long:"regenerate_id"   description:"regenerate id for documents, this will override the exist document id in data source"`
+	/*GenerateDocs：根据索引的 mapping 生成 N 个随机文档写入目标，用于压测新的索引，源集群只提供 mapping*/
+	GenerateDocs              int    `long:"generate_docs"   description:"generate N random documents from the index mapping instead of copying documents, for load testing"`
+	/*GenerateMapping：生成文档使用的 mapping 文件，文档写入 --dest_index，默认使用源集群中索引的 mapping*/
+	GenerateMapping           string `long:"generate_mapping"   description:"mapping file of the generated documents, default is the mapping of the source indexes, ie: mapping.json"`
+	/*GenerateRate：每秒最多生成的文档数，0 表示不限速*/
+	GenerateRate              int    `long:"generate_rate"   description:"max documents per second of the generator, 0 means unlimited" default:"0"`
+	/*GenerateCardinality：每个 keyword 字段不同取值的数量*/
+	GenerateCardinality       int    `long:"generate_cardinality"   description:"distinct values of each generated keyword field" default:"1000"`
+	/*GenerateDateRange：生成日期的范围，默认最近 365 天*/
+	GenerateDateRange         string `long:"generate_date_range"   description:"date range of the generated dates, default is the last 365 days, ie: 2023-01-01,2023-12-31"`
+	/*GenerateArraySize：nested 字段最多生成的对象数量*/
+	GenerateArraySize         int    `long:"generate_array_size"   description:"max objects of each generated nested field" default:"3"`
 	/*Compress：是否使用gzip压缩传输数据*/
 	Compress                  bool `long:"compress"            description:"use gzip to compress traffic"`
 	/*SleepSecondsAfterEachBulk：每次请求之间的睡眠时间，单位为秒，例如：-1表示不设置睡眠时间*/
 	SleepSecondsAfterEachBulk int  `short:"p" long:"sleep" description:"sleep N seconds after each bulk request" default:"-1"`
+	/*BulkDocsPerSecond：所有 bulk worker 合计每秒最多写入的文档数，0 表示不限速*/
+	BulkDocsPerSecond       int     `long:"bulk_docs_per_second" description:"max documents per second for all bulk workers, 0 means unlimited" default:"0"`
+	/*BulkMBPerSecond：所有 bulk worker 合计每秒最多写入的数据量，单位 MB，0 表示不限速*/
+	BulkMBPerSecond         float64 `long:"bulk_mb_per_second" description:"max MB per second for all bulk workers, 0 means unlimited" default:"0"`
+	/*AdaptiveBulk：根据 bulk 的耗时和 429 拒绝情况，动态调整 bulk 大小和活跃的 worker 数量，--bulk_size 和 --workers 作为初始值和上限*/
+	AdaptiveBulk            bool          `long:"adaptive_bulk" description:"adjust bulk size and active workers by target feedback(latency, took and rejections)"`
+	/*AdaptiveMinBulkSizeInMB/AdaptiveMaxBulkSizeInMB：动态调整时 bulk 大小的范围，单位 MB*/
+	AdaptiveMinBulkSizeInMB int           `long:"adaptive_min_bulk_size" description:"min bulk size in MB when adaptive bulk enabled" default:"1"`
+	AdaptiveMaxBulkSizeInMB int           `long:"adaptive_max_bulk_size" description:"max bulk size in MB when adaptive bulk enabled" default:"20"`
+	/*AdaptiveMinWorkers：动态调整时最少的活跃 worker 数量，最多为 --workers*/
+	AdaptiveMinWorkers      int           `long:"adaptive_min_workers" description:"min active bulk workers when adaptive bulk enabled" default:"1"`
+	/*AdaptiveTargetLatency：bulk 的目标耗时，超过之后会减小 bulk 大小和活跃 worker 数量*/
+	AdaptiveTargetLatency   time.Duration `long:"adaptive_target_latency" description:"target bulk latency when adaptive bulk enabled, ie: 2s, 500ms" default:"2s"`
+	/*ScrollRequestsPerSecond：所有 scroll 每秒最多发起的请求数，用于限制对源集群的读取压力，0 表示不限速*/
+	ScrollRequestsPerSecond float64 `long:"scroll_requests_per_second" description:"max scroll requests per second against source elasticsearch, 0 means unlimited" default:"0"`
+	/*Benchmark：记录每个 bulk 请求的耗时、took、字节数和拒绝数，定期输出吞吐和耗时的百分位数，用于对比不同的集群配置*/
+	Benchmark               bool          `long:"benchmark" description:"record latency, took, bytes and rejections of each bulk request, print throughput and latency percentiles per interval and at the end"`
+	/*BenchmarkInterval：--benchmark 输出统计的间隔，0 表示只在结束时输出*/
+	BenchmarkInterval       time.Duration `long:"benchmark_interval" description:"interval of the benchmark reports, 0 means only at the end, ie: 10s, 1m" default:"10s"`
+	/*BenchmarkOutput：把 --benchmark 的每次统计以 JSON 的形式逐行写入文件*/
+	BenchmarkOutput         string        `long:"benchmark_output" description:"write the benchmark reports to the file as JSON lines, ie: bench.json"`
+	/*PerIndex：每个源索引作为一个独立的任务迁移，有自己的 scroll 和 bulk worker，一个索引失败不影响其他索引*/
+	PerIndex                bool              `long:"per_index"  description:"migrate each source index as an independent job, one failed index doesn't abort the others"`
+	/*IndexParallelism：--per_index 模式下同时迁移的索引数量*/
+	IndexParallelism        int               `long:"index_parallelism"  description:"number of indices migrated concurrently in per_index mode" default:"1"`
+	/*IndexOrder：--per_index 模式下索引的迁移顺序，name 按名称，size 小索引优先，priority 按 --index_priority 从高到低*/
+	IndexOrder              string            `long:"index_order"  description:"order of index jobs in per_index mode, options: name,size,priority" default:"name" choice:"name" choice:"size" choice:"priority"`
+	/*IndexPriority：索引的优先级，索引名称支持通配符，可以重复指定，数值越大越先迁移*/
+	IndexPriority           map[string]string `long:"index_priority"  description:"priority of index jobs, higher first, can be repeated, ie: orders:10, logs-*:-1"`
+	/*ReindexRemote：文档不经过 esm，由目标集群通过 reindex-from-remote 直接从源集群读取，esm 负责提交任务、显示进度，Ctrl-C 时取消任务*/
+	ReindexRemote           bool              `long:"reindex_remote"  description:"let the destination cluster pull documents with reindex from remote, one _reindex task per index, --sliced_scroll_size is the number of concurrent tasks"`
+	/*ReindexRemoteHost：目标集群访问源集群使用的地址，默认和 --source 相同，需要在目标集群的 reindex.remote.whitelist 中*/
+	ReindexRemoteHost       string            `long:"reindex_remote_host"  description:"source address as seen from the destination cluster, must be in its reindex.remote.whitelist, default is --source"`
 }
 
 type Auth struct {
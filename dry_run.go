@@ -0,0 +1,186 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+)
+
+/*
+DryRunAPI 包装目标集群的 ESAPI，用于 --dry_run。
+读取类的请求（集群状态、索引设置、mapping、统计）照常发送到目标集群；
+删除索引、创建索引、更新设置和 mapping、bulk、refresh 不会发送，只记录下来，迁移计划中原样输出请求体。
+这样复制设置和 mapping、--force 删除索引走的是和正式迁移完全相同的代码。
+*/
+type DryRunAPI struct {
+	ESAPI
+	lock    sync.Mutex
+	actions []dryRunAction
+}
+
+type dryRunAction struct {
+	method string
+	index  string
+	body   interface{}
+	exists bool /*DELETE 的目标索引是否存在*/
+}
+
+func NewDryRunAPI(api ESAPI) *DryRunAPI {
+	return &DryRunAPI{ESAPI: api}
+}
+
+func (s *DryRunAPI) record(method, index string, body interface{}) {
+	s.lock.Lock()
+	s.actions = append(s.actions, dryRunAction{method: method, index: index, body: body})
+	s.lock.Unlock()
+}
+
+/*记录要删除的索引，同时查询目标索引中现有的文档数量，不存在的索引会标记出来。*/
+func (s *DryRunAPI) DeleteIndex(name string) error {
+	action := dryRunAction{method: "DELETE", index: name, body: "index doesn't exist"}
+	if count, err := s.ESAPI.Count(name); err == nil {
+		action.body = fmt.Sprintf("%d existing documents", count)
+		action.exists = true
+	}
+	s.lock.Lock()
+	s.actions = append(s.actions, action)
+	s.lock.Unlock()
+	return nil
+}
+
+/*和 ESAPIV0.CreateIndex 一样先清理设置，输出的就是实际会发送的请求体。*/
+func (s *DryRunAPI) CreateIndex(name string, settings map[string]interface{}) error {
+	cleanSettings(settings)
+	s.record("PUT", name, settings)
+	return nil
+}
+
+func (s *DryRunAPI) UpdateIndexSettings(name string, settings map[string]interface{}) error {
+	cleanSettings(settings)
+	s.record("PUT", name+"/_settings", settings)
+	return nil
+}
+
+func (s *DryRunAPI) UpdateIndexMapping(name string, mappings map[string]interface{}) error {
+	s.record("PUT", name+"/_mapping", mappings)
+	return nil
+}
+
+func (s *DryRunAPI) Bulk(data *bytes.Buffer) (*BulkResponse, error) {
+	return &BulkResponse{}, nil
+}
+
+func (s *DryRunAPI) Refresh(name string) error {
+	return nil
+}
+
+/*
+输出 --dry_run 的迁移计划：每个源索引的目标索引名称、文档数、数据大小、预计的 bulk 请求数，
+以及所有被拦截的写请求，最后汇总 --force 会删除的索引。
+*/
+func (c *Migrator) reportDryRun() {
+	log.Info("dry run, nothing is written to the destination")
+
+	stats, err := c.SourceESAPI.GetIndexStats(c.Config.SourceIndexNames)
+	if err != nil {
+		log.Error("failed to get source index stats: ", err)
+	}
+
+	indices := splitFieldList(c.Config.SourceIndexNames)
+	sort.Strings(indices)
+
+	bulkSize := int64(c.Config.BulkSizeInMB) * 1024 * 1024
+	repeat := int64(c.Config.RepeatOutputTimes)
+	if repeat < 1 {
+		repeat = 1
+	}
+
+	var totalDocs, totalBytes, totalBulks int64
+	for _, index := range indices {
+		s := stats[index]
+		bulks := estimateBulkRequests(s.StoreSizeInBytes, s.DocsCount, bulkSize) * repeat
+		totalDocs += s.DocsCount
+		totalBytes += s.StoreSizeInBytes
+		totalBulks += bulks
+		log.Infof("index %s => %s, %d docs, %.1fMB, ~%d bulk requests", index, c.targetIndexName(index), s.DocsCount, float64(s.StoreSizeInBytes)/1024/1024, bulks)
+	}
+	log.Infof("total: %d indices, %d docs, %.1fMB, ~%d bulk requests of %dMB", len(indices), totalDocs*repeat, float64(totalBytes)/1024/1024, totalBulks, c.Config.BulkSizeInMB)
+	if len(c.Config.Query) > 0 || len(c.Config.QueryFile) > 0 || len(c.Config.IndexQueryFiles) > 0 || c.Config.SampleRate < 1 || c.Config.MaxDocs > 0 {
+		log.Info("the document counts don't apply the query, sampling or max_docs, the actual number of migrated documents may be smaller")
+	}
+
+	if c.Config.ReindexRemote {
+		jobs, err := c.planReindexJobs()
+		if err != nil {
+			log.Error(err)
+		}
+		for _, job := range jobs {
+			b, _ := json.MarshalIndent(job.body, "", "  ")
+			log.Infof("POST _reindex?wait_for_completion=false\n%s", string(b))
+		}
+	}
+
+	api, ok := c.TargetESAPI.(*DryRunAPI)
+	if !ok {
+		return
+	}
+
+	var deleted []string
+	for _, action := range api.actions {
+		body := ""
+		switch v := action.body.(type) {
+		case string:
+			body = v
+		default:
+			b, _ := json.MarshalIndent(v, "", "  ")
+			body = string(b)
+		}
+		log.Infof("%s %s\n%s", action.method, action.index, body)
+		if action.exists {
+			deleted = append(deleted, fmt.Sprintf("%s (%s)", action.index, body))
+		}
+	}
+
+	if len(deleted) > 0 {
+		log.Warnf("--force would delete %d indices: %s", len(deleted), strings.Join(deleted, ", "))
+	}
+}
+
+/*
+按照主分片的存储大小估算 bulk 请求数，存储大小是压缩后的，所以结果只是一个下限的估计；
+有文档时至少需要一个请求。
+*/
+func estimateBulkRequests(storeBytes, docs, bulkSize int64) int64 {
+	if docs == 0 {
+		return 0
+	}
+	if bulkSize <= 0 {
+		return 1
+	}
+	n := (storeBytes + bulkSize - 1) / bulkSize
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
@@ -16,7 +16,10 @@ limitations under the License.
 
 package main
 
-import "bytes"
+import (
+	"bytes"
+	"encoding/json"
+)
 
 /*
 定义了一些常用的 API 的 接口
@@ -26,7 +29,7 @@ type ESAPI interface {
 	/*获取 Elasticsearch 集群的健康状态*/
 	ClusterHealth() *ClusterHealth
 	/*批量插入、更新或删除文档*/
-	Bulk(data *bytes.Buffer)
+	Bulk(data *bytes.Buffer) (*BulkResponse, error)
 	/*获取索引的设置信息*/
 	GetIndexSettings(indexNames string) (*Indexes, error)
 	/*删除索引*/
@@ -40,9 +43,29 @@ type ESAPI interface {
 	/*更新索引的映射信息*/
 	UpdateIndexMapping(indexName string, mappings map[string]interface{}) error
 	/*滚动搜索，用于读取大批量数据*/
-	NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, slicedId, maxSlicedCount int, fields string) (interface{}, error)
+	NewScroll(indexNames string, scrollTime string, docBufferCount int, query map[string]interface{}, slicedId, maxSlicedCount int, fields, excludeFields string, version bool) (interface{}, error)
 	/*获取下一批滚动搜索结果*/
 	NextScroll(scrollTime string, scrollId string) (interface{}, error)
+	/*流式读取下一批滚动搜索结果，每读取出一个文档就交给 onHit 处理*/
+	StreamScroll(scrollTime string, scrollId string, onHit func(hit map[string]json.RawMessage)) (*ScrollPage, error)
 	/*刷新一个或多个索引的缓存*/
 	Refresh(name string) (err error)
+	/*获取一个或多个索引主分片的文档数和存储大小*/
+	GetIndexStats(indexNames string) (map[string]IndexStats, error)
+	/*获取一个或多个索引中的文档数量*/
+	Count(indexNames string) (int64, error)
+	/*获取集群的 persistent 和 transient 设置，使用扁平的 key，transient 优先*/
+	GetClusterSettings() (map[string]interface{}, error)
+	/*获取所有数据节点的磁盘可用空间之和，单位字节*/
+	GetDiskAvailable() (int64, error)
+	/*获取数据节点的数量*/
+	GetDataNodeCount() (int, error)
+	/*获取所有节点上都安装了的插件名称*/
+	GetPlugins() ([]string, error)
+	/*提交 _reindex 任务，不等待完成，返回任务 ID*/
+	Reindex(body map[string]interface{}) (string, error)
+	/*获取任务的执行状态*/
+	GetTask(taskId string) (*ReindexTask, error)
+	/*取消正在执行的任务*/
+	CancelTask(taskId string) error
 }
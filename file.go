@@ -51,6 +51,16 @@ func (m *Migrator) NewFileReadWorker(pb *pb.ProgressBar, wg *sync.WaitGroup) {
 	}
 
 	defer f.Close()
+
+	/*--input_file_type=csv 时每一行是一个文档的字段*/
+	if m.Config.InputFileType == "csv" {
+		m.readCSVFile(f, pb)
+		log.Debug("end reading csv file")
+		m.closeDocChan()
+		wg.Done()
+		return
+	}
+
 	r := bufio.NewReader(f)
 	lineCount := 0
 	for {
@@ -69,15 +79,15 @@ func (m *Migrator) NewFileReadWorker(pb *pb.ProgressBar, wg *sync.WaitGroup) {
 			log.Error(err)
 			continue
 		}
-		/*发送到通道 m.DocChan*/
-		m.DocChan <- js
+		/*发送到通道 m.DocChan，缓存满了会在这里等待*/
+		m.sendDoc(js)
 		/*每读取一行就让进度条(pb)加1*/
 		pb.Increment()
 	}
 
 	defer f.Close()
 	log.Debug("end reading file")
-	close(m.DocChan)
+	m.closeDocChan()
 	wg.Done()
 }
 
@@ -127,6 +137,20 @@ func (c *Migrator) NewFileDumpWorker(pb *pb.ProgressBar, wg *sync.WaitGroup) {
 	*/
 	w := bufio.NewWriter(f)
 
+	/*--output_file_type=csv 时每个文档写一行字段，追加到已有的内容后面时不再写入列名*/
+	if c.Config.OutputFileType == "csv" {
+		header := true
+		if st, err := f.Stat(); err == nil && st.Size() > 0 {
+			header = false
+		}
+		c.writeCSVFile(w, pb, header)
+		w.Flush()
+		f.Close()
+		wg.Done()
+		log.Debug("csv file dump finished")
+		return
+	}
+
 READ_DOCS:
 	for {
 
@@ -136,6 +160,7 @@ READ_DOCS:
 			这样可以避免在通道关闭前读取到空值。如果没有文档可读取或者通道已经关闭，那么程序将结束循环并退出。
 		*/
 		docI, open := <-c.DocChan
+		c.releaseDoc(docI)
 		/*
 			程序将检查文档 docI 中是否包含一个名为 status 的键。如果包含，那么将检查 status 的值是否为 404。
 			这个检查主要是用来处理 Elasticsearch 查询时出现的错误，避免这些错误对程序的正常运行造成影响。
@@ -0,0 +1,377 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cheggaaa/pb"
+	log "github.com/cihub/seelog"
+)
+
+/*text 字段的随机单词*/
+var generateWords = []string{
+	"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel",
+	"india", "juliet", "kilo", "lima", "mike", "november", "oscar", "papa",
+	"quebec", "romeo", "sierra", "tango", "uniform", "victor", "whiskey", "xray",
+	"yankee", "zulu", "search", "index", "cluster", "shard", "replica", "node",
+}
+
+/*生成文档的一个目标：索引、type 和 mapping 中的字段*/
+type generateTarget struct {
+	index      string
+	typeName   string
+	properties map[string]interface{}
+}
+
+/*
+DocGenerator 实现 --generate_docs，根据索引的 mapping 生成类型正确的随机文档，用于压测新的索引。
+mapping 来自 --generate_mapping 文件，或者源集群中 -x 指定的索引；文档轮流分配给各个索引（和多 type 索引中的各个 type）。
+keyword 字段的取值数量由 --generate_cardinality 决定，日期在 --generate_date_range 之内，nested 字段生成 1 到 --generate_array_size 个对象。
+*/
+type DocGenerator struct {
+	targets     []generateTarget
+	total       int
+	cardinality int
+	maxArray    int
+	from, to    time.Time
+	limiter     *RateLimiter
+	rnd         *rand.Rand
+	skipped     map[string]bool /*不支持的字段类型，只提示一次*/
+}
+
+/*根据配置读取 mapping，文件中的 mapping 写入 --dest_index，源集群的 mapping 保持源索引名称，由 bulk 按照 --dest_index 改写。*/
+func (c *Migrator) NewDocGenerator() (*DocGenerator, error) {
+	from, to, err := parseGenerateDateRange(c.Config.GenerateDateRange)
+	if err != nil {
+		return nil, err
+	}
+	g := &DocGenerator{
+		total:       c.Config.GenerateDocs,
+		cardinality: c.Config.GenerateCardinality,
+		maxArray:    c.Config.GenerateArraySize,
+		from:        from,
+		to:          to,
+		limiter:     NewRateLimiter(float64(c.Config.GenerateRate)),
+		rnd:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		skipped:     map[string]bool{},
+	}
+
+	if len(c.Config.GenerateMapping) > 0 {
+		mappings, err := loadGenerateMapping(c.Config.GenerateMapping)
+		if err != nil {
+			return nil, err
+		}
+		g.targets = mappingTargets(c.Config.TargetIndexName, mappings)
+	} else {
+		_, _, indexes, err := c.SourceESAPI.GetIndexMappings(c.Config.CopyAllIndexes, c.Config.SourceIndexNames)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for name := range *indexes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			index, _ := (*indexes)[name].(map[string]interface{})
+			mappings, _ := index["mappings"].(map[string]interface{})
+			g.targets = append(g.targets, mappingTargets(name, mappings)...)
+		}
+	}
+
+	if len(g.targets) == 0 {
+		return nil, errors.New("no field found in the mapping, can't generate documents")
+	}
+	return g, nil
+}
+
+/*使用 --generate_mapping 文件中的 mapping 创建目标索引，创建失败（例如索引已经存在）时只输出错误，继续写入文档。*/
+func (c *Migrator) createGeneratedIndex() {
+	mappings, err := loadGenerateMapping(c.Config.GenerateMapping)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	settings := getEmptyIndexSettings()
+	if c.Config.ShardsCount > 0 {
+		settings["settings"].(map[string]interface{})["index"].(map[string]interface{})["number_of_shards"] = c.Config.ShardsCount
+	}
+	settings["mappings"] = mappings
+	if err := c.TargetESAPI.CreateIndex(c.Config.TargetIndexName, settings); err != nil {
+		log.Error(err)
+		return
+	}
+	log.Infof("index %s created with mapping %s", c.Config.TargetIndexName, c.Config.GenerateMapping)
+}
+
+/*
+读取 mapping 文件，支持 GET index/_mapping 的返回结果 {"index": {"mappings": {...}}}、
+创建索引的请求体 {"mappings": {...}} 以及 mappings 本身。
+*/
+func loadGenerateMapping(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	if err := DecodeJsonBytes(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid mapping file %s: %v", path, err)
+	}
+	if mappings, ok := m["mappings"].(map[string]interface{}); ok {
+		return mappings, nil
+	}
+	if len(m) == 1 {
+		for _, v := range m {
+			if index, ok := v.(map[string]interface{}); ok {
+				if mappings, ok := index["mappings"].(map[string]interface{}); ok {
+					return mappings, nil
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+/*
+7.x 的 mappings 直接包含 properties，没有 type，写入时使用 --type_override 或者目标集群默认的 type；
+之前的版本每个 type 一个 mapping，_default_ 不生成文档。
+*/
+func mappingTargets(index string, mappings map[string]interface{}) []generateTarget {
+	if properties, ok := mappings["properties"].(map[string]interface{}); ok {
+		return []generateTarget{{index: index, properties: properties}}
+	}
+	var types []string
+	for name := range mappings {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+
+	var targets []generateTarget
+	for _, name := range types {
+		mapping, ok := mappings[name].(map[string]interface{})
+		if !ok || name == "_default_" {
+			continue
+		}
+		if properties, ok := mapping["properties"].(map[string]interface{}); ok && len(properties) > 0 {
+			targets = append(targets, generateTarget{index: index, typeName: name, properties: properties})
+		}
+	}
+	return targets
+}
+
+/*解析 --generate_date_range，格式为 起始日期,结束日期，为空时使用最近 365 天。*/
+func parseGenerateDateRange(s string) (time.Time, time.Time, error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		to := time.Now().UTC()
+		return to.AddDate(-1, 0, 0), to, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid generate_date_range %s, ie: 2023-01-01,2023-12-31", s)
+	}
+	var dates [2]time.Time
+	for i, part := range parts {
+		t, err := time.Parse("2006-01-02", strings.TrimSpace(part))
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid date %s in generate_date_range, ie: 2023-01-01", part)
+		}
+		dates[i] = t
+	}
+	if !dates[0].Before(dates[1]) {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid generate_date_range %s, the start date should be before the end date", s)
+	}
+	return dates[0], dates[1], nil
+}
+
+/*
+生成文档并写入 DocChan，--generate_rate 限制每秒生成的文档数。
+文档没有 _id，由目标集群自动生成，所以只能使用 index 或 create。
+*/
+func (c *Migrator) NewGenerateWorker(g *DocGenerator, bar *pb.ProgressBar, wg *sync.WaitGroup) {
+	log.Debugf("start generating %d documents for %d index mappings", g.total, len(g.targets))
+	for i := 0; i < g.total; i++ {
+		g.limiter.Wait(1)
+		target := g.targets[i%len(g.targets)]
+		c.sendDoc(map[string]interface{}{
+			"_index":  target.index,
+			"_type":   target.typeName,
+			"_id":     "",
+			"_source": g.object(target.properties, ""),
+		})
+		bar.Increment()
+	}
+	log.Debug("end generating documents")
+	c.closeDocChan()
+	wg.Done()
+}
+
+/*按照 properties 生成一个对象，没有指定类型但有 properties 的字段是 object*/
+func (g *DocGenerator) object(properties map[string]interface{}, prefix string) map[string]interface{} {
+	doc := map[string]interface{}{}
+	for name, p := range properties {
+		field, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if v, ok := g.value(field, prefix+name); ok {
+			doc[name] = v
+		}
+	}
+	return doc
+}
+
+/*按照字段的类型生成一个随机值，不支持的类型（join、percolator、alias 等）不生成，返回 false。*/
+func (g *DocGenerator) value(field map[string]interface{}, path string) (interface{}, bool) {
+	fieldType, _ := field["type"].(string)
+	if properties, ok := field["properties"].(map[string]interface{}); ok && (fieldType == "" || fieldType == "object") {
+		return g.object(properties, path+"."), true
+	}
+
+	switch fieldType {
+	case "keyword", "constant_keyword", "wildcard":
+		return g.keyword(path), true
+	case "string":
+		/*1.x/2.x 的 string，not_analyzed 相当于 keyword*/
+		if field["index"] == "not_analyzed" {
+			return g.keyword(path), true
+		}
+		return g.text(), true
+	case "text", "match_only_text", "search_as_you_type", "completion":
+		return g.text(), true
+	case "byte":
+		return g.rnd.Int63n(math.MaxInt8), true
+	case "short":
+		return g.rnd.Int63n(math.MaxInt16), true
+	case "integer", "token_count":
+		return g.rnd.Int63n(1000000), true
+	case "long", "unsigned_long":
+		return g.rnd.Int63n(1000000000), true
+	case "float", "half_float", "double", "scaled_float":
+		return math.Round(g.rnd.Float64()*100000) / 100, true
+	case "boolean":
+		return g.rnd.Intn(2) == 0, true
+	case "date", "date_nanos":
+		format, _ := field["format"].(string)
+		return g.date(format), true
+	case "ip":
+		return fmt.Sprintf("%d.%d.%d.%d", 1+g.rnd.Intn(223), g.rnd.Intn(256), g.rnd.Intn(256), 1+g.rnd.Intn(254)), true
+	case "geo_point":
+		return map[string]interface{}{"lat": g.coordinate(90), "lon": g.coordinate(180)}, true
+	case "geo_shape":
+		return map[string]interface{}{"type": "point", "coordinates": []float64{g.coordinate(180), g.coordinate(90)}}, true
+	case "binary":
+		data := make([]byte, 16)
+		g.rnd.Read(data)
+		return base64.StdEncoding.EncodeToString(data), true
+	case "nested":
+		properties, _ := field["properties"].(map[string]interface{})
+		items := make([]interface{}, 1+g.rnd.Intn(g.maxArray))
+		for i := range items {
+			items[i] = g.object(properties, path+".")
+		}
+		return items, true
+	case "flattened":
+		return map[string]interface{}{"key": g.keyword(path + ".key"), "value": g.keyword(path + ".value")}, true
+	case "integer_range", "long_range":
+		gte := g.rnd.Int63n(1000000)
+		return map[string]interface{}{"gte": gte, "lte": gte + g.rnd.Int63n(1000)}, true
+	case "float_range", "double_range":
+		gte := math.Round(g.rnd.Float64()*100000) / 100
+		return map[string]interface{}{"gte": gte, "lte": gte + 10}, true
+	case "date_range":
+		from := g.randomTime()
+		return map[string]interface{}{"gte": from.Format(time.RFC3339), "lte": from.Add(time.Hour).Format(time.RFC3339)}, true
+	case "dense_vector":
+		dims, _ := strconv.Atoi(fmt.Sprint(field["dims"]))
+		if dims <= 0 {
+			break
+		}
+		vector := make([]float64, dims)
+		for i := range vector {
+			vector[i] = math.Round(g.rnd.Float64()*2000-1000) / 1000
+		}
+		return vector, true
+	case "rank_feature":
+		return math.Round(g.rnd.Float64()*10000)/100 + 0.01, true
+	}
+
+	if !g.skipped[fieldType] {
+		g.skipped[fieldType] = true
+		log.Warnf("field %s of type %s is not supported by the generator, skipped", path, fieldType)
+	}
+	return nil, false
+}
+
+/*keyword 的值从 --generate_cardinality 个候选值中选择，例如 status_42*/
+func (g *DocGenerator) keyword(path string) string {
+	name := path[strings.LastIndex(path, ".")+1:]
+	return fmt.Sprintf("%s_%d", name, g.rnd.Intn(g.cardinality))
+}
+
+func (g *DocGenerator) text() string {
+	words := make([]string, 3+g.rnd.Intn(10))
+	for i := range words {
+		words[i] = generateWords[g.rnd.Intn(len(generateWords))]
+	}
+	return strings.Join(words, " ")
+}
+
+func (g *DocGenerator) coordinate(max float64) float64 {
+	return math.Round((g.rnd.Float64()*2-1)*max*1000000) / 1000000
+}
+
+func (g *DocGenerator) randomTime() time.Time {
+	return g.from.Add(time.Duration(g.rnd.Int63n(int64(g.to.Sub(g.from)))))
+}
+
+/*
+按照 mapping 中的 format 输出日期，多个格式用 || 分隔时使用第一个可以识别的格式，
+没有 format 或者无法识别时使用默认的 strict_date_optional_time 格式。
+*/
+func (g *DocGenerator) date(format string) interface{} {
+	t := g.randomTime()
+	for _, f := range strings.Split(format, "||") {
+		switch f = strings.TrimSpace(f); f {
+		case "epoch_millis":
+			return t.UnixNano() / int64(time.Millisecond)
+		case "epoch_second":
+			return t.Unix()
+		case "date", "strict_date":
+			return t.Format("2006-01-02")
+		case "basic_date":
+			return t.Format("20060102")
+		case "date_optional_time", "strict_date_optional_time", "strict_date_optional_time_nanos", "date_time", "strict_date_time":
+			return t.Format("2006-01-02T15:04:05.000Z")
+		}
+		if strings.Contains(f, "yyyy") {
+			layout := strings.NewReplacer("yyyy", "2006", "MM", "01", "dd", "02", "HH", "15", "mm", "04", "ss", "05", "SSS", "000", "'", "").Replace(f)
+			return t.Format(layout)
+		}
+	}
+	return t.Format("2006-01-02T15:04:05.000Z")
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMappingTargets(t *testing.T) {
+	properties := map[string]interface{}{"a": map[string]interface{}{"type": "long"}}
+	tests := []struct {
+		name     string
+		mappings map[string]interface{}
+		types    []string
+	}{
+		{"typeless", map[string]interface{}{"properties": properties}, []string{""}},
+		{"types", map[string]interface{}{
+			"user":      map[string]interface{}{"properties": properties},
+			"order":     map[string]interface{}{"properties": properties},
+			"_default_": map[string]interface{}{"properties": properties},
+			"empty":     map[string]interface{}{"properties": map[string]interface{}{}},
+		}, []string{"order", "user"}},
+		{"no properties", map[string]interface{}{}, nil},
+	}
+
+	for _, tt := range tests {
+		var types []string
+		for _, target := range mappingTargets("logs", tt.mappings) {
+			if target.index != "logs" {
+				t.Errorf("%s: index = %q", tt.name, target.index)
+			}
+			types = append(types, target.typeName)
+		}
+		if !reflect.DeepEqual(types, tt.types) {
+			t.Errorf("%s: types = %q, expected %q", tt.name, types, tt.types)
+		}
+	}
+}
+
+func TestParseGenerateDateRange(t *testing.T) {
+	tests := []struct {
+		value string
+		from  string
+		to    string
+		valid bool
+	}{
+		{"2023-01-01,2023-12-31", "2023-01-01", "2023-12-31", true},
+		{" 2023-01-01 , 2023-02-01 ", "2023-01-01", "2023-02-01", true},
+		{"2023-12-31,2023-01-01", "", "", false},
+		{"2023-01-01", "", "", false},
+		{"2023-01-01,tomorrow", "", "", false},
+	}
+
+	for _, tt := range tests {
+		from, to, err := parseGenerateDateRange(tt.value)
+		if (err == nil) != tt.valid {
+			t.Errorf("%q: unexpected error %v", tt.value, err)
+			continue
+		}
+		if tt.valid && (from.Format("2006-01-02") != tt.from || to.Format("2006-01-02") != tt.to) {
+			t.Errorf("%q: got %v - %v", tt.value, from, to)
+		}
+	}
+
+	from, to, err := parseGenerateDateRange("")
+	if err != nil || !from.Before(to) {
+		t.Errorf("default range: %v - %v, %v", from, to, err)
+	}
+}
@@ -1,3 +1,19 @@
 module esm-master
 
 go 1.20
+
+require (
+	github.com/cheggaaa/pb v1.0.30
+	github.com/cihub/seelog v0.0.0-20170130134532-f561c5e57575
+	github.com/jessevdk/go-flags v1.6.1
+	github.com/mattn/go-isatty v0.0.24
+	github.com/parnurzeal/gorequest v0.3.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/mattn/go-runewidth v0.0.4 // indirect
+	github.com/moul/http2curl v1.0.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+)
@@ -18,6 +18,7 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
@@ -300,6 +301,69 @@ func DoRequest(compress bool, method string, loadUrl string, auth *Auth, body []
 	return string(resp.Body()), nil
 }
 
+/*
+发起 HTTP 请求并返回响应体的流，由调用方边读边解码，读取完成后需要关闭。
+和 DoRequest 不同，响应体不会被完整读入内存，用于返回大量文档的 scroll 请求。
+compress 为 true 时请求体使用 gzip 压缩，压缩的响应由 net/http 自动解压。
+*/
+func DoStreamRequest(compress bool, method string, loadUrl string, auth *Auth, body []byte, proxy string) (io.ReadCloser, error) {
+	var reader io.Reader
+	if len(body) > 0 {
+		if compress {
+			var buf bytes.Buffer
+			g := gzip.NewWriter(&buf)
+			if _, err := g.Write(body); err != nil {
+				return nil, err
+			}
+			if err := g.Close(); err != nil {
+				return nil, err
+			}
+			reader = &buf
+		} else {
+			reader = bytes.NewReader(body)
+		}
+	}
+
+	req, err := http.NewRequest(method, loadUrl, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if compress && len(body) > 0 {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if auth != nil {
+		req.SetBasicAuth(auth.User, auth.Pass)
+	}
+
+	c := client
+	if len(proxy) > 0 {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		c = &http.Client{
+			Transport: &http.Transport{
+				Proxy:             http.ProxyURL(proxyURL),
+				DisableKeepAlives: true,
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("server error, status code %d: %s", resp.StatusCode, string(b))
+	}
+	return resp.Body, nil
+}
+
 func Request(method string, r string, auth *Auth, body *bytes.Buffer, proxy string) (string, error) {
 
 	//TODO use global client
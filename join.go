@@ -0,0 +1,190 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+/*
+JoinTranslator 把 1.x 到 5.x 的 _parent 父子关系翻译成 6.x 及以上版本的 join 字段。
+6.x 开始一个索引只能有一个 type，也不再支持 _parent，父子文档需要放在同一个 type 中，通过 join 字段区分：
+  - 父文档：{"join": "question"}
+  - 子文档：{"join": {"name": "answer", "parent": "1"}}，并且 routing 必须等于父文档的 ID，保证父子文档在同一个分片上。
+
+父子关系（relations）来自源索引 mapping 中的 _parent，也可以通过 --join_relations 手动指定，例如从导出文件导入时。
+目标集群是 6.x 及以上版本时才会创建，nil 的 JoinTranslator 什么都不做。
+*/
+type JoinTranslator struct {
+	field     string
+	typeName  string
+	relations map[string][]string
+	parents   map[string]bool
+	children  map[string]bool
+}
+
+/*
+创建 JoinTranslator，typeName 是合并之后使用的 type 名称，6.x 为 doc，7.x 为 _doc，--type_override 优先。
+relations 是 --join_relations 指定的父子关系，格式为 父类型:子类型1,子类型2。
+*/
+func NewJoinTranslator(field, typeName string, relations map[string]string) *JoinTranslator {
+	j := &JoinTranslator{
+		field:     field,
+		typeName:  typeName,
+		relations: map[string][]string{},
+		parents:   map[string]bool{},
+		children:  map[string]bool{},
+	}
+	for parent, children := range relations {
+		for _, child := range splitFieldList(children) {
+			j.addRelation(parent, child)
+		}
+	}
+	return j
+}
+
+func (j *JoinTranslator) addRelation(parent, child string) {
+	for _, c := range j.relations[parent] {
+		if c == child {
+			return
+		}
+	}
+	j.relations[parent] = append(j.relations[parent], child)
+	j.parents[parent] = true
+	j.children[child] = true
+}
+
+/*
+从源索引的 mapping 中找出父子关系，1.x 到 5.x 子类型的 mapping 中带有 {"_parent": {"type": "父类型"}}。
+mappings 的结构为 {索引名: {"mappings": {类型: {...}}}}。
+*/
+func (j *JoinTranslator) AddRelationsFromMappings(mappings *Indexes) {
+	if j == nil || mappings == nil {
+		return
+	}
+	for _, idx := range *mappings {
+		types, ok := idx.(map[string]interface{})["mappings"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for child, mapping := range types {
+			m, ok := mapping.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if p, ok := m["_parent"].(map[string]interface{}); ok {
+				if parent, ok := p["type"].(string); ok && len(parent) > 0 {
+					j.addRelation(parent, child)
+				}
+			}
+		}
+	}
+}
+
+/*是否存在父子关系，没有时不需要 join 字段。*/
+func (j *JoinTranslator) Enabled() bool {
+	return j != nil && len(j.relations) > 0
+}
+
+/*
+在目标索引上添加 join 字段的 mapping，6.x 的 mapping 需要带上 type 名称，7.x 不需要。
+目标索引不存在时，先使用空的 settings 创建索引。
+*/
+func (j *JoinTranslator) PutMappings(api ESAPI, indexNames string, includeTypeName bool) {
+	if !j.Enabled() {
+		return
+	}
+
+	relations := map[string]interface{}{}
+	for parent, children := range j.relations {
+		sort.Strings(children)
+		relations[parent] = children
+	}
+	properties := map[string]interface{}{
+		"properties": map[string]interface{}{
+			j.field: map[string]interface{}{
+				"type":      "join",
+				"relations": relations,
+			},
+		},
+	}
+
+	mapping := properties
+	if includeTypeName {
+		mapping = map[string]interface{}{j.typeName: properties}
+	}
+
+	for _, name := range strings.Split(indexNames, ",") {
+		if _, err := api.GetIndexSettings(name); err != nil {
+			log.Debugf("target index %s not exists, create it for join field", name)
+			if err := api.CreateIndex(name, getEmptyIndexSettings()); err != nil {
+				log.Error(err)
+				continue
+			}
+		}
+		log.Infof("put join field [%s] mapping to index %s, relations: %v", j.field, name, relations)
+		if err := api.UpdateIndexMapping(name, mapping); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+/*
+把文档的 _parent 翻译成 join 字段，sourceType 是文档在源集群中的类型。
+目标不再支持 _parent，所以 doc.Parent 总是被清空，并使用父文档的 ID 作为 routing。
+*/
+func (j *JoinTranslator) Apply(doc *Document, sourceType string) {
+	if j == nil {
+		return
+	}
+
+	parent := doc.Parent
+	doc.Parent = ""
+	if len(parent) > 0 && len(doc.Routing) == 0 {
+		doc.Routing = parent
+	}
+
+	if !j.Enabled() {
+		return
+	}
+
+	if len(j.typeName) > 0 {
+		doc.Type = j.typeName
+	}
+
+	var value interface{}
+	if j.children[sourceType] && len(parent) > 0 {
+		value = map[string]interface{}{
+			"name":   sourceType,
+			"parent": parent,
+		}
+	} else if j.parents[sourceType] {
+		value = sourceType
+	} else {
+		return
+	}
+
+	source, err := doc.sourceMap()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	source[j.field] = value
+}
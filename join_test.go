@@ -0,0 +1,111 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJoinTranslatorApply(t *testing.T) {
+	j := NewJoinTranslator("join", "_doc", map[string]string{"question": "answer, comment"})
+
+	tests := []struct {
+		name       string
+		doc        Document
+		sourceType string
+		source     map[string]interface{}
+		routing    string
+	}{
+		{
+			name:       "parent",
+			doc:        Document{source: map[string]interface{}{"title": "q"}},
+			sourceType: "question",
+			source:     map[string]interface{}{"title": "q", "join": "question"},
+		},
+		{
+			name:       "child",
+			doc:        Document{Parent: "1", source: map[string]interface{}{"body": "a"}},
+			sourceType: "answer",
+			source:     map[string]interface{}{"body": "a", "join": map[string]interface{}{"name": "answer", "parent": "1"}},
+			routing:    "1",
+		},
+		{
+			name:       "child with raw source",
+			doc:        Document{Parent: "2", rawSource: json.RawMessage(`{"body":"c"}`)},
+			sourceType: "comment",
+			source:     map[string]interface{}{"body": "c", "join": map[string]interface{}{"name": "comment", "parent": "2"}},
+			routing:    "2",
+		},
+		{
+			name:       "parent without source",
+			doc:        Document{},
+			sourceType: "question",
+			source:     map[string]interface{}{"join": "question"},
+		},
+		{
+			name:       "unrelated type keeps raw source",
+			doc:        Document{rawSource: json.RawMessage(`{"x":1}`)},
+			sourceType: "other",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := tt.doc
+			j.Apply(&doc, tt.sourceType)
+			if doc.Type != "_doc" {
+				t.Errorf("type = %q", doc.Type)
+			}
+			if len(doc.Parent) > 0 || doc.Routing != tt.routing {
+				t.Errorf("parent = %q, routing = %q, expected routing %q", doc.Parent, doc.Routing, tt.routing)
+			}
+			if tt.source == nil {
+				if doc.rawSource == nil {
+					t.Errorf("raw source was decoded")
+				}
+				return
+			}
+			if doc.rawSource != nil || !reflect.DeepEqual(doc.source, tt.source) {
+				t.Errorf("source = %v, expected %v", doc.source, tt.source)
+			}
+		})
+	}
+}
+
+func TestJoinRelationsFromMappings(t *testing.T) {
+	mappings := Indexes{"qa": map[string]interface{}{"mappings": map[string]interface{}{
+		"question": map[string]interface{}{},
+		"answer":   map[string]interface{}{"_parent": map[string]interface{}{"type": "question"}},
+	}}}
+
+	var j *JoinTranslator
+	j.AddRelationsFromMappings(&mappings)
+	if j.Enabled() {
+		t.Errorf("nil translator is enabled")
+	}
+
+	j = NewJoinTranslator("join", "", nil)
+	if j.Enabled() {
+		t.Errorf("enabled without relations")
+	}
+	j.AddRelationsFromMappings(&mappings)
+	if !j.Enabled() || !reflect.DeepEqual(j.relations, map[string][]string{"question": {"answer"}}) {
+		t.Errorf("relations = %v", j.relations)
+	}
+}
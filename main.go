@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,13 +12,14 @@ import (
 	"os"
 	"runtime"
 	_ "runtime/pprof"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cheggaaa/pb"
 	log "github.com/cihub/seelog"
-	goflags "github.com/jessevdk/go-flags"
 	"github.com/mattn/go-isatty"
 )
 
@@ -46,6 +48,9 @@ func main() {
 			http.DefaultServeMux.ServeHTTP(w, r)
 		})
 
+		// expvar 指标，包括缓存中的文档数量和字节数
+		mux.Handle("/debug/vars", expvar.Handler())
+
 		// register metrics handler
 		// 这段代码的作用是注册一个 HTTP 的 pprof 处理器，用于性能分析。在该处理器中，我们采用默认的 ServeMux 对象来处理 HTTP 请求，并将其绑定到 /debug/pprof/ 路径下
 		endpoint := http.ListenAndServe("0.0.0.0:6060", mux)
@@ -67,34 +72,38 @@ func main() {
 	//将 Migrator 的 Config 字段设置为一个 Config 结构体
 	migrator.Config = c
 
+	/*迁移有失败的任务时，在其他 defer（例如恢复索引的 refresh 设置）执行完之后以非 0 状态退出，方便脚本判断结果*/
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			log.Flush()
+			os.Exit(exitCode)
+		}
+	}()
+
 	/*
 		使用 goflags "github.com/jessevdk/go-flags" 包解析 c 变量（类型为指向 Config 结构体的指针），
-		通过执行 goflags.Parse(c)，将命令行参数解析并赋值给 c，同时也会检查参数是否存在无效的选项或参数，
-		需要注意的是，此处将解析结果的第一个值赋值给空标识符 _，表示忽略该值，仅仅只是为了符合 goflags 包的函数签名，实际用处为解析命令行参数并更新 c 对应的属性。
+		指定了 --config 时，还会加载配置文件中的参数，命令行参数的优先级更高，具体见 config.go 的 parseConfig。
 	*/
-	_, err = goflags.Parse(c)
+	err = parseConfig(c)
 
-	// 如果解析失败（即 err != nil），则将错误日志输出并返回。
+	// 如果解析失败（即 err != nil），则将错误日志输出并返回。日志还没有初始化，默认的日志是异步的，需要 Flush 才能输出。
 	if err != nil {
 		log.Error(err)
+		log.Flush()
 		return
 	}
 
 	//初始化日志记录器
 	setInitLogging(c.LogLevel)
 
-	// 判断用户是否传入必要参数
-	if len(c.SourceEs) == 0 && len(c.DumpInputFile) == 0 {
-		log.Error("no input, type --help for more details")
+	// 在连接任何集群之前，检查参数是否完整、是否互相冲突
+	if err = c.Validate(); err != nil {
+		log.Errorf("invalid options:\n  %v", err)
 		return
 	}
-	if len(c.TargetEs) == 0 && len(c.DumpOutFile) == 0 {
-		log.Error("no output, type --help for more details")
-		return
-	}
-
-	if c.SourceEs == c.TargetEs && c.SourceIndexNames == c.TargetIndexName {
-		log.Error("migration output is the same as the output")
+	if c.CheckConfig {
+		log.Info("options are valid")
 		return
 	}
 
@@ -108,6 +117,34 @@ func main() {
 		showBar = false
 	}
 
+	/*
+		初始化全局限速器，所有的 bulk worker 和 scroll 共用，未设置的限速器为 nil，表示不限速。
+	*/
+	migrator.BulkDocsLimiter = NewRateLimiter(float64(c.BulkDocsPerSecond))
+	migrator.BulkBytesLimiter = NewRateLimiter(c.BulkMBPerSecond * 1024 * 1024)
+	migrator.ScrollLimiter = NewRateLimiter(c.ScrollRequestsPerSecond)
+	migrator.BulkController = NewBulkController(c)
+	migrator.BulkStats = NewBulkStats()
+	migrator.Sampler = NewDocSampler(c)
+	migrator.Masker, err = NewMasker(c)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	migrator.Bench, err = NewBenchRecorder(c)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	/*
+		DocChan 中缓存的文档按照 --buffer_size 限制总字节数，缓存的文档数量和大小定期输出到日志，
+		并通过 expvar 发布在 http://localhost:6060/debug/vars。
+	*/
+	migrator.DocBuffer = NewDocBuffer(int64(c.BufferSizeInMB) * 1024 * 1024)
+	expvar.Publish("doc_buffer", expvar.Func(migrator.DocBuffer.Vars))
+	go migrator.DocBuffer.Report(30 * time.Second)
+
 	//至少输出一次
 	if c.RepeatOutputTimes < 1 {
 		c.RepeatOutputTimes = 1
@@ -129,6 +166,13 @@ func main() {
 			*/
 			migrator.DocChan = make(chan map[string]interface{}, c.BufferCount)
 
+			/*开启 --spill_dir 时，DocChan 满了之后的文档先写入磁盘，由后台协程读回 DocChan，提前退出时也会删除临时目录*/
+			if err := migrator.startSpill(); err != nil {
+				log.Error("failed to create spill queue: ", err)
+				return
+			}
+			defer migrator.Spill.Remove()
+
 			/*
 				定义了1个名为 srcESVersion 的指针类型变量，类型为 *ClusterVersion ,
 				该变量用于存储源 Elasticsearch 集群的版本信息。
@@ -178,7 +222,8 @@ func main() {
 					获取输入源ES的版本并根据版本创建相应的API对象
 					该方法的第一个参数是输入源ES的地址，第二个参数是用于身份认证（如果需要）的Auth结构体指针，第三个参数是ES的代理地址（如果有的话）
 				*/
-				srcESVersion, errs := migrator.ClusterVersion(c.SourceEs, migrator.SourceAuth, migrator.Config.SourceProxy)
+				var errs []error
+				srcESVersion, errs = migrator.ClusterVersion(c.SourceEs, migrator.SourceAuth, migrator.Config.SourceProxy)
 				if errs != nil {
 					return
 				}
@@ -190,6 +235,7 @@ func main() {
 				if strings.HasPrefix(srcESVersion.Version.Number, "7.") {
 					log.Debug("source es is V7,", srcESVersion.Version.Number)
 					api := new(ESAPIV7)
+					api.Sampler = migrator.Sampler
 					api.Host = c.SourceEs
 					api.Compress = c.Compress
 					api.Auth = migrator.SourceAuth
@@ -198,6 +244,7 @@ func main() {
 				} else if strings.HasPrefix(srcESVersion.Version.Number, "6.") {
 					log.Debug("source es is V6,", srcESVersion.Version.Number)
 					api := new(ESAPIV6)
+					api.Sampler = migrator.Sampler
 					api.Compress = c.Compress
 					api.Host = c.SourceEs
 					api.Auth = migrator.SourceAuth
@@ -206,6 +253,7 @@ func main() {
 				} else if strings.HasPrefix(srcESVersion.Version.Number, "5.") {
 					log.Debug("source es is V5,", srcESVersion.Version.Number)
 					api := new(ESAPIV5)
+					api.Sampler = migrator.Sampler
 					api.Host = c.SourceEs
 					api.Compress = c.Compress
 					api.Auth = migrator.SourceAuth
@@ -219,124 +267,21 @@ func main() {
 					api.Auth = migrator.SourceAuth
 					api.HttpProxy = migrator.Config.SourceProxy
 					migrator.SourceESAPI = api
-				}
-
-				// 确保 c.ScrollSliceSize 属性小于1时候，置位1
-				if c.ScrollSliceSize < 1 {
-					c.ScrollSliceSize = 1
-				}
-
-				//根据输入源(c)中设定的游标(Cursor)大小，分批从源ES中读取数据
-				totalSize := 0
-				finishedSlice := 0
 
-				/*
-					在进行数据迁移的过程中，通过 Elasticsearch 的 scroll API 来批量拉取原索引中的文档数据，并分片进行处理。
-					具体来说，循环的次数是由 c.ScrollSliceSize 变量决定的，每一次循环通过 NewScroll 方法来创建一个 scroll 对象，
-					该对象会拉取一个固定数量（c.DocBufferCount）的文档数据，并在固定的时间内（c.ScrollTime）内保持数据的可访问性，以供后续查看和处理。
-					Query 参数是查询条件，slice 和 c.ScrollSliceSize 用来确定当前循环处理的块的起始位置和大小（分片）。
-					Fields 参数则指定了需要获取的字段列表。
-				*/
-				for slice := 0; slice < c.ScrollSliceSize; slice++ {
-					scroll, err := migrator.SourceESAPI.NewScroll(c.SourceIndexNames, c.ScrollTime, c.DocBufferCount, c.Query, slice, c.ScrollSliceSize, c.Fields)
-					//在每一次循环中，如果创建 scroll 对象失败，会输出错误日志并退出函数。
-					if err != nil {
-						log.Error(err)
-						return
-					}
-
-					/*
-						将 scroll 对象转换为实现了 ScrollAPI 接口的类型temp,
-						把 scroll 对象强制转换为 ScrollAPI 接口类型，我们就可以在之后对这个对象进行更高级别的操作和处理，而不用担心会发生类型错误。
-					*/
-					temp := scroll.(ScrollAPI)
-
-					/*
-						累加每个分片中查询结果的总命中数，因此需要将每个分片中命中数相加并赋值给 totalSize 变量。
-						其中 temp 是一个存储查询结果的结构体，它包含了分片的查询结果信息，包括总命中数，命中的数据文档等。
-						GetHitsTotal() 是 temp 结构体的一个方法，用于获取该分片查询结果的总命中数。
-					*/
-					totalSize += temp.GetHitsTotal()
-
-					/*
-						判断当前查询结果是否有命中的文档，并且是否使用了 scroll 参数。
-						其中，scroll 参数是一种分批获取数据的方式，它可以在 Elasticsearch 中实现快速滚动查询,
-						temp.GetDocs() 是一个方法，用于获取当前查询结果命中的文档列表。
-					*/
-					if scroll != nil && temp.GetDocs() != nil {
-
-						/*
-							temp.GetHitsTotal() 是一个方法，用于获取当前查询结果的总命中数。
-							如果该命中数为0，则说明没有任何文档被查询到，此时就会输出错误日志信息并退出程序执行。
-							这样可以避免后续处理数据的代码因为没有任何文档的情况而出现异常。
-						*/
-						if temp.GetHitsTotal() == 0 {
-							log.Error("can't find documents from source.")
-							return
-						}
-
-						//一个匿名的 go 协程.用语处理数据的逻辑。这里创建了协程，是为了方便数据读取和处理的过程可以并发执行，提高程序运行效率。
-						go func() {
-
-							//调用 wg.Add(1) 方法，将 WaitGroup 的计数器加1，表示有一个任务需要等待完成。
-							wg.Add(1)
-
-							/*
-								开始处理当前查询结果集中的所有文档。该方法会处理当前查询结果集中第一页的数据，
-								并将第一页的数据放入到 migrator.DocChan 通道中。DocChan 是一个用于存储要处理的数据文档的通道。
-							*/
-							temp.ProcessScrollResult(&migrator, fetchBar)
-
-							/*
-								for循环是个无限循环，直到 temp.Next(&migrator, fetchBar) 函数返回 true 才会退出循环。
-								进入下一页面的查询结果，并将查询结果中的文档放入 migrator.DocChan 通道中。
-								如果返回 false，则说明查询结果已经全部读取完成。
-							*/
-							for temp.Next(&migrator, fetchBar) == false {
-							}
-
-							/*
-								用于控制台中输出进度条。
-								如果需要显示进度条，则会调用 fetchBar.Finish() 方法，这个方法会结束当前进度条的显示。
-								如果 showBar 为 false，则不会有任何输出。
-								这种参数化的设计模式可以提高代码的可复用性和灵活性，使得代码更易于扩展和维护。
-							*/
-							if showBar {
-								fetchBar.Finish()
-							}
-
-							// finished, close doc chan and wait for goroutines to be done
-							// wg.Done() 函数会通知 WaitGroup 程序，表示一个goroutine已经完成了任务，从而维护 WaitGroup 中的计数器。
-							wg.Done()
-
-							// finishedSlice 变量会自增1，用于表示已经完成的数据块数量.
-							finishedSlice++
-
-							//clean up final results
-							//如果finishedSlice 的值等于 c.ScrollSliceSize，则意味着已经处理完了指定数量的数据块，就需要进行最后一些清理工作了。
-							if finishedSlice == c.ScrollSliceSize {
-								log.Debug("closing doc chan")
-
-								/*
-									会调用 close(migrator.DocChan) 函数来关闭 DocChan 通道，这样就能通知后台 goroutine 停止工作。
-									最终结果是通过该代码段来正确关闭和整理迁移过程中的各种任务和资源，以确保程序能够正常地结束。
-								*/
-								close(migrator.DocChan)
-							}
-						}()
+					// 1.x/2.x 的 _source 排除和通配符在客户端完成
+					if needClientSourceFilter(c.Fields, c.ExcludeFields) {
+						log.Debug("source es doesn't support _source includes/excludes, filter source fields on client side")
+						migrator.SourceFilter = NewSourceFilter(c.Fields, c.ExcludeFields)
 					}
 				}
 
-				/*
-					在设置进度条的总进度值。其中，totalSize 是数据的总大小，如果大于 0，则将其设置为进度条的总值。
-					fetchBar 和 outputBar 是两个进度条对象，分别用来表示数据 fetch（获取）和 output（输出）的进度。
-					通过设置 Total 属性，可以让进度条显示正确的总进度。
-				*/
-				if totalSize > 0 {
-					fetchBar.Total = int64(totalSize)
-					outputBar.Total = int64(totalSize)
+				/*5.x 及以上的源集群在 scroll 查询中采样，1.x/2.x 在客户端采样*/
+				if _, ok := migrator.SourceESAPI.(*ESAPIV0); !ok && migrator.Sampler != nil {
+					migrator.Sampler.serverSide = true
 				}
 
+				/*scroll 在目标集群准备完成之后才打开，见下面的 startScrolls*/
+
 				// 判断是否指定了输入文件 c.DumpInputFile，如果指定了，则会将文件内容读取出来，并根据读取到的行数创建相应数量的进度条。
 			} else if len(c.DumpInputFile) > 0 {
 
@@ -389,6 +334,11 @@ func main() {
 					我们可以知道当前程序正在执行到哪一行代码，以及在解决程序问题时有所帮助。
 					通常日志的等级包括 Debug、Info、Warning、Error 和 Fatal 等，开发者可以根据需要选择合适的等级进行记录。
 				*/
+				/*CSV 的第一行是列名*/
+				if c.InputFileType == "csv" && !c.CsvNoHeader && lineCount > 0 {
+					lineCount--
+				}
+
 				log.Trace("file line,", lineCount)
 
 				/*
@@ -409,6 +359,19 @@ func main() {
 
 			}
 
+			/*--generate_docs 时根据 mapping 生成随机文档，代替 scroll 或者文件读取的文档*/
+			if c.GenerateDocs > 0 {
+				generator, err := migrator.NewDocGenerator()
+				if err != nil {
+					log.Error(err)
+					return
+				}
+				fetchBar = pb.New(c.GenerateDocs).Prefix("Generate")
+				outputBar.Total = int64(c.GenerateDocs)
+				wg.Add(1)
+				go migrator.NewGenerateWorker(generator, fetchBar, &wg)
+			}
+
 			/*
 				定义一个名为 pool 的指针变量，它的类型是 *pb.Pool。简单来说，它表示一个 pb.Pool 类型的指针，
 				即指向一个进度池（Pool）对象的指针。
@@ -416,7 +379,8 @@ func main() {
 			var pool *pb.Pool
 
 			//只有当 showBar 为 true 时才创建和启动进度条池。如果该变量为 false，则不会进行进度条相关的操作。
-			if showBar {
+			//--per_index 模式下每个索引任务有自己的进度条，由 runIndexJobs 创建。
+			if showBar && !c.PerIndex && !c.DryRun && !c.ReindexRemote {
 
 				/*
 					使用 pb.StartPool() 函数来创建进度条池，并将组件 fetchBar 和 outputBar 作为参数传递给该函数。
@@ -495,6 +459,29 @@ func main() {
 
 				}
 
+				/*--dry_run 时拦截所有写入目标集群的请求，只记录下来输出到迁移计划中*/
+				if c.DryRun {
+					migrator.TargetESAPI = NewDryRunAPI(migrator.TargetESAPI)
+				}
+
+				/*
+					6.x 及以上版本不再支持 _parent，父子文档需要翻译成 join 字段，并合并到同一个 type 中。
+					join、--split_types 以及没有 _type 的文档都写入同一个 type：--type_override，没有指定时使用目标集群默认的 type。
+				*/
+				typeName := c.OverrideTypeName
+				if len(typeName) == 0 {
+					typeName = defaultTypeName(descESVersion)
+				}
+				migrator.TargetTypeName = typeName
+				if majorVersion(descESVersion) >= 6 {
+					migrator.Join = NewJoinTranslator(c.JoinField, typeName, c.JoinRelations)
+				}
+
+				/*开启 --split_types 时，每个 type 写入单独的索引*/
+				if c.SplitTypes {
+					migrator.TypeSplitter = NewTypeSplitter(c, typeName)
+				}
+
 				log.Debug("start process with mappings")
 
 				/*
@@ -615,6 +602,20 @@ func main() {
 						return
 					}
 
+					/*
+						从源索引的 mapping 中找出 _parent 父子关系。
+						--split_types 把父文档和子文档写入不同的索引，join 字段无法关联，只把 _parent 转换成 routing，丢弃父子关系。
+					*/
+					if migrator.TypeSplitter == nil {
+						migrator.Join.AddRelationsFromMappings(sourceIndexMappings)
+					} else {
+						dropped := NewJoinTranslator(c.JoinField, "", nil)
+						dropped.AddRelationsFromMappings(sourceIndexMappings)
+						if dropped.Enabled() {
+							log.Warn("split_types puts parents and children into different indices, _parent relations are dropped, only the routing is kept")
+						}
+					}
+
 					/*
 						map[string]interface{}{} 表示一个空的字典类型。这是因为 map 是一种数据结构，用于存储键值对，需要指定键和值的类型。
 						在这种情况下，键类型是 string，值类型是 interface{}，{} 表示没有初始化时的初始状态，因此表示空字典类型。
@@ -664,6 +665,40 @@ func main() {
 						*/
 						c.SourceIndexNames = indexNames
 
+						/*
+							迁移开始之前检查版本兼容性、磁盘空间、字段数量、scroll 限制和插件，有失败项时以非 0 状态退出；
+							这时还没有打开任何 scroll（scroll 在目标集群准备完成之后才打开），退出时不会留下 scroll context。
+							--dry_run 时只输出检查结果，继续输出迁移计划。
+						*/
+						if !c.SkipPreflight {
+							report := migrator.preflight(srcESVersion, descESVersion, indexNames, sourceIndexMappings)
+							report.Log()
+							if err := report.Err(); err != nil && !c.DryRun {
+								log.Error(err)
+								log.Error("fix the problems above or use --skip_preflight to start the migration anyway")
+								exitCode = 1
+								return
+							}
+						}
+
+						/*
+							-y 把多个源索引合并到一个目标索引时，比较所有源索引的 mapping，输出类型冲突的字段。
+							复制 mapping 时使用合并之后的 mapping 更新目标索引，冲突的字段必须通过 --merge_mapping_rule 指定类型。
+						*/
+						mergeIndices := migrator.TypeSplitter == nil && len(c.TargetIndexName) > 0 && indexCount > 1
+						if mergeIndices {
+							merge := MergeMappings(sourceIndexMappings, splitFieldList(indexNames), c.MergeMappingRules)
+							merge.Log()
+							if c.CopyIndexMappings {
+								if unresolved := merge.Unresolved(); len(unresolved) > 0 && !c.DryRun {
+									log.Errorf("%d conflicting fields have no resolution rule, the merged mapping can't be copied", len(unresolved))
+									exitCode = 1
+									return
+								}
+								sourceIndexMappings = &Indexes{c.TargetIndexName: map[string]interface{}{"mappings": merge.Mapping}}
+							}
+						}
+
 						// copy index settings if user asked
 						/*
 							根据用户是否要求复制索引设置，或者是否指定了要复制的分片数，对索引设置进行复制，并获取源索引的设置。
@@ -673,7 +708,20 @@ func main() {
 							在这种情况下，代码会调用 Elasticsearch 的 RESTful API，获取源索引的设置，保存在 sourceIndexSettings 变量中，以供后面的代码使用。
 
 						*/
-						if c.CopyIndexSettings || c.ShardsCount > 0 {
+						/*
+							开启 --split_types 时，目标索引按照 type 拆分，使用每个 type 自己的 mapping 创建，不再复制整个索引的 mapping。
+						*/
+						if migrator.TypeSplitter != nil {
+							var sourceIndexSettings *Indexes
+							if c.CopyIndexSettings {
+								sourceIndexSettings, err = migrator.SourceESAPI.GetIndexSettings(c.SourceIndexNames)
+								if err != nil {
+									log.Error(err)
+									return
+								}
+							}
+							migrator.TypeSplitter.CreateIndices(migrator.TargetESAPI, sourceIndexMappings, sourceIndexSettings, c.TargetIndexName, c.ShardsCount, c.RecreateIndex, strings.HasPrefix(descESVersion.Version.Number, "6."))
+						} else if c.CopyIndexSettings || c.ShardsCount > 0 {
 							log.Info("start settings/mappings migration..")
 
 							//get source index settings
@@ -737,6 +785,12 @@ func main() {
 								*/
 								delete(*sourceIndexSettings, c.SourceIndexNames)
 								log.Debug(sourceIndexSettings)
+							} else if mergeIndices {
+								/*多个源索引合并到一个目标索引时，使用名称排序后第一个源索引的设置创建目标索引*/
+								names := splitFieldList(c.SourceIndexNames)
+								sort.Strings(names)
+								log.Debugf("merge %d indices into %s, use the settings of %s", indexCount, c.TargetIndexName, names[0])
+								*sourceIndexSettings = Indexes{c.TargetIndexName: (*sourceIndexSettings)[names[0]]}
 							}
 
 							/*
@@ -945,21 +999,82 @@ func main() {
 					}
 
 					defer migrator.recoveryIndexSettings(sourceIndexRefreshSettings)
+					migrator.IndexRefreshSettings = sourceIndexRefreshSettings
 				} else if len(c.DumpInputFile) > 0 {
 					//check shard settings
 					//TODO support shard config
+				} else if len(c.GenerateMapping) > 0 && c.CopyIndexMappings {
+					/*--generate_mapping 时使用文件中的 mapping 创建目标索引*/
+					migrator.createGeneratedIndex()
+				}
+
+				/*在目标索引上添加 join 字段的 mapping*/
+				if migrator.Join.Enabled() {
+					targetIndexNames := c.TargetIndexName
+					if len(targetIndexNames) == 0 {
+						targetIndexNames = c.SourceIndexNames
+					}
+					migrator.Join.PutMappings(migrator.TargetESAPI, targetIndexNames, strings.HasPrefix(descESVersion.Version.Number, "6."))
 				}
 
 			}
 
+			if c.DryRun {
+				migrator.reportDryRun()
+				return
+			}
+
+			/*
+				在进行数据迁移的过程中，通过 Elasticsearch 的 scroll API 来批量拉取原索引中的文档数据，并分片进行处理。
+				生成 scroll 计划，默认所有源索引共用一个 scroll，如果通过 --index_query_file 为某些索引指定了单独的查询文件，这些索引会使用各自的 scroll，
+				每个计划打开 plan.slices 个 scroll，在后台读取全部结果写入 DocChan，全部读取完成后关闭 DocChan。
+				scroll 在目标集群的准备工作（join 字段、拆分 type、preflight 检查等）完成之后才打开，
+				保证读取第一个文档之前处理文档需要的配置都已经确定，检查失败时也不会留下已经打开的 scroll。
+				--per_index 模式下每个索引任务各自生成 scroll 计划，见 runIndexJobs；--reindex_remote 由目标集群读取，--generate_docs 只读取 mapping。
+			*/
+			if len(c.SourceEs) > 0 && !c.PerIndex && !c.ReindexRemote && c.GenerateDocs == 0 {
+				plans, err := migrator.planScrolls()
+				if err != nil {
+					log.Error(err)
+					return
+				}
+				//确定每个 scroll 计划的 slice 数量，--sliced_scroll_size=auto 时根据分片和文档数量自动选择
+				migrator.resolveSlices(plans)
+
+				totalSize, err := migrator.startScrolls(plans, fetchBar)
+				if err != nil {
+					log.Error(err)
+					return
+				}
+				if totalSize == 0 {
+					log.Error("can't find documents from source.")
+					return
+				}
+
+				/*设置进度条的总进度值，fetchBar 和 outputBar 分别表示数据获取和输出的进度*/
+				fetchBar.Total = int64(totalSize)
+				outputBar.Total = int64(totalSize)
+			}
+
 			log.Info("start data migration..")
+			migrator.Bench.Start()
 
 			//start es bulk thread
 			/*
 				启动 Elasticsearch 批量写入线程或者文件导出线程。
+				--per_index 模式下每个源索引作为独立的任务迁移，失败的任务在最后汇总输出；
+				--reindex_remote 模式下由目标集群执行 _reindex 任务，这里只轮询进度。
 				如果 TargetEs 不为空。
 			*/
-			if len(c.TargetEs) > 0 {
+			if c.PerIndex {
+				if failed := migrator.runIndexJobs(showBar); failed > 0 {
+					exitCode = 1
+				}
+			} else if c.ReindexRemote {
+				if failed := migrator.runReindexRemote(showBar); failed > 0 {
+					exitCode = 1
+				}
+			} else if len(c.TargetEs) > 0 {
 				log.Debug("start es bulk workers")
 
 				/*
@@ -1008,11 +1123,12 @@ func main() {
 
 			wg.Wait()
 
-			if showBar {
+			if showBar && pool != nil {
 
 				/*
 					如果 showBar 为 true，即需要显示进度条，那么输出进度条结束信息（outputBar.Finish()）。
 				*/
+				fetchBar.Finish()
 				outputBar.Finish()
 
 				/*
@@ -1025,6 +1141,17 @@ func main() {
 
 	}
 
+	/*输出 --benchmark 的最后一段和整个过程的统计，--repeat_times 的所有轮次合并统计*/
+	migrator.Bench.Stop()
+
+	if len(c.TargetEs) > 0 {
+		log.Infof("bulk %s results, %s", c.OpType, migrator.BulkStats)
+	}
+	if n := atomic.LoadInt32(&migrator.ScrollErrors); n > 0 {
+		log.Errorf("%d errors while reading the source, some documents were not migrated", n)
+		exitCode = 1
+	}
+	migrator.Masker.Log()
 	log.Info("data migration finished.")
 }
 
@@ -1033,6 +1160,9 @@ Migrator 结构体中的一个方法，用于从源索引中恢复索引设置
 sourceIndexRefreshSettings 参数是一个 map，表示源索引名称及其设置，该参数将用于覆盖目标索引的对应设置。
 */
 func (c *Migrator) recoveryIndexSettings(sourceIndexRefreshSettings map[string]interface{}) {
+	if c.Config.DryRun {
+		return
+	}
 	//update replica and refresh_interval
 	for name, interval := range sourceIndexRefreshSettings {
 		tempIndexSettings := getEmptyIndexSettings()
@@ -0,0 +1,341 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+/*
+MappingConflict 是合并多个源索引的 mapping 时，同一个字段在不同索引中类型不同的冲突。
+Types 记录每种类型出现在哪些索引中，Resolved 是按照 --merge_mapping_rule 选择的类型，没有匹配的规则时为空。
+*/
+type MappingConflict struct {
+	Type     string /*mapping type 名称，7.x 为空*/
+	Field    string
+	Types    map[string][]string
+	Resolved string
+	def      map[string]interface{}
+}
+
+func (c *MappingConflict) String() string {
+	var types []string
+	for t := range c.Types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	var parts []string
+	for _, t := range types {
+		parts = append(parts, fmt.Sprintf("%s in [%s]", t, strings.Join(c.Types[t], ",")))
+	}
+	field := c.Field
+	if len(c.Type) > 0 {
+		field = c.Type + "." + c.Field
+	}
+	s := fmt.Sprintf("field %s: %s", field, strings.Join(parts, ", "))
+	if len(c.Resolved) > 0 {
+		s += " => " + c.Resolved
+	}
+	return s
+}
+
+/*
+MappingMerge 是多个源索引合并到一个目标索引时的 mapping 分析结果。
+Mapping 是合并之后的 mapping，格式和 GetIndexMappings 返回的 mappings 相同，可以直接用于 UpdateIndexMapping。
+*/
+type MappingMerge struct {
+	Mapping   map[string]interface{}
+	Conflicts []*MappingConflict
+}
+
+/*
+比较 indices 中所有索引的 mapping，找出类型冲突的字段，并生成合并之后的 mapping。
+字段取所有索引的并集，multi-fields 也取并集；冲突的字段按照 rules 选择类型，规则的 key 是字段路径，支持通配符，
+没有匹配规则的冲突字段保留第一个索引（按名称排序）中的定义。
+*/
+func MergeMappings(mappings *Indexes, indices []string, rules map[string]string) *MappingMerge {
+	indices = append([]string(nil), indices...)
+	sort.Strings(indices)
+
+	/*每个 type 中每个字段路径的每种类型出现在哪些索引中，以及第一次出现时的定义*/
+	seen := map[string]map[string]map[string][]string{}
+	defs := map[string]map[string]map[string]map[string]interface{}{}
+	for _, index := range indices {
+		for typeName, typeMapping := range indexMappingTypes(mappings, index) {
+			if seen[typeName] == nil {
+				seen[typeName] = map[string]map[string][]string{}
+				defs[typeName] = map[string]map[string]map[string]interface{}{}
+			}
+			props, _ := typeMapping["properties"].(map[string]interface{})
+			walkMappingFields(props, "", func(field string, def map[string]interface{}) {
+				t := mappingFieldType(def)
+				if seen[typeName][field] == nil {
+					seen[typeName][field] = map[string][]string{}
+					defs[typeName][field] = map[string]map[string]interface{}{}
+				}
+				seen[typeName][field][t] = append(seen[typeName][field][t], index)
+				if _, ok := defs[typeName][field][t]; !ok {
+					defs[typeName][field][t] = def
+				}
+			})
+		}
+	}
+
+	merge := &MappingMerge{}
+	conflicts := map[string]map[string]*MappingConflict{}
+	for typeName, fields := range seen {
+		conflicts[typeName] = map[string]*MappingConflict{}
+		for field, types := range fields {
+			if len(types) < 2 {
+				continue
+			}
+			conflict := &MappingConflict{Type: typeName, Field: field, Types: types}
+			if t, ok := mappingRule(rules, field); ok {
+				conflict.Resolved = t
+				conflict.def = defs[typeName][field][t]
+				if conflict.def == nil {
+					conflict.def = map[string]interface{}{"type": t}
+				}
+			}
+			conflicts[typeName][field] = conflict
+			merge.Conflicts = append(merge.Conflicts, conflict)
+		}
+	}
+	sort.Slice(merge.Conflicts, func(i, j int) bool {
+		if merge.Conflicts[i].Type != merge.Conflicts[j].Type {
+			return merge.Conflicts[i].Type < merge.Conflicts[j].Type
+		}
+		return merge.Conflicts[i].Field < merge.Conflicts[j].Field
+	})
+
+	/*按照索引名称的顺序合并，type 级别的其他配置（_source、dynamic 等）使用第一个索引的*/
+	merged := map[string]map[string]interface{}{}
+	for _, index := range indices {
+		for typeName, typeMapping := range indexMappingTypes(mappings, index) {
+			target, ok := merged[typeName]
+			if !ok {
+				target = map[string]interface{}{}
+				for k, v := range typeMapping {
+					if k != "properties" {
+						target[k] = copyMapping(v)
+					}
+				}
+				target["properties"] = map[string]interface{}{}
+				merged[typeName] = target
+			}
+			props, _ := typeMapping["properties"].(map[string]interface{})
+			mergeMappingFields(target["properties"].(map[string]interface{}), props, "", conflicts[typeName])
+		}
+	}
+
+	if typeMapping, ok := merged[""]; ok {
+		merge.Mapping = typeMapping
+	} else {
+		merge.Mapping = map[string]interface{}{}
+		for typeName, typeMapping := range merged {
+			merge.Mapping[typeName] = typeMapping
+		}
+	}
+	return merge
+}
+
+/*没有匹配到任何规则的冲突*/
+func (m *MappingMerge) Unresolved() []*MappingConflict {
+	var unresolved []*MappingConflict
+	for _, c := range m.Conflicts {
+		if len(c.Resolved) == 0 {
+			unresolved = append(unresolved, c)
+		}
+	}
+	return unresolved
+}
+
+/*在日志中输出所有的冲突，没有规则的冲突写入目标索引时会导致 bulk 错误*/
+func (m *MappingMerge) Log() {
+	if len(m.Conflicts) == 0 {
+		log.Info("no mapping conflicts between the merged indices")
+		return
+	}
+	for _, c := range m.Conflicts {
+		if len(c.Resolved) > 0 {
+			log.Infof("mapping conflict resolved, %s", c)
+		} else {
+			log.Warnf("mapping conflict, %s", c)
+		}
+	}
+	if unresolved := m.Unresolved(); len(unresolved) > 0 {
+		log.Warnf("%d conflicting fields have no resolution rule, documents with the other types may be rejected by bulk, use --merge_mapping_rule, ie: %s:%s",
+			len(unresolved), unresolved[0].Field, firstMappingType(unresolved[0]))
+	}
+}
+
+func firstMappingType(c *MappingConflict) string {
+	var types []string
+	for t := range c.Types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types[0]
+}
+
+/*
+取出一个索引的 mapping 中每个 type 的 mapping。
+7.x 的 mapping 直接包含 properties，返回的 type 名称为空；更早的版本外面还有一层 type，_default_ 不参与合并。
+*/
+func indexMappingTypes(mappings *Indexes, index string) map[string]map[string]interface{} {
+	types := map[string]map[string]interface{}{}
+	if mappings == nil {
+		return types
+	}
+	m, _ := (*mappings)[index].(map[string]interface{})
+	mapping, _ := m["mappings"].(map[string]interface{})
+	if len(mapping) == 0 {
+		return types
+	}
+	if _, ok := mapping["properties"]; ok {
+		types[""] = mapping
+		return types
+	}
+	for name, v := range mapping {
+		typeMapping, ok := v.(map[string]interface{})
+		if !ok || (strings.HasPrefix(name, "_") && name != "_default_") {
+			/*不是 type 的 map，或者是 _source 之类的元数据字段，说明是没有 properties 的 7.x mapping*/
+			return map[string]map[string]interface{}{"": mapping}
+		}
+		if name != "_default_" {
+			types[name] = typeMapping
+		}
+	}
+	return types
+}
+
+/*遍历 properties 中的所有字段，包括 object 的子字段，字段路径用 . 连接*/
+func walkMappingFields(props map[string]interface{}, prefix string, fn func(field string, def map[string]interface{})) {
+	for name, v := range props {
+		def, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		field := prefix + name
+		fn(field, def)
+		if sub, ok := def["properties"].(map[string]interface{}); ok {
+			walkMappingFields(sub, field+".", fn)
+		}
+	}
+}
+
+/*字段的类型，没有 type 的是 object*/
+func mappingFieldType(def map[string]interface{}) string {
+	if t, ok := def["type"].(string); ok {
+		return t
+	}
+	return "object"
+}
+
+/*查找字段的合并规则，和配置文件中的索引名称一样，完全匹配优先，其次是最具体的通配符*/
+func mappingRule(rules map[string]string, field string) (string, bool) {
+	var patterns []string
+	for p := range rules {
+		patterns = append(patterns, p)
+	}
+	if p, ok := matchIndexPattern(patterns, field); ok {
+		return rules[p], true
+	}
+	return "", false
+}
+
+/*
+把 src 中的字段合并到 dst，object 的子字段和 multi-fields 取并集。
+有规则的冲突字段使用规则选择的定义，其他类型的定义被忽略；没有规则的冲突字段保留先合并进来的定义。
+*/
+func mergeMappingFields(dst, src map[string]interface{}, prefix string, conflicts map[string]*MappingConflict) {
+	for name, v := range src {
+		def, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		field := prefix + name
+
+		if conflict, ok := conflicts[field]; ok {
+			want := conflict.Resolved
+			if len(want) == 0 {
+				want = mappingFieldType(def)
+				if existing, ok := dst[name].(map[string]interface{}); ok {
+					want = mappingFieldType(existing)
+				}
+			}
+			if mappingFieldType(def) != want {
+				if _, exists := dst[name]; !exists {
+					dst[name] = copyMapping(conflict.def)
+				}
+				continue
+			}
+		}
+
+		existing, ok := dst[name].(map[string]interface{})
+		if !ok {
+			existing = map[string]interface{}{}
+			for k, item := range def {
+				if k != "properties" && k != "fields" {
+					existing[k] = copyMapping(item)
+				}
+			}
+			dst[name] = existing
+		}
+
+		if sub, ok := def["properties"].(map[string]interface{}); ok {
+			props, ok := existing["properties"].(map[string]interface{})
+			if !ok {
+				props = map[string]interface{}{}
+				existing["properties"] = props
+			}
+			mergeMappingFields(props, sub, field+".", conflicts)
+		}
+
+		if fields, ok := def["fields"].(map[string]interface{}); ok {
+			multi, ok := existing["fields"].(map[string]interface{})
+			if !ok {
+				multi = map[string]interface{}{}
+				existing["fields"] = multi
+			}
+			for k, f := range fields {
+				if _, ok := multi[k]; !ok {
+					multi[k] = copyMapping(f)
+				}
+			}
+		}
+	}
+}
+
+/*深拷贝 mapping 中的值，避免合并时修改源索引的 mapping*/
+func copyMapping(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return v
+	}
+	return out
+}
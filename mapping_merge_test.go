@@ -0,0 +1,136 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMappingRule(t *testing.T) {
+	rules := map[string]string{"user.id": "keyword", "user.*": "long", "*": "text", "*.id": "integer"}
+	tests := []struct {
+		field    string
+		expected string
+	}{
+		{"user.id", "keyword"},
+		{"order.id", "integer"},
+		{"user.age", "long"},
+		{"title", "text"},
+	}
+	for _, tt := range tests {
+		if got, ok := mappingRule(rules, tt.field); !ok || got != tt.expected {
+			t.Errorf("mappingRule(%q) = %q, %v, expected %q", tt.field, got, ok, tt.expected)
+		}
+	}
+	if _, ok := mappingRule(map[string]string{"user.*": "long"}, "title"); ok {
+		t.Errorf("expected no rule for title")
+	}
+}
+
+func indexMapping(mappings map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"mappings": mappings}
+}
+
+func field(t string) map[string]interface{} {
+	return map[string]interface{}{"type": t}
+}
+
+func TestMergeMappings(t *testing.T) {
+	mappings := Indexes{
+		"logs-2": indexMapping(map[string]interface{}{"properties": map[string]interface{}{
+			"status": field("keyword"),
+			"title":  map[string]interface{}{"type": "text", "fields": map[string]interface{}{"raw": field("keyword")}},
+			"user":   map[string]interface{}{"properties": map[string]interface{}{"id": field("keyword"), "age": field("integer")}},
+		}}),
+		"logs-1": indexMapping(map[string]interface{}{"_source": map[string]interface{}{"enabled": true}, "properties": map[string]interface{}{
+			"status": field("long"),
+			"title":  map[string]interface{}{"type": "text", "fields": map[string]interface{}{"en": map[string]interface{}{"type": "text", "analyzer": "english"}}},
+			"user":   map[string]interface{}{"properties": map[string]interface{}{"id": field("long")}},
+		}}),
+	}
+
+	tests := []struct {
+		name       string
+		rules      map[string]string
+		conflicts  []string
+		unresolved int
+		status     string
+		userId     string
+	}{
+		{
+			name:       "without rules keeps the first index",
+			conflicts:  []string{"field status: keyword in [logs-2], long in [logs-1]", "field user.id: keyword in [logs-2], long in [logs-1]"},
+			unresolved: 2, status: "long", userId: "long",
+		},
+		{
+			name:       "rules",
+			rules:      map[string]string{"status": "keyword", "user.*": "keyword"},
+			conflicts:  []string{"field status: keyword in [logs-2], long in [logs-1] => keyword", "field user.id: keyword in [logs-2], long in [logs-1] => keyword"},
+			unresolved: 0, status: "keyword", userId: "keyword",
+		},
+	}
+
+	for _, tt := range tests {
+		merge := MergeMappings(&mappings, []string{"logs-2", "logs-1"}, tt.rules)
+
+		var conflicts []string
+		for _, c := range merge.Conflicts {
+			conflicts = append(conflicts, c.String())
+		}
+		if !reflect.DeepEqual(conflicts, tt.conflicts) {
+			t.Errorf("%s: conflicts = %q, expected %q", tt.name, conflicts, tt.conflicts)
+		}
+		if n := len(merge.Unresolved()); n != tt.unresolved {
+			t.Errorf("%s: %d unresolved, expected %d", tt.name, n, tt.unresolved)
+		}
+
+		props := merge.Mapping["properties"].(map[string]interface{})
+		user := props["user"].(map[string]interface{})["properties"].(map[string]interface{})
+		if got := mappingFieldType(props["status"].(map[string]interface{})); got != tt.status {
+			t.Errorf("%s: status = %s, expected %s", tt.name, got, tt.status)
+		}
+		if got := mappingFieldType(user["id"].(map[string]interface{})); got != tt.userId {
+			t.Errorf("%s: user.id = %s, expected %s", tt.name, got, tt.userId)
+		}
+		if _, ok := user["age"]; !ok {
+			t.Errorf("%s: user.age is missing", tt.name)
+		}
+		if fields := props["title"].(map[string]interface{})["fields"].(map[string]interface{}); len(fields) != 2 {
+			t.Errorf("%s: multi-fields = %v", tt.name, fields)
+		}
+		if !reflect.DeepEqual(merge.Mapping["_source"], map[string]interface{}{"enabled": true}) {
+			t.Errorf("%s: _source = %v", tt.name, merge.Mapping["_source"])
+		}
+	}
+}
+
+func TestMergeMappingsWithTypes(t *testing.T) {
+	mappings := Indexes{
+		"a": indexMapping(map[string]interface{}{"doc": map[string]interface{}{"properties": map[string]interface{}{"x": field("long")}}}),
+		"b": indexMapping(map[string]interface{}{
+			"doc":       map[string]interface{}{"properties": map[string]interface{}{"y": field("keyword")}},
+			"_default_": map[string]interface{}{"properties": map[string]interface{}{"z": field("keyword")}},
+		}),
+	}
+
+	merge := MergeMappings(&mappings, []string{"a", "b"}, nil)
+	expected := map[string]interface{}{"doc": map[string]interface{}{"properties": map[string]interface{}{"x": field("long"), "y": field("keyword")}}}
+	if len(merge.Conflicts) != 0 || !reflect.DeepEqual(merge.Mapping, expected) {
+		t.Errorf("got %v, %v, expected %v", merge.Mapping, merge.Conflicts, expected)
+	}
+}
@@ -0,0 +1,394 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	log "github.com/cihub/seelog"
+)
+
+/*脱敏之后的字符串，redact 策略使用*/
+const redactedValue = "[REDACTED]"
+
+/*
+maskPolicy 是 --mask 中字段对应的脱敏策略：
+redact 替换成 [REDACTED]（非字符串替换成 null），hmac 使用 --mask_key 计算 HMAC-SHA256，相同的值得到相同的结果，可以用于关联，
+truncate:N 只保留前 N 个字符，email 和 phone 生成格式相同的假数据（同样由 HMAC 决定，相同的值得到相同的假数据），
+shift_date:N 把日期移动 -N 到 N 天，同一个文档中的日期移动相同的天数，保持它们之间的间隔。
+*/
+type maskPolicy struct {
+	name string
+	arg  int
+}
+
+func (p maskPolicy) String() string {
+	if p.arg > 0 {
+		return fmt.Sprintf("%s:%d", p.name, p.arg)
+	}
+	return p.name
+}
+
+/*解析脱敏策略，truncate 和 shift_date 需要一个正整数参数。*/
+func parseMaskPolicy(s string) (maskPolicy, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	p := maskPolicy{name: parts[0]}
+	switch p.name {
+	case "redact", "hmac", "email", "phone":
+		if len(parts) > 1 {
+			return p, fmt.Errorf("mask policy %s doesn't take an argument", p.name)
+		}
+	case "truncate", "shift_date":
+		if len(parts) < 2 {
+			return p, fmt.Errorf("mask policy %s needs an argument, ie: %s:10", p.name, p.name)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n <= 0 {
+			return p, fmt.Errorf("invalid argument of mask policy %s: %s", p.name, parts[1])
+		}
+		p.arg = n
+	default:
+		return p, fmt.Errorf("unknown mask policy %s, options: redact,hmac,truncate:N,email,phone,shift_date:DAYS", p.name)
+	}
+	return p, nil
+}
+
+/*
+Masker 在文档写入 DocChan 之前对 _source 脱敏，bulk、导出文件和磁盘队列中都只有脱敏之后的数据。
+规则的 key 是字段路径，支持通配符，匹配方式和 --merge_mapping_rule 相同；匹配到 object 时，对其中所有的值使用同一个策略。
+*/
+type Masker struct {
+	rules    map[string]string
+	policies map[string]maskPolicy
+	key      []byte
+
+	lock   sync.Mutex
+	counts map[string]int /*key 为 字段路径(策略)*/
+}
+
+/*没有 --mask 时返回 nil。没有指定 --mask_key 时随机生成，hmac 的结果只在本次迁移中一致。*/
+func NewMasker(config *Config) (*Masker, error) {
+	if len(config.MaskFields) == 0 {
+		return nil, nil
+	}
+	m := &Masker{rules: config.MaskFields, policies: map[string]maskPolicy{}, counts: map[string]int{}}
+	for _, policy := range config.MaskFields {
+		p, err := parseMaskPolicy(policy)
+		if err != nil {
+			return nil, err
+		}
+		m.policies[policy] = p
+	}
+
+	if len(config.MaskKey) > 0 {
+		m.key = []byte(config.MaskKey)
+	} else {
+		m.key = make([]byte, 32)
+		if _, err := rand.Read(m.key); err != nil {
+			return nil, err
+		}
+		log.Warn("no --mask_key, using a random key, hashed and fake values won't match other runs")
+	}
+	return m, nil
+}
+
+/*对文档的 _source 脱敏，原始 JSON 的 _source 不会被修改，需要脱敏时 rawSourceAllowed 返回 false。*/
+func (m *Masker) Apply(doc map[string]interface{}) {
+	if m == nil {
+		return
+	}
+	source, ok := doc["_source"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	docKey := fmt.Sprintf("%v/%v", doc["_index"], doc["_id"])
+	m.walk(source, "", docKey)
+}
+
+func (m *Masker) walk(node map[string]interface{}, prefix, docKey string) {
+	for name, v := range node {
+		field := prefix + name
+		if policy, ok := mappingRule(m.rules, field); ok {
+			node[name] = m.mask(v, m.policies[policy], field, docKey)
+			continue
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			m.walk(v, field+".", docKey)
+		case []interface{}:
+			for _, item := range v {
+				if sub, ok := item.(map[string]interface{}); ok {
+					m.walk(sub, field+".", docKey)
+				}
+			}
+		}
+	}
+}
+
+/*对一个值脱敏，object 和数组中的每个值都使用同一个策略，redact 直接替换整个 object。*/
+func (m *Masker) mask(v interface{}, policy maskPolicy, field, docKey string) interface{} {
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		if policy.name == "redact" {
+			m.count(field, policy)
+			return nil
+		}
+		for k, item := range value {
+			value[k] = m.mask(item, policy, field, docKey)
+		}
+		return value
+	case []interface{}:
+		for i, item := range value {
+			value[i] = m.mask(item, policy, field, docKey)
+		}
+		return value
+	}
+
+	masked, ok := m.maskLeaf(v, policy, docKey)
+	if ok {
+		m.count(field, policy)
+	}
+	return masked
+}
+
+/*对单个值使用策略，策略不适用于这种类型的值时（例如 truncate 一个数字）原样返回 false。*/
+func (m *Masker) maskLeaf(v interface{}, policy maskPolicy, docKey string) (interface{}, bool) {
+	s, isString := v.(string)
+	switch policy.name {
+	case "redact":
+		if isString {
+			return redactedValue, true
+		}
+		return nil, true
+	case "hmac":
+		digest := m.digest(fmt.Sprint(v))
+		if isString {
+			return hex.EncodeToString(digest), true
+		}
+		return json.Number(strconv.FormatInt(maskedNumber(digest, v), 10)), true
+	case "truncate":
+		if !isString {
+			return v, false
+		}
+		if r := []rune(s); len(r) > policy.arg {
+			return string(r[:policy.arg]), true
+		}
+		return s, true
+	case "email":
+		if !isString {
+			return v, false
+		}
+		return m.fakeEmail(s), true
+	case "phone":
+		switch v.(type) {
+		case string:
+			return m.fakeDigits(s), true
+		case json.Number, float64:
+			n := fmt.Sprint(v)
+			if _, err := strconv.ParseInt(n, 10, 64); err != nil {
+				return v, false
+			}
+			return json.Number(m.fakeDigits(n)), true
+		}
+		return v, false
+	case "shift_date":
+		return m.shiftDate(v, policy.arg, docKey)
+	}
+	return v, false
+}
+
+/*
+数字的 hmac 结果保持数字类型，并且和原值的符号相同、绝对值小于能容纳原值的最小的 2 的幂，
+所以原值能写入的 byte、short、integer、long 字段，结果也能写入；上限为 2^52，JSON 中的整数不会丢失精度。
+*/
+func maskedNumber(digest []byte, v interface{}) int64 {
+	f, _ := strconv.ParseFloat(fmt.Sprint(v), 64)
+	abs := math.Abs(f)
+	bound := uint64(1)
+	for float64(bound) <= abs && bound < 1<<52 {
+		bound <<= 1
+	}
+	n := int64(binary.BigEndian.Uint64(digest) % bound)
+	if f < 0 {
+		n = -n
+	}
+	return n
+}
+
+func (m *Masker) digest(value string) []byte {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+/*
+生成格式相同的假数据：字母替换成字母（保持大小写），数字替换成数字，其他字符不变，
+替换由值的 HMAC 决定，所以相同的值总是得到相同的假数据。
+*/
+func (m *Masker) preserveFormat(value string) string {
+	out := []rune(value)
+	stream := m.digest(value)
+	for len(stream) < len(out) {
+		stream = append(stream, m.digest(string(stream))...)
+	}
+
+	for i, r := range out {
+		switch {
+		case r >= 'a' && r <= 'z':
+			out[i] = rune('a' + int(stream[i])%26)
+		case r >= 'A' && r <= 'Z':
+			out[i] = rune('A' + int(stream[i])%26)
+		case r >= '0' && r <= '9':
+			out[i] = rune('0' + int(stream[i])%10)
+		case unicode.IsLetter(r):
+			out[i] = 'x'
+		}
+	}
+	return string(out)
+}
+
+/*假的邮箱地址，用户名和域名都替换，只保留顶级域名，例如 john.doe@acme.com => kqzv.ram@wtxe.com*/
+func (m *Masker) fakeEmail(s string) string {
+	at := strings.LastIndex(s, "@")
+	if at < 0 {
+		return m.preserveFormat(s)
+	}
+	domain := s[at+1:]
+	tld := ""
+	if dot := strings.LastIndex(domain, "."); dot >= 0 {
+		domain, tld = domain[:dot], domain[dot:]
+	}
+	masked := m.preserveFormat(s[:at] + "@" + domain)
+	return masked + tld
+}
+
+/*假的电话号码，只替换数字，保留 +、括号、空格和 - 等格式，第一个数字不为 0 的号码替换之后也不为 0*/
+func (m *Masker) fakeDigits(s string) string {
+	out := []rune(m.preserveFormat(s))
+	orig := []rune(s)
+	for i, r := range orig {
+		if r >= '0' && r <= '9' {
+			if r != '0' && out[i] == '0' {
+				out[i] = '1'
+			}
+			break
+		}
+	}
+	return string(out)
+}
+
+/*shift_date 支持的日期格式，输出时保持原来的格式*/
+var maskDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+}
+
+/*
+把日期移动 -days 到 days 天（不为 0），偏移量由文档的 _index 和 _id 决定，同一个文档中的所有日期移动相同的天数。
+支持字符串格式的日期和毫秒时间戳，无法识别的值原样返回。
+*/
+func (m *Masker) shiftDate(v interface{}, days int, docKey string) (interface{}, bool) {
+	n := int(binary.BigEndian.Uint32(m.digest(docKey)) % uint32(2*days))
+	offset := n - days
+	if offset >= 0 {
+		offset++
+	}
+	shift := time.Duration(offset) * 24 * time.Hour
+
+	switch value := v.(type) {
+	case string:
+		for _, layout := range maskDateLayouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t.Add(shift).Format(layout), true
+			}
+		}
+	case json.Number:
+		if ms, err := value.Int64(); err == nil {
+			return json.Number(strconv.FormatInt(ms+int64(shift/time.Millisecond), 10)), true
+		}
+	case float64:
+		return value + float64(shift/time.Millisecond), true
+	}
+	return v, false
+}
+
+func (m *Masker) count(field string, policy maskPolicy) {
+	m.lock.Lock()
+	m.counts[fmt.Sprintf("%s(%s)", field, policy)]++
+	m.lock.Unlock()
+}
+
+/*按字段输出脱敏的值的数量，没有匹配到任何值的规则也会提示出来，通常是字段路径写错了。*/
+func (m *Masker) Log() {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var keys []string
+	total := 0
+	for k, n := range m.counts {
+		keys = append(keys, k)
+		total += n
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s: %d", k, m.counts[k]))
+	}
+	log.Infof("masked %d values, %s", total, strings.Join(parts, ", "))
+
+	var unused []string
+	for pattern, policy := range m.rules {
+		used := false
+		for k := range m.counts {
+			field := k[:strings.LastIndex(k, "(")]
+			if t, ok := mappingRule(map[string]string{pattern: policy}, field); ok && t == policy {
+				used = true
+				break
+			}
+		}
+		if !used {
+			unused = append(unused, pattern)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		log.Warnf("mask rules matched no values: %s", strings.Join(unused, ", "))
+	}
+}
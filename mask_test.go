@@ -0,0 +1,196 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParseMaskPolicy(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected maskPolicy
+		valid    bool
+	}{
+		{"redact", maskPolicy{name: "redact"}, true},
+		{" hmac ", maskPolicy{name: "hmac"}, true},
+		{"truncate:3", maskPolicy{name: "truncate", arg: 3}, true},
+		{"shift_date:30", maskPolicy{name: "shift_date", arg: 30}, true},
+		{"email:1", maskPolicy{}, false},
+		{"truncate", maskPolicy{}, false},
+		{"truncate:0", maskPolicy{}, false},
+		{"shift_date:x", maskPolicy{}, false},
+		{"hash", maskPolicy{}, false},
+	}
+
+	for _, tt := range tests {
+		p, err := parseMaskPolicy(tt.value)
+		if (err == nil) != tt.valid {
+			t.Errorf("%q: unexpected error %v", tt.value, err)
+			continue
+		}
+		if tt.valid && p != tt.expected {
+			t.Errorf("%q: got %+v, expected %+v", tt.value, p, tt.expected)
+		}
+	}
+}
+
+func newTestMasker(t *testing.T, rules map[string]string) *Masker {
+	m, err := NewMasker(&Config{MaskFields: rules, MaskKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func maskTestDoc(source map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"_index": "users", "_id": "1", "_source": source}
+}
+
+func TestMaskerApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    map[string]string
+		source   map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name:     "redact",
+			rules:    map[string]string{"ssn": "redact", "card": "redact", "age": "redact"},
+			source:   map[string]interface{}{"ssn": "123", "card": map[string]interface{}{"no": "4111"}, "age": json.Number("30"), "name": "bob"},
+			expected: map[string]interface{}{"ssn": redactedValue, "card": nil, "age": nil, "name": "bob"},
+		},
+		{
+			name:     "truncate nested and arrays",
+			rules:    map[string]string{"user.*": "truncate:2"},
+			source:   map[string]interface{}{"user": map[string]interface{}{"name": "alice", "tags": []interface{}{"abc", json.Number("12345")}}},
+			expected: map[string]interface{}{"user": map[string]interface{}{"name": "al", "tags": []interface{}{"ab", json.Number("12345")}}},
+		},
+		{
+			name:     "objects in arrays",
+			rules:    map[string]string{"contacts.email": "redact"},
+			source:   map[string]interface{}{"contacts": []interface{}{map[string]interface{}{"email": "a@b.com", "type": "work"}}},
+			expected: map[string]interface{}{"contacts": []interface{}{map[string]interface{}{"email": redactedValue, "type": "work"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		m := newTestMasker(t, tt.rules)
+		doc := maskTestDoc(tt.source)
+		m.Apply(doc)
+		if !reflect.DeepEqual(doc["_source"], tt.expected) {
+			t.Errorf("%s: got %v, expected %v", tt.name, doc["_source"], tt.expected)
+		}
+	}
+}
+
+func TestMaskerFormats(t *testing.T) {
+	m := newTestMasker(t, map[string]string{"id": "hmac", "n": "hmac", "email": "email", "phone": "phone", "mobile": "phone"})
+	source := map[string]interface{}{"id": "u-1", "n": json.Number("42"), "email": "john.doe@acme.com", "phone": "+1 (555) 010-9999", "mobile": json.Number("13800138000")}
+	m.Apply(maskTestDoc(source))
+
+	if !regexp.MustCompile(`^[0-9a-f]{64}$`).MatchString(source["id"].(string)) {
+		t.Errorf("hmac string = %v", source["id"])
+	}
+	if _, err := source["n"].(json.Number).Int64(); err != nil {
+		t.Errorf("hmac number = %v", source["n"])
+	}
+	if email := source["email"].(string); !regexp.MustCompile(`^[a-z]{4}\.[a-z]{3}@[a-z]{4}\.com$`).MatchString(email) || email == "john.doe@acme.com" {
+		t.Errorf("email = %v", email)
+	}
+	if !regexp.MustCompile(`^\+[1-9] \(\d{3}\) \d{3}-\d{4}$`).MatchString(source["phone"].(string)) {
+		t.Errorf("phone = %v", source["phone"])
+	}
+	if mobile := string(source["mobile"].(json.Number)); len(mobile) != 11 || mobile[0] == '0' {
+		t.Errorf("mobile = %v", mobile)
+	}
+
+	/*相同的密钥和值得到相同的结果*/
+	again := map[string]interface{}{"id": "u-1", "email": "john.doe@acme.com"}
+	newTestMasker(t, map[string]string{"id": "hmac", "email": "email"}).Apply(maskTestDoc(again))
+	if again["id"] != source["id"] || again["email"] != source["email"] {
+		t.Errorf("masked values differ: %v, %v", again, source)
+	}
+}
+
+func TestMaskerShiftDate(t *testing.T) {
+	m := newTestMasker(t, map[string]string{"created": "shift_date:10", "updated": "shift_date:10", "ts": "shift_date:10", "note": "shift_date:10"})
+	source := map[string]interface{}{"created": "2023-05-01", "updated": "2023-05-03T10:00:00Z", "ts": json.Number("1682899200000"), "note": "soon"}
+	m.Apply(maskTestDoc(source))
+
+	created, err := time.Parse("2006-01-02", source["created"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shift := created.Sub(time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC))
+	if shift == 0 || shift > 10*24*time.Hour || shift < -10*24*time.Hour {
+		t.Errorf("shift = %v", shift)
+	}
+
+	/*同一个文档中的日期移动相同的天数*/
+	updated, err := time.Parse(time.RFC3339, source["updated"].(string))
+	if err != nil || updated.Sub(created) != 58*time.Hour {
+		t.Errorf("updated = %v, %v", source["updated"], err)
+	}
+	if ms, _ := source["ts"].(json.Number).Int64(); ms != 1682899200000+int64(shift/time.Millisecond) {
+		t.Errorf("ts = %v", source["ts"])
+	}
+	if source["note"] != "soon" {
+		t.Errorf("note = %v", source["note"])
+	}
+}
+
+func TestMaskerHmacNumbers(t *testing.T) {
+	m := newTestMasker(t, map[string]string{"*": "hmac"})
+	tests := []struct {
+		name     string
+		value    json.Number
+		min, max int64
+	}{
+		{"byte", "100", 0, 127},
+		{"negative byte", "-100", -128, 0},
+		{"short", "30000", 0, 32767},
+		{"integer", "2000000000", 0, 1<<31 - 1},
+		{"long", "9000000000000000000", 0, 1 << 52},
+		{"zero", "0", 0, 0},
+		{"float", "3.5", 0, 3},
+	}
+
+	for _, tt := range tests {
+		for _, id := range []string{"1", "2", "3"} {
+			source := map[string]interface{}{"n": tt.value, "id": json.Number(id)}
+			m.Apply(maskTestDoc(source))
+			n, err := source["n"].(json.Number).Int64()
+			if err != nil || n < tt.min || n > tt.max {
+				t.Errorf("%s: %s masked to %v, expected between %d and %d", tt.name, tt.value, source["n"], tt.min, tt.max)
+			}
+		}
+	}
+
+	/*相同的值得到相同的结果*/
+	a := map[string]interface{}{"n": json.Number("12345")}
+	b := map[string]interface{}{"n": json.Number("12345")}
+	m.Apply(maskTestDoc(a))
+	m.Apply(maskTestDoc(b))
+	if a["n"] != b["n"] {
+		t.Errorf("masked values differ: %v, %v", a["n"], b["n"])
+	}
+}
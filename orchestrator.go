@@ -0,0 +1,380 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cheggaaa/pb"
+	log "github.com/cihub/seelog"
+)
+
+/*
+indexJob 表示 --per_index 模式下一个源索引的迁移任务。
+每个任务有自己的 scroll（包括 sliced scroll）、DocChan 和 bulk worker，任务之间互不影响；
+限速器、BulkController 等全局的资源仍然由所有任务共用。
+*/
+type indexJob struct {
+	index    string
+	target   string
+	priority int
+	stats    IndexStats
+
+	expected int
+	written  int
+	err      error
+	took     time.Duration
+	verified string
+}
+
+/*
+为每个源索引生成一个迁移任务，并按照 --index_order 排序：
+  - name：按索引名称排序；
+  - size：按主分片的存储大小从小到大排序，小索引先完成，尽早发现问题；
+  - priority：按 --index_priority 指定的优先级从高到低排序，优先级相同时按大小排序。
+*/
+func (c *Migrator) planIndexJobs() ([]*indexJob, error) {
+	indexNames, _, _, err := c.SourceESAPI.GetIndexMappings(c.Config.CopyAllIndexes, c.Config.SourceIndexNames)
+	if err != nil {
+		return nil, err
+	}
+
+	names := splitFieldList(indexNames)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("index not exists, %s", c.Config.SourceIndexNames)
+	}
+
+	stats, err := c.SourceESAPI.GetIndexStats(indexNames)
+	if err != nil {
+		log.Warn("failed to get index stats, index sizes are unknown: ", err)
+	}
+
+	var jobs []*indexJob
+	for _, name := range names {
+		job := &indexJob{
+			index:    name,
+			target:   c.targetIndexName(name),
+			priority: indexPriority(c.Config.IndexPriority, name),
+			stats:    stats[name],
+		}
+		jobs = append(jobs, job)
+	}
+
+	sort.SliceStable(jobs, func(i, j int) bool {
+		switch c.Config.IndexOrder {
+		case "size":
+			if jobs[i].stats.StoreSizeInBytes != jobs[j].stats.StoreSizeInBytes {
+				return jobs[i].stats.StoreSizeInBytes < jobs[j].stats.StoreSizeInBytes
+			}
+		case "priority":
+			if jobs[i].priority != jobs[j].priority {
+				return jobs[i].priority > jobs[j].priority
+			}
+			if jobs[i].stats.StoreSizeInBytes != jobs[j].stats.StoreSizeInBytes {
+				return jobs[i].stats.StoreSizeInBytes < jobs[j].stats.StoreSizeInBytes
+			}
+		}
+		return jobs[i].index < jobs[j].index
+	})
+	return jobs, nil
+}
+
+/*根据 --index_priority 得到索引的优先级，先精确匹配，再按最具体的通配符匹配，没有指定时为 0。*/
+func indexPriority(priorities map[string]string, name string) int {
+	var patterns []string
+	for pattern := range priorities {
+		patterns = append(patterns, pattern)
+	}
+	pattern, ok := matchIndexPattern(patterns, name)
+	if !ok {
+		return 0
+	}
+	value := priorities[pattern]
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		log.Warnf("invalid priority %s of index %s", value, name)
+		return 0
+	}
+	return priority
+}
+
+/*源索引对应的目标索引名称，和 NewBulkWorker 中的规则一致。*/
+func (c *Migrator) targetIndexName(index string) string {
+	if ic := c.Config.indexConfig(index); ic != nil && len(ic.DestIndex) > 0 {
+		return ic.DestIndex
+	}
+	if len(c.Config.TargetIndexName) > 0 {
+		return c.Config.TargetIndexName
+	}
+	return index
+}
+
+/*
+为单个任务创建独立的 Migrator，DocChan、SourceFilter 和统计都是任务自己的，
+ESAPI、限速器、BulkController、DocBuffer、采样和脱敏等由所有任务共用。
+*/
+func (c *Migrator) newJobMigrator(index string) *Migrator {
+	config := *c.Config
+	config.SourceIndexNames = index
+	return &Migrator{
+		DocChan:          make(chan map[string]interface{}, c.Config.BufferCount),
+		DocBuffer:        c.DocBuffer,
+		SourceESAPI:      c.SourceESAPI,
+		TargetESAPI:      c.TargetESAPI,
+		SourceAuth:       c.SourceAuth,
+		TargetAuth:       c.TargetAuth,
+		Config:           &config,
+		SourceFilter:     c.SourceFilter,
+		BulkDocsLimiter:  c.BulkDocsLimiter,
+		BulkBytesLimiter: c.BulkBytesLimiter,
+		ScrollLimiter:    c.ScrollLimiter,
+		BulkController:   c.BulkController,
+		BulkStats:        NewBulkStats(),
+		Join:             c.Join,
+		TargetTypeName:   c.TargetTypeName,
+		TypeSplitter:     c.TypeSplitter,
+		Sampler:          c.Sampler,
+		Masker:           c.Masker,
+		Bench:            c.Bench,
+	}
+}
+
+/*
+按照 --index_parallelism 并发执行所有的索引任务，一个任务失败只会记录下来，不会影响其他任务。
+全部完成之后输出每个索引的结果，返回失败的任务数量。
+*/
+func (c *Migrator) runIndexJobs(showBar bool) int {
+	jobs, err := c.planIndexJobs()
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	parallelism := c.Config.IndexParallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	/*目标索引被多个任务共用时（例如 -y 把多个索引合并成一个），无法按索引校验文档数量*/
+	targets := map[string]int{}
+	for _, job := range jobs {
+		targets[job.target]++
+	}
+
+	log.Infof("start %d index jobs, parallelism: %d, order: %s", len(jobs), parallelism, c.Config.IndexOrder)
+
+	var pool *pb.Pool
+	if showBar {
+		pool = pb.NewPool()
+		if err := pool.Start(); err != nil {
+			log.Error(err)
+			pool = nil
+		}
+	}
+
+	var settingsLock sync.Mutex
+	sem := make(chan struct{}, parallelism)
+	wg := sync.WaitGroup{}
+	for _, job := range jobs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(job *indexJob) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			start := time.Now()
+			c.runIndexJob(job, pool)
+			job.took = time.Since(start)
+
+			/*恢复这个目标索引的 refresh_interval，并从待恢复的列表中删除，避免程序退出时重复恢复*/
+			settingsLock.Lock()
+			if interval, ok := c.IndexRefreshSettings[job.target]; ok && targets[job.target] == 1 {
+				c.recoveryIndexSettings(map[string]interface{}{job.target: interval})
+				delete(c.IndexRefreshSettings, job.target)
+			}
+			settingsLock.Unlock()
+
+			if job.err == nil && targets[job.target] == 1 {
+				c.verifyIndexJob(job)
+			}
+
+			if job.err != nil {
+				log.Errorf("index %s failed after %v: %v", job.index, job.took, job.err)
+			} else {
+				log.Infof("index %s -> %s finished in %v, %d documents, %s", job.index, job.target, job.took, job.written, job.verified)
+			}
+		}(job)
+	}
+	wg.Wait()
+
+	if pool != nil {
+		pool.Stop()
+	}
+
+	failed := 0
+	log.Info("index jobs summary:")
+	for _, job := range jobs {
+		status := "ok"
+		if job.err != nil {
+			status = "failed: " + job.err.Error()
+			failed++
+		}
+		log.Infof("  %s -> %s, expected: %d, written: %d, took: %v, %s, %s", job.index, job.target, job.expected, job.written, job.took, job.verified, status)
+	}
+	if failed > 0 {
+		log.Errorf("%d of %d index jobs failed", failed, len(jobs))
+	}
+	return failed
+}
+
+/*执行单个索引任务：创建 scroll，启动 bulk worker，等待全部写入完成。*/
+func (c *Migrator) runIndexJob(job *indexJob, pool *pb.Pool) {
+	jm := c.newJobMigrator(job.index)
+	if err := jm.startSpill(); err != nil {
+		job.err = err
+		return
+	}
+	defer jm.Spill.Remove()
+
+	plans, err := jm.planScrolls()
+	if err != nil {
+		job.err = err
+		return
+	}
+
+	fetchBar := pb.New(1).Prefix(job.index + " Scroll")
+	outputBar := pb.New(1).Prefix(job.index + " Bulk")
+	if pool != nil {
+		pool.Add(fetchBar, outputBar)
+	}
+
+	jm.resolveSlices(plans)
+	total, err := jm.startScrolls(plans, fetchBar)
+	job.expected = total
+	if err != nil {
+		job.err = err
+	}
+	if total > 0 {
+		fetchBar.Total = int64(total)
+		outputBar.Total = int64(total)
+	}
+
+	var docCount int
+	wg := sync.WaitGroup{}
+	wg.Add(jm.Config.Workers)
+	for i := 0; i < jm.Config.Workers; i++ {
+		go jm.NewBulkWorker(&docCount, outputBar, &wg)
+	}
+	wg.Wait()
+
+	fetchBar.Finish()
+	outputBar.Finish()
+
+	job.written = docCount
+	c.BulkStats.Merge(jm.BulkStats)
+
+	/*采样或者限制了数量时，目标索引只应该包含被选中的文档*/
+	if jm.Sampler != nil {
+		job.expected = int(jm.Sampler.Accepted(job.index))
+	}
+
+	if job.err == nil {
+		if n := atomic.LoadInt32(&jm.ScrollErrors); n > 0 {
+			job.err = fmt.Errorf("%d errors while reading the source", n)
+		} else if failed := jm.BulkStats.Count("failed") + jm.BulkStats.Count("rejected"); failed > 0 {
+			job.err = fmt.Errorf("%d documents failed, bulk results: %s", failed, jm.BulkStats)
+		}
+	}
+}
+
+/*
+为每个 scroll 计划打开 plan.slices 个 scroll，并在后台读取全部结果写入 DocChan。
+返回所有 scroll 的命中总数；所有已经打开的 scroll 读取完成后关闭 DocChan，
+即使中途打开 scroll 失败，已经打开的 scroll 仍然会被读取完，DocChan 也一定会被关闭。
+*/
+func (c *Migrator) startScrolls(plans []scrollPlan, bar *pb.ProgressBar) (int, error) {
+	total := 0
+	var err error
+	wg := sync.WaitGroup{}
+
+OPEN:
+	for _, plan := range plans {
+		for slice := 0; slice < plan.slices; slice++ {
+			c.ScrollLimiter.Wait(1)
+			scroll, e := c.SourceESAPI.NewScroll(plan.indexNames, c.Config.ScrollTime, c.Config.DocBufferCount, plan.query, slice, plan.slices, plan.fields, plan.excludeFields, c.Config.PreserveVersion)
+			if e != nil {
+				err = e
+				break OPEN
+			}
+
+			/*命中总数为 0 的 scroll 也要读取第一页，关闭响应体*/
+			temp := scroll.(ScrollAPI)
+			total += temp.GetHitsTotal()
+
+			indexNames := plan.indexNames
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				temp.ProcessScrollResult(c, bar)
+				/*--max_docs 时所有索引都达到上限之后提前结束*/
+				for !c.Sampler.Full(indexNames) && temp.Next(c, bar) == false {
+				}
+			}()
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		log.Debug("closing doc chan of ", c.Config.SourceIndexNames)
+		c.closeDocChan()
+	}()
+
+	return total, err
+}
+
+/*
+刷新目标索引后，使用 _count 校验文档数量。
+op_type 为 create 时目标中可能已经有文档，拆分 type 时目标索引不止一个，所以只检查目标数量不少于期望数量。
+*/
+func (c *Migrator) verifyIndexJob(job *indexJob) {
+	if c.TypeSplitter != nil || (c.Config.OpType != "index" && c.Config.OpType != "create") {
+		job.verified = "verification skipped"
+		return
+	}
+
+	c.TargetESAPI.Refresh(job.target)
+	count, err := c.TargetESAPI.Count(job.target)
+	if err != nil {
+		job.verified = "verification failed"
+		job.err = fmt.Errorf("failed to count target index %s: %v", job.target, err)
+		return
+	}
+
+	if count < int64(job.expected) {
+		job.verified = fmt.Sprintf("verification failed, target count %d", count)
+		job.err = fmt.Errorf("expected %d documents in target index %s, found %d", job.expected, job.target, count)
+		return
+	}
+	job.verified = fmt.Sprintf("verified, target count %d", count)
+}
@@ -0,0 +1,587 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+/*README 兼容性表格中支持的主版本*/
+var supportedMajorVersions = []int{1, 2, 5, 6, 7}
+
+/*
+mapping 和 analysis 设置中引用的分词器、过滤器、字段类型，以及提供它们的插件。
+目标集群缺少这些插件时，创建索引或者写入文档会失败。
+*/
+var pluginReferences = map[string]string{
+	"ik_smart":                "analysis-ik",
+	"ik_max_word":             "analysis-ik",
+	"pinyin":                  "analysis-pinyin",
+	"smartcn":                 "analysis-smartcn",
+	"smartcn_tokenizer":       "analysis-smartcn",
+	"kuromoji":                "analysis-kuromoji",
+	"kuromoji_tokenizer":      "analysis-kuromoji",
+	"kuromoji_baseform":       "analysis-kuromoji",
+	"kuromoji_part_of_speech": "analysis-kuromoji",
+	"kuromoji_readingform":    "analysis-kuromoji",
+	"kuromoji_stemmer":        "analysis-kuromoji",
+	"icu_analyzer":            "analysis-icu",
+	"icu_tokenizer":           "analysis-icu",
+	"icu_normalizer":          "analysis-icu",
+	"icu_folding":             "analysis-icu",
+	"icu_collation":           "analysis-icu",
+	"icu_collation_keyword":   "analysis-icu",
+	"icu_transform":           "analysis-icu",
+	"phonetic":                "analysis-phonetic",
+	"polish":                  "analysis-stempel",
+	"polish_stem":             "analysis-stempel",
+	"nori":                    "analysis-nori",
+	"nori_tokenizer":          "analysis-nori",
+	"nori_part_of_speech":     "analysis-nori",
+	"nori_readingform":        "analysis-nori",
+	"ukrainian":               "analysis-ukrainian",
+	"murmur3":                 "mapper-murmur3",
+	"attachment":              "mapper-attachments",
+}
+
+/*mapping 和 analysis 设置中值为分词器、过滤器或者字段类型名称的 key*/
+var analysisReferenceKeys = map[string]bool{
+	"analyzer":              true,
+	"search_analyzer":       true,
+	"search_quote_analyzer": true,
+	"normalizer":            true,
+	"tokenizer":             true,
+	"filter":                true,
+	"char_filter":           true,
+	"type":                  true,
+}
+
+/*
+迁移开始之前的检查结果，每一项是通过、警告或者失败。
+有任何一项失败时迁移不会开始，--skip_preflight 可以跳过所有检查。
+*/
+type PreflightReport struct {
+	checks []preflightCheck
+}
+
+type preflightCheck struct {
+	level   string /*ok、warn、fail*/
+	name    string
+	message string
+}
+
+func (r *PreflightReport) add(level, name, format string, args ...interface{}) {
+	r.checks = append(r.checks, preflightCheck{level: level, name: name, message: fmt.Sprintf(format, args...)})
+}
+
+func (r *PreflightReport) Ok(name, format string, args ...interface{}) {
+	r.add("ok", name, format, args...)
+}
+
+func (r *PreflightReport) Warn(name, format string, args ...interface{}) {
+	r.add("warn", name, format, args...)
+}
+
+func (r *PreflightReport) Fail(name, format string, args ...interface{}) {
+	r.add("fail", name, format, args...)
+}
+
+/*在日志中输出每一项检查的结果*/
+func (r *PreflightReport) Log() {
+	for _, check := range r.checks {
+		switch check.level {
+		case "fail":
+			log.Errorf("preflight [%s] failed: %s", check.name, check.message)
+		case "warn":
+			log.Warnf("preflight [%s] warning: %s", check.name, check.message)
+		default:
+			log.Infof("preflight [%s] ok: %s", check.name, check.message)
+		}
+	}
+}
+
+/*所有失败项的原因，没有失败时返回 nil*/
+func (r *PreflightReport) Err() error {
+	var reasons []string
+	for _, check := range r.checks {
+		if check.level == "fail" {
+			reasons = append(reasons, fmt.Sprintf("[%s] %s", check.name, check.message))
+		}
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	return errors.New("preflight checks failed:\n  " + strings.Join(reasons, "\n  "))
+}
+
+/*
+迁移开始之前检查源集群和目标集群：版本兼容性、集群状态、目标集群的磁盘空间、字段数量限制、
+scroll 的 max_result_window 和 scroll context 限制，以及 mapping 中用到的插件。
+indexNames 是解析之后的源索引列表，mappings 是源索引的 mapping。
+*/
+func (c *Migrator) preflight(srcVersion, destVersion *ClusterVersion, indexNames string, mappings *Indexes) *PreflightReport {
+	report := &PreflightReport{}
+
+	srcMajor := majorVersion(srcVersion)
+	destMajor := majorVersion(destVersion)
+	c.checkVersions(report, srcVersion, destVersion)
+	c.checkHealth(report, "source health", c.SourceESAPI)
+	c.checkHealth(report, "target health", c.TargetESAPI)
+
+	sourceSettings, err := c.SourceESAPI.GetIndexSettings(indexNames)
+	if err != nil {
+		report.Warn("source settings", "failed to get settings of source indices, related checks are skipped: %v", err)
+		sourceSettings = &Indexes{}
+	}
+
+	c.checkScrollLimits(report, srcMajor, indexNames, sourceSettings)
+	c.checkDisk(report, indexNames)
+	c.checkFieldLimits(report, destMajor, indexNames, mappings, sourceSettings)
+	c.checkTypes(report, srcMajor, destMajor, mappings)
+	c.checkPlugins(report, destMajor, mappings, sourceSettings)
+
+	return report
+}
+
+/*从版本号中取出主版本，无法解析时返回 0*/
+func majorVersion(version *ClusterVersion) int {
+	if version == nil {
+		return 0
+	}
+	major, _ := strconv.Atoi(strings.SplitN(version.Version.Number, ".", 2)[0])
+	return major
+}
+
+/*
+目标集群默认的 type：7.x 和 6.2 及以上版本为 _doc，之前的版本不允许 type 以下划线开头，使用 doc。
+*/
+func defaultTypeName(version *ClusterVersion) string {
+	major := majorVersion(version)
+	if major >= 7 {
+		return "_doc"
+	}
+	if major == 6 {
+		parts := strings.SplitN(version.Version.Number, ".", 3)
+		if len(parts) > 1 {
+			if minor, _ := strconv.Atoi(parts[1]); minor >= 2 {
+				return "_doc"
+			}
+		}
+	}
+	return "doc"
+}
+
+/*
+按照 README 中的兼容性表格检查版本：两边都必须是支持的主版本；
+跨主版本时不能复制 mapping，复制 settings 时给出警告；目标集群的版本比源集群低时只能迁移数据。
+*/
+func (c *Migrator) checkVersions(report *PreflightReport, srcVersion, destVersion *ClusterVersion) {
+	srcMajor := majorVersion(srcVersion)
+	destMajor := majorVersion(destVersion)
+
+	supported := func(major int) bool {
+		for _, v := range supportedMajorVersions {
+			if v == major {
+				return true
+			}
+		}
+		return false
+	}
+
+	failed := false
+	if !supported(srcMajor) {
+		report.Fail("version", "source version %s is not supported", srcVersion.Version.Number)
+		failed = true
+	}
+	if !supported(destMajor) {
+		report.Fail("version", "target version %s is not supported", destVersion.Version.Number)
+		failed = true
+	}
+	if failed {
+		return
+	}
+
+	if srcMajor != destMajor && c.Config.CopyIndexMappings {
+		report.Fail("version", "%s => %s, mappings can't be copied across major versions, create the target mappings manually", srcVersion.Version.Number, destVersion.Version.Number)
+		return
+	}
+	if srcMajor != destMajor && c.Config.CopyIndexSettings {
+		report.Warn("version", "%s => %s, some index settings may not be accepted by the target version", srcVersion.Version.Number, destVersion.Version.Number)
+		return
+	}
+	if destMajor < srcMajor {
+		report.Warn("version", "%s => %s, target is older than source, only documents are migrated, newer mapping features may be rejected", srcVersion.Version.Number, destVersion.Version.Number)
+		return
+	}
+	report.Ok("version", "%s => %s", srcVersion.Version.Number, destVersion.Version.Number)
+}
+
+/*通过 ClusterReady 检查集群状态，red 状态的集群无法完成迁移*/
+func (c *Migrator) checkHealth(report *PreflightReport, name string, api ESAPI) {
+	health, ready := c.ClusterReady(api)
+	if health == nil {
+		report.Fail(name, "failed to get cluster health")
+		return
+	}
+	if health.Status == "red" {
+		report.Fail(name, "cluster %s is red", health.Name)
+		return
+	}
+	if !ready {
+		report.Warn(name, "cluster %s is %s", health.Name, health.Status)
+		return
+	}
+	report.Ok(name, "cluster %s is %s", health.Name, health.Status)
+}
+
+/*
+-c 是 scroll 请求的 size，不能超过源索引的 index.max_result_window，7.x 开始超过时 scroll 会直接报错；
+7.x 开始同时打开的 scroll 在单个节点上占用的 search context 不能超过 search.max_open_scroll_context。
+*/
+func (c *Migrator) checkScrollLimits(report *PreflightReport, srcMajor int, indexNames string, sourceSettings *Indexes) {
+	failed := false
+	for _, index := range splitFieldList(indexNames) {
+		window := 10000
+		if v, ok := indexSetting(sourceSettings, index, "max_result_window"); ok {
+			if n, err := strconv.Atoi(v); err == nil {
+				window = n
+			}
+		}
+		if c.Config.DocBufferCount <= window {
+			continue
+		}
+		failed = true
+		if srcMajor >= 7 {
+			report.Fail("max_result_window", "scroll size %d is larger than index.max_result_window %d of index %s, use a smaller -c", c.Config.DocBufferCount, window, index)
+		} else {
+			report.Warn("max_result_window", "scroll size %d is larger than index.max_result_window %d of index %s", c.Config.DocBufferCount, window, index)
+		}
+	}
+	if !failed {
+		report.Ok("max_result_window", "scroll size %d", c.Config.DocBufferCount)
+	}
+
+	if srcMajor < 7 {
+		return
+	}
+
+	/*
+		和 resolveSlices 使用相同的估算方法：每个 slice 在单个节点上打开 contextsPerSlice 个 search context。
+		auto 时 resolveSlices 会在上限之内选择 slice 数量，这里按每个 scroll 至少 1 个 slice 检查；
+		--per_index 模式下每个索引单独 scroll，按最大的索引和 --index_parallelism 计算。
+	*/
+	slices := int(c.Config.ScrollSliceSize)
+	if c.Config.ScrollSliceSize.IsAuto() || slices < 1 {
+		slices = 1
+	}
+	scrolls := []string{indexNames}
+	if c.Config.PerIndex {
+		scrolls = splitFieldList(indexNames)
+	}
+	shards := primaryShards(sourceSettings)
+	nodes := c.sourceDataNodes()
+	contexts := 0
+	for _, scroll := range scrolls {
+		n := 0
+		for _, index := range splitFieldList(scroll) {
+			n += shards[index]
+		}
+		if perScroll := slices * c.contextsPerSlice(n, nodes); perScroll > contexts {
+			contexts = perScroll
+		}
+	}
+	contexts *= c.concurrentJobs(1)
+
+	limit := c.maxOpenScrollContext()
+	if contexts > limit {
+		report.Fail("scroll context", "%d scroll contexts per node (%d slices, %d data nodes) exceed search.max_open_scroll_context %d of source cluster, use smaller --sliced_scroll_size or --index_parallelism",
+			contexts, slices, nodes, limit)
+		return
+	}
+	report.Ok("scroll context", "%d scroll contexts per node, limit %d", contexts, limit)
+}
+
+/*目标集群数据节点的可用磁盘空间需要大于源索引主分片的大小，迁移期间目标索引没有副本*/
+func (c *Migrator) checkDisk(report *PreflightReport, indexNames string) {
+	stats, err := c.SourceESAPI.GetIndexStats(indexNames)
+	if err != nil {
+		report.Warn("disk", "failed to get source index stats: %v", err)
+		return
+	}
+	var size int64
+	for _, s := range stats {
+		size += s.StoreSizeInBytes
+	}
+	if c.Config.RepeatOutputTimes > 1 {
+		size *= int64(c.Config.RepeatOutputTimes)
+	}
+
+	available, err := c.TargetESAPI.GetDiskAvailable()
+	if err != nil {
+		report.Warn("disk", "failed to get disk usage of target cluster: %v", err)
+		return
+	}
+	if available < size {
+		report.Fail("disk", "target cluster has %s disk available, source indices need %s", formatBytes(int(available)), formatBytes(int(size)))
+		return
+	}
+	report.Ok("disk", "%s needed, %s available on target", formatBytes(int(size)), formatBytes(int(available)))
+}
+
+/*
+源索引 mapping 中的字段数量不能超过目标索引的 index.mapping.total_fields.limit（5.x 开始），默认 1000。
+目标索引已经存在时使用它自己的设置，复制 settings 时使用源索引的设置。
+*/
+func (c *Migrator) checkFieldLimits(report *PreflightReport, destMajor int, indexNames string, mappings *Indexes, sourceSettings *Indexes) {
+	if destMajor < 5 || mappings == nil {
+		return
+	}
+
+	failed := false
+	for _, index := range splitFieldList(indexNames) {
+		mapping, ok := (*mappings)[index].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fields := len(mappingFieldPaths(mapping["mappings"]))
+
+		target := c.targetIndexName(index)
+		limit := 1000
+		if v, ok := c.targetIndexSetting(target, "mapping", "total_fields", "limit"); ok {
+			limit, _ = strconv.Atoi(v)
+		} else if v, ok := indexSetting(sourceSettings, index, "mapping", "total_fields", "limit"); ok && c.Config.CopyIndexSettings {
+			limit, _ = strconv.Atoi(v)
+		}
+
+		if limit > 0 && fields > limit {
+			report.Fail("total_fields", "index %s has %d fields, more than index.mapping.total_fields.limit %d of target index %s", index, fields, limit, target)
+			failed = true
+		}
+	}
+	if !failed {
+		report.Ok("total_fields", "field counts are within the limits")
+	}
+}
+
+/*读取目标索引的设置，索引不存在时返回 false*/
+func (c *Migrator) targetIndexSetting(index string, path ...string) (string, bool) {
+	settings, err := c.TargetESAPI.GetIndexSettings(index)
+	if err != nil {
+		return "", false
+	}
+	return indexSetting(settings, index, path...)
+}
+
+/*6.x 开始每个索引只能有一个 type，多 type 的源索引需要 --split_types 或者 -u 统一 type 名称*/
+func (c *Migrator) checkTypes(report *PreflightReport, srcMajor, destMajor int, mappings *Indexes) {
+	if srcMajor >= 6 || destMajor < 6 || mappings == nil || c.TypeSplitter != nil || len(c.Config.OverrideTypeName) > 0 {
+		return
+	}
+	var multiType []string
+	for index, v := range *mappings {
+		m, _ := v.(map[string]interface{})
+		types, _ := m["mappings"].(map[string]interface{})
+		count := 0
+		for name := range types {
+			if name != "_default_" {
+				count++
+			}
+		}
+		if count > 1 {
+			multiType = append(multiType, index)
+		}
+	}
+	if len(multiType) > 0 {
+		sort.Strings(multiType)
+		report.Fail("types", "indices %s have multiple types, which target %d.x doesn't support, use --split_types or -u", strings.Join(multiType, ","), destMajor)
+		return
+	}
+	report.Ok("types", "no multi-type indices")
+}
+
+/*mapping 和 analysis 设置中用到的插件必须安装在目标集群的每个节点上*/
+func (c *Migrator) checkPlugins(report *PreflightReport, destMajor int, mappings *Indexes, sourceSettings *Indexes) {
+	refs := map[string]bool{}
+	if mappings != nil {
+		collectAnalysisReferences(map[string]interface{}(*mappings), refs)
+	}
+	for _, v := range *sourceSettings {
+		if m, ok := v.(map[string]interface{}); ok {
+			if s, ok := m["settings"].(map[string]interface{}); ok {
+				if index, ok := s["index"].(map[string]interface{}); ok {
+					collectAnalysisReferences(index["analysis"], refs)
+				}
+			}
+		}
+	}
+
+	required := map[string][]string{}
+	for ref := range refs {
+		plugin, ok := pluginReferences[ref]
+		if !ok {
+			continue
+		}
+		/*6.x 开始 attachment 字段类型被移除，需要改成通过 ingest-attachment 的 pipeline 写入*/
+		if ref == "attachment" && destMajor >= 6 {
+			report.Fail("plugins", "attachment field type was removed in 6.0, map the field as an object and index it through an ingest-attachment pipeline")
+			plugin = "ingest-attachment"
+		}
+		required[plugin] = append(required[plugin], ref)
+	}
+	if len(required) == 0 {
+		return
+	}
+
+	installed, err := c.TargetESAPI.GetPlugins()
+	if err != nil {
+		report.Warn("plugins", "failed to get plugins of target cluster: %v", err)
+		return
+	}
+
+	var missing []string
+	for plugin, used := range required {
+		if !hasPlugin(installed, plugin) {
+			sort.Strings(used)
+			missing = append(missing, fmt.Sprintf("%s (used by %s)", plugin, strings.Join(used, ",")))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		report.Fail("plugins", "plugins missing on target: %s", strings.Join(missing, ", "))
+		return
+	}
+	report.Ok("plugins", "required plugins are installed")
+}
+
+/*1.x/2.x 的插件名称可能没有 analysis- 之类的前缀，比较时去掉前缀*/
+func hasPlugin(installed []string, plugin string) bool {
+	trim := func(name string) string {
+		for _, prefix := range []string{"analysis-", "mapper-", "ingest-"} {
+			name = strings.TrimPrefix(name, prefix)
+		}
+		return name
+	}
+	for _, name := range installed {
+		if name == plugin || trim(name) == trim(plugin) {
+			return true
+		}
+	}
+	return false
+}
+
+/*递归收集 mapping 和 analysis 设置中引用的分词器、过滤器和字段类型名称*/
+func collectAnalysisReferences(v interface{}, refs map[string]bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for key, value := range t {
+			if analysisReferenceKeys[key] {
+				switch ref := value.(type) {
+				case string:
+					refs[ref] = true
+				case []interface{}:
+					for _, item := range ref {
+						if s, ok := item.(string); ok {
+							refs[s] = true
+						}
+					}
+				}
+			}
+			collectAnalysisReferences(value, refs)
+		}
+	case []interface{}:
+		for _, item := range t {
+			collectAnalysisReferences(item, refs)
+		}
+	}
+}
+
+/*
+mapping 中所有字段的路径，包括 object 字段和 multi-fields，和 Elasticsearch 计算 total_fields 的方式一致。
+7.x 的 mapping 直接包含 properties，更早的版本外面还有一层 type，多个 type 的字段合并计算。
+*/
+func mappingFieldPaths(mappings interface{}) map[string]bool {
+	paths := map[string]bool{}
+	m, ok := mappings.(map[string]interface{})
+	if !ok {
+		return paths
+	}
+	if props, ok := m["properties"].(map[string]interface{}); ok {
+		collectFieldPaths(props, "", paths)
+		return paths
+	}
+	for _, t := range m {
+		if typeMapping, ok := t.(map[string]interface{}); ok {
+			if props, ok := typeMapping["properties"].(map[string]interface{}); ok {
+				collectFieldPaths(props, "", paths)
+			}
+		}
+	}
+	return paths
+}
+
+func collectFieldPaths(props map[string]interface{}, prefix string, paths map[string]bool) {
+	for name, v := range props {
+		path := prefix + name
+		paths[path] = true
+		field, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if sub, ok := field["properties"].(map[string]interface{}); ok {
+			collectFieldPaths(sub, path+".", paths)
+		}
+		if fields, ok := field["fields"].(map[string]interface{}); ok {
+			for multi := range fields {
+				paths[path+"."+multi] = true
+			}
+		}
+	}
+}
+
+/*按照路径读取 GetIndexSettings 返回的嵌套设置中 settings.index 下的值*/
+func indexSetting(settings *Indexes, index string, path ...string) (string, bool) {
+	if settings == nil {
+		return "", false
+	}
+	m, ok := (*settings)[index].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	if m, ok = m["settings"].(map[string]interface{}); !ok {
+		return "", false
+	}
+	var v interface{} = m["index"]
+	for _, key := range path {
+		node, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = node[key]; !ok {
+			return "", false
+		}
+	}
+	if v == nil {
+		return "", false
+	}
+	return fmt.Sprint(v), true
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func testClusterVersion(number string) *ClusterVersion {
+	v := &ClusterVersion{}
+	v.Version.Number = number
+	return v
+}
+
+/*每一项检查的级别，按名称排列*/
+func preflightLevels(r *PreflightReport) []string {
+	var levels []string
+	for _, check := range r.checks {
+		levels = append(levels, check.name+":"+check.level)
+	}
+	sort.Strings(levels)
+	return levels
+}
+
+func TestCheckVersions(t *testing.T) {
+	tests := []struct {
+		src, dest string
+		mappings  bool
+		settings  bool
+		level     string
+	}{
+		{"6.8.0", "6.5.0", true, true, "ok"},
+		{"5.6.0", "7.10.0", false, false, "ok"},
+		{"5.6.0", "7.10.0", true, false, "fail"},
+		{"5.6.0", "7.10.0", false, true, "warn"},
+		{"7.10.0", "6.8.0", false, false, "warn"},
+		{"8.1.0", "7.10.0", false, false, "fail"},
+		{"0.90.0", "7.10.0", false, false, "fail"},
+	}
+
+	for _, tt := range tests {
+		c := &Migrator{Config: &Config{CopyIndexMappings: tt.mappings, CopyIndexSettings: tt.settings}}
+		report := &PreflightReport{}
+		c.checkVersions(report, testClusterVersion(tt.src), testClusterVersion(tt.dest))
+		if got := preflightLevels(report); !reflect.DeepEqual(got, []string{"version:" + tt.level}) {
+			t.Errorf("%s => %s: got %v, expected %s", tt.src, tt.dest, got, tt.level)
+		}
+		if (report.Err() != nil) != (tt.level == "fail") {
+			t.Errorf("%s => %s: unexpected error %v", tt.src, tt.dest, report.Err())
+		}
+	}
+}
+
+func TestCheckScrollWindow(t *testing.T) {
+	settings := Indexes{
+		"small": map[string]interface{}{"settings": map[string]interface{}{"index": map[string]interface{}{"max_result_window": "500"}}},
+		"large": map[string]interface{}{"settings": map[string]interface{}{"index": map[string]interface{}{}}},
+	}
+
+	tests := []struct {
+		name    string
+		size    int
+		major   int
+		indices string
+		level   string
+	}{
+		{"within default", 5000, 6, "large", "ok"},
+		{"above index setting on 6.x", 1000, 6, "small,large", "warn"},
+		{"above default on 6.x", 20000, 6, "large", "warn"},
+		{"within index setting", 500, 6, "small", "ok"},
+	}
+
+	for _, tt := range tests {
+		c := &Migrator{Config: &Config{DocBufferCount: tt.size}}
+		report := &PreflightReport{}
+		c.checkScrollLimits(report, tt.major, tt.indices, &settings)
+		if got := preflightLevels(report); !reflect.DeepEqual(got, []string{"max_result_window:" + tt.level}) {
+			t.Errorf("%s: got %v, expected %s", tt.name, got, tt.level)
+		}
+	}
+}
+
+func TestCheckScrollContexts(t *testing.T) {
+	api := &testLayoutAPI{shards: map[string]int{"big": 6, "small": 5}}
+	settings, _ := api.GetIndexSettings("big,small")
+
+	tests := []struct {
+		name        string
+		size        SliceSize
+		perIndex    bool
+		parallelism int
+		nodes       int
+		limit       string
+		level       string
+	}{
+		{"fixed within default", 20, false, 0, 3, "", "ok"},
+		{"fixed above limit", 20, false, 0, 3, "50", "fail"},
+		{"auto on one node", autoSliceSize, false, 0, 1, "10", "fail"},
+		{"auto spread over nodes", autoSliceSize, false, 0, 4, "10", "ok"},
+		{"per index with parallelism", 4, true, 3, 2, "30", "fail"},
+		{"per index within limit", 4, true, 2, 2, "30", "ok"},
+	}
+
+	for _, tt := range tests {
+		api.nodes = tt.nodes
+		api.settings = map[string]interface{}{}
+		if tt.limit != "" {
+			api.settings["search.max_open_scroll_context"] = tt.limit
+		}
+		c := &Migrator{SourceESAPI: api, Config: &Config{DocBufferCount: 1000, ScrollSliceSize: tt.size, PerIndex: tt.perIndex, IndexParallelism: tt.parallelism}}
+		report := &PreflightReport{}
+		c.checkScrollLimits(report, 7, "big,small", settings)
+		if got := preflightLevels(report); !reflect.DeepEqual(got, []string{"max_result_window:ok", "scroll context:" + tt.level}) {
+			t.Errorf("%s: got %v, expected %s", tt.name, got, tt.level)
+		}
+	}
+}
+
+func TestHasPlugin(t *testing.T) {
+	installed := []string{"analysis-ik", "mapper-murmur3", "icu"}
+	tests := map[string]bool{
+		"analysis-ik":       true,
+		"ik":                true,
+		"murmur3":           true,
+		"analysis-icu":      true,
+		"analysis-pinyin":   false,
+		"mapper-attachment": false,
+	}
+	for plugin, expected := range tests {
+		if got := hasPlugin(installed, plugin); got != expected {
+			t.Errorf("hasPlugin(%q) = %v, expected %v", plugin, got, expected)
+		}
+	}
+}
+
+func TestMappingFieldPaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		mappings interface{}
+		expected []string
+	}{
+		{
+			name: "7.x",
+			mappings: map[string]interface{}{"properties": map[string]interface{}{
+				"title": map[string]interface{}{"type": "text", "fields": map[string]interface{}{"raw": map[string]interface{}{"type": "keyword"}}},
+				"user":  map[string]interface{}{"properties": map[string]interface{}{"name": map[string]interface{}{"type": "keyword"}}},
+			}},
+			expected: []string{"title", "title.raw", "user", "user.name"},
+		},
+		{
+			name: "types",
+			mappings: map[string]interface{}{
+				"a": map[string]interface{}{"properties": map[string]interface{}{"x": map[string]interface{}{"type": "long"}}},
+				"b": map[string]interface{}{"properties": map[string]interface{}{"x": map[string]interface{}{"type": "long"}, "y": map[string]interface{}{"type": "long"}}},
+			},
+			expected: []string{"x", "y"},
+		},
+		{name: "invalid", mappings: "x", expected: nil},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for path := range mappingFieldPaths(tt.mappings) {
+			got = append(got, path)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: got %v, expected %v", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestDefaultTypeName(t *testing.T) {
+	tests := map[string]string{
+		"5.6.16": "doc",
+		"6.0.1":  "doc",
+		"6.1.4":  "doc",
+		"6.2.0":  "_doc",
+		"6.8.23": "_doc",
+		"7.10.2": "_doc",
+		"8.1.0":  "_doc",
+		"2.4.6":  "doc",
+	}
+	for number, expected := range tests {
+		if got := defaultTypeName(testClusterVersion(number)); got != expected {
+			t.Errorf("defaultTypeName(%s) = %q, expected %q", number, got, expected)
+		}
+	}
+}
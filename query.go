@@ -0,0 +1,237 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+/*
+scrollPlan 表示一次 scroll 需要读取的索引、使用的查询条件、需要返回的字段以及 sliced scroll 的数量。
+没有为单独的索引指定查询文件或者配置时，只有一个 scrollPlan，覆盖所有的源索引。
+*/
+type scrollPlan struct {
+	indexNames    string
+	query         map[string]interface{}
+	fields        string
+	excludeFields string
+	slices        int
+}
+
+/*
+读取 --query_file 指定的 Query DSL 文件。
+文件内容可以是 Query DSL 本身，例如 {"bool": {...}}，也可以是从 Kibana 里直接复制出来的 {"query": {...}}。
+*/
+func loadQueryFile(file string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	query := map[string]interface{}{}
+	if err := DecodeJsonBytes(data, &query); err != nil {
+		return nil, fmt.Errorf("invalid query dsl in file %s: %v", file, err)
+	}
+
+	if len(query) == 0 {
+		return nil, fmt.Errorf("empty query dsl in file %s", file)
+	}
+
+	/*去掉外层的 query，只保留 Query DSL 本身*/
+	if inner, ok := query["query"].(map[string]interface{}); ok && len(query) == 1 {
+		query = inner
+	}
+	return query, nil
+}
+
+/*
+把 --query 的 query_string 和 --query_file 的 Query DSL 合并成 scroll 请求体中的 query。
+两个都没有时返回 nil；两个都有时使用 bool must 把它们组合在一起，1.x 到 7.x 都支持这种写法。
+*/
+func buildScrollQuery(queryString string, queryDSL map[string]interface{}) map[string]interface{} {
+	var queryStringQuery map[string]interface{}
+	if len(queryString) > 0 {
+		queryStringQuery = map[string]interface{}{
+			"query_string": map[string]interface{}{
+				"query": queryString,
+			},
+		}
+	}
+
+	if queryDSL == nil {
+		return queryStringQuery
+	}
+	if queryStringQuery == nil {
+		return queryDSL
+	}
+
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must": []interface{}{queryDSL, queryStringQuery},
+		},
+	}
+}
+
+/*
+根据 --index_query_file 找到某个索引对应的查询文件，先精确匹配索引名称，再按最具体的通配符匹配。
+*/
+func findIndexQueryFile(indexQueryFiles map[string]string, indexName string) (string, bool) {
+	var patterns []string
+	for pattern := range indexQueryFiles {
+		patterns = append(patterns, pattern)
+	}
+	if pattern, ok := matchIndexPattern(patterns, indexName); ok {
+		return indexQueryFiles[pattern], true
+	}
+	return "", false
+}
+
+/*
+在多个索引名称或通配符中选择和 indexName 匹配的一个：精确匹配优先，其次是最具体的通配符，
+即去掉 * 和 ? 之后剩余字符最多的，一样时按字典序取第一个，保证每次运行的结果都相同。
+*/
+func matchIndexPattern(patterns []string, indexName string) (string, bool) {
+	best, found := "", false
+	for _, pattern := range patterns {
+		if pattern == indexName {
+			return pattern, true
+		}
+		if matched, _ := path.Match(pattern, indexName); !matched {
+			continue
+		}
+		if !found || patternSpecificity(pattern) > patternSpecificity(best) ||
+			patternSpecificity(pattern) == patternSpecificity(best) && pattern < best {
+			best, found = pattern, true
+		}
+	}
+	return best, found
+}
+
+func patternSpecificity(pattern string) int {
+	return len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+}
+
+/*
+生成 scroll 计划。
+没有 --index_query_file 和配置文件中的 indices 时，所有源索引使用同一个 scroll；
+否则先通过 GetIndexMappings 解析出具体的索引列表，为指定了查询文件或者查询、字段配置的索引单独生成 scroll，其余索引共用默认查询。
+*/
+func (c *Migrator) planScrolls() ([]scrollPlan, error) {
+	var defaultDSL map[string]interface{}
+	if len(c.Config.QueryFile) > 0 {
+		dsl, err := loadQueryFile(c.Config.QueryFile)
+		if err != nil {
+			return nil, err
+		}
+		defaultDSL = dsl
+	}
+	defaultPlan := scrollPlan{
+		indexNames:    c.Config.SourceIndexNames,
+		query:         buildScrollQuery(c.Config.Query, defaultDSL),
+		fields:        c.Config.Fields,
+		excludeFields: c.Config.ExcludeFields,
+	}
+
+	if len(c.Config.IndexQueryFiles) == 0 && len(c.Config.Indices) == 0 {
+		return []scrollPlan{defaultPlan}, nil
+	}
+
+	indexNames, _, _, err := c.SourceESAPI.GetIndexMappings(c.Config.CopyAllIndexes, c.Config.SourceIndexNames)
+	if err != nil {
+		return nil, err
+	}
+
+	var plans []scrollPlan
+	var defaultIndexes []string
+	loaded := map[string]map[string]interface{}{}
+	for _, name := range splitFieldList(indexNames) {
+		ic := c.Config.indexConfig(name)
+		file, hasFile := findIndexQueryFile(c.Config.IndexQueryFiles, name)
+		if ic != nil && len(ic.QueryFile) > 0 {
+			file, hasFile = ic.QueryFile, true
+		}
+		if !hasFile && !ic.hasScrollOverride() {
+			defaultIndexes = append(defaultIndexes, name)
+			continue
+		}
+
+		plan := defaultPlan
+		plan.indexNames = name
+		queryString := c.Config.Query
+		dsl := defaultDSL
+		if ic != nil {
+			if len(ic.Query) > 0 {
+				queryString = ic.Query
+			}
+			if len(ic.Fields) > 0 {
+				plan.fields = ic.Fields
+			}
+			if len(ic.ExcludeFields) > 0 {
+				plan.excludeFields = ic.ExcludeFields
+			}
+		}
+		if hasFile {
+			var ok bool
+			dsl, ok = loaded[file]
+			if !ok {
+				dsl, err = loadQueryFile(file)
+				if err != nil {
+					return nil, err
+				}
+				loaded[file] = dsl
+			}
+			log.Debugf("index %s use query file %s", name, file)
+		}
+		plan.query = buildScrollQuery(queryString, dsl)
+		c.setIndexSourceFilter(name, plan.fields, plan.excludeFields)
+		plans = append(plans, plan)
+	}
+
+	if len(defaultIndexes) > 0 {
+		defaultPlan.indexNames = strings.Join(defaultIndexes, ",")
+		plans = append(plans, defaultPlan)
+	}
+
+	if len(plans) == 0 {
+		return nil, errors.New("index not exists, " + c.Config.SourceIndexNames)
+	}
+	return plans, nil
+}
+
+/*
+1.x/2.x 的源集群需要在客户端过滤 _source，单独配置了字段的索引使用自己的过滤器，
+即使不需要过滤也要记录下来，避免使用全局的过滤器。
+*/
+func (c *Migrator) setIndexSourceFilter(index, fields, excludeFields string) {
+	if _, ok := c.SourceESAPI.(*ESAPIV0); !ok {
+		return
+	}
+	if c.IndexSourceFilters == nil {
+		c.IndexSourceFilters = map[string]*SourceFilter{}
+	}
+	if needClientSourceFilter(fields, excludeFields) {
+		c.IndexSourceFilters[index] = NewSourceFilter(fields, excludeFields)
+	} else {
+		c.IndexSourceFilters[index] = nil
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMatchIndexPattern(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		index    string
+		expected string
+		found    bool
+	}{
+		{"exact wins over wildcard", []string{"logs-*", "logs-2020", "*"}, "logs-2020", "logs-2020", true},
+		{"most specific wildcard", []string{"*", "logs-*", "logs-2020-*"}, "logs-2020-01", "logs-2020-*", true},
+		{"same specificity in name order", []string{"logs-?1", "logs-0?"}, "logs-01", "logs-0?", true},
+		{"question mark is less specific", []string{"log?-01", "logs-*"}, "logs-01", "log?-01", true},
+		{"no match", []string{"orders", "users-*"}, "logs", "", false},
+		{"no patterns", nil, "logs", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			/*结果不能依赖顺序*/
+			for i := 0; i < len(tt.patterns); i++ {
+				patterns := append(append([]string(nil), tt.patterns[i:]...), tt.patterns[:i]...)
+				got, found := matchIndexPattern(patterns, tt.index)
+				if got != tt.expected || found != tt.found {
+					t.Errorf("matchIndexPattern(%v, %q) = %q, %v, expected %q, %v", patterns, tt.index, got, found, tt.expected, tt.found)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexPatternLookups(t *testing.T) {
+	files := map[string]string{"logs-*": "all.json", "logs-2020-*": "2020.json"}
+	if file, _ := findIndexQueryFile(files, "logs-2020-01"); file != "2020.json" {
+		t.Errorf("findIndexQueryFile = %q", file)
+	}
+
+	priorities := map[string]string{"*": "1", "orders*": "5", "orders-archive": "-1"}
+	for index, expected := range map[string]int{"orders-1": 5, "orders-archive": -1, "users": 1} {
+		if got := indexPriority(priorities, index); got != expected {
+			t.Errorf("indexPriority(%q) = %d, expected %d", index, got, expected)
+		}
+	}
+
+	config := &Config{Indices: map[string]*IndexConfig{"*": {DestIndex: "all"}, "logs-*": {DestIndex: "logs"}}}
+	if ic := config.indexConfig("logs-1"); ic == nil || ic.DestIndex != "logs" {
+		t.Errorf("indexConfig = %v", ic)
+	}
+}
+
+func TestBuildScrollQuery(t *testing.T) {
+	dsl := map[string]interface{}{"term": map[string]interface{}{"status": "ok"}}
+	queryString := map[string]interface{}{"query_string": map[string]interface{}{"query": "a:b"}}
+
+	tests := []struct {
+		name        string
+		queryString string
+		dsl         map[string]interface{}
+		expected    map[string]interface{}
+	}{
+		{"none", "", nil, nil},
+		{"query string", "a:b", nil, queryString},
+		{"dsl", "", dsl, dsl},
+		{"both", "a:b", dsl, map[string]interface{}{"bool": map[string]interface{}{"must": []interface{}{dsl, queryString}}}},
+	}
+
+	for _, tt := range tests {
+		if got := buildScrollQuery(tt.queryString, tt.dsl); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: got %v, expected %v", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestLoadQueryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esm-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		content string
+		valid   bool
+		key     string
+	}{
+		{`{"query":{"match_all":{}}}`, true, "match_all"},
+		{`{"bool":{"must":[]}}`, true, "bool"},
+		{`{}`, false, ""},
+		{`not json`, false, ""},
+	}
+
+	for i, tt := range tests {
+		file := filepath.Join(dir, "query.json")
+		if err := ioutil.WriteFile(file, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		query, err := loadQueryFile(file)
+		if (err == nil) != tt.valid {
+			t.Errorf("%d: unexpected error %v", i, err)
+			continue
+		}
+		if _, ok := query[tt.key]; tt.valid && !ok {
+			t.Errorf("%d: got %v, expected key %s", i, query, tt.key)
+		}
+	}
+}
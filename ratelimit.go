@@ -0,0 +1,75 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+RateLimiter 是一个令牌桶限速器，所有的 bulk worker（或者 scroll 协程）共用同一个实例，从而实现全局的限速。
+令牌按照 rate 每秒的速度补充，桶的容量为 burst。
+Wait(n) 一次取走 n 个令牌，令牌不够时允许“透支”，调用方按照透支的数量睡眠，
+这样即使一次 bulk 的大小超过了桶的容量，整体的吞吐依然能稳定在 rate 附近。
+*/
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+/*创建一个限速器，rate 小于等于 0 表示不限速，返回 nil；nil 的限速器调用 Wait 会直接返回。*/
+func NewRateLimiter(rate float64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:   rate,
+		burst:  rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+/*取走 n 个令牌，令牌不够时阻塞，直到补充的令牌足够偿还透支的部分。*/
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWait(t *testing.T) {
+	if l := NewRateLimiter(0); l != nil {
+		t.Fatalf("expected nil limiter without a rate")
+	}
+	var unlimited *RateLimiter
+	unlimited.Wait(1000000)
+
+	tests := []struct {
+		name     string
+		waits    []int
+		min, max time.Duration
+	}{
+		{"within burst", []int{500, 500}, 0, 50 * time.Millisecond},
+		{"overdraft", []int{1000, 100}, 80 * time.Millisecond, 300 * time.Millisecond},
+		{"single request above burst", []int{1200}, 150 * time.Millisecond, 400 * time.Millisecond},
+		{"nothing to take", []int{1000, 0, -1}, 0, 50 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		l := NewRateLimiter(1000)
+		start := time.Now()
+		for _, n := range tt.waits {
+			l.Wait(n)
+		}
+		if took := time.Since(start); took < tt.min || took > tt.max {
+			t.Errorf("%s: took %v, expected between %v and %v", tt.name, took, tt.min, tt.max)
+		}
+	}
+}
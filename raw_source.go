@@ -0,0 +1,112 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/*
+是否可以把这个索引的 _source 作为原始的 JSON 字节直接写入 bulk 请求，不解码成 map，也不重新编码。
+只要有任何需要修改 _source 的配置（字段重命名、客户端字段过滤、join 字段、--type_field、--mask）或者输出 CSV，就必须完整解码。
+Join 和 TypeSplitter 在目标集群准备阶段创建，所以 scroll 必须在这之后才打开，见 main 中的 startScrolls。
+*/
+func (c *Migrator) rawSourceAllowed(index string) bool {
+	if len(c.Config.RenameFields) > 0 {
+		return false
+	}
+	if c.Masker != nil {
+		return false
+	}
+	if c.Config.OutputFileType == "csv" {
+		return false
+	}
+	if ic := c.Config.indexConfig(index); ic != nil && len(ic.Rename) > 0 {
+		return false
+	}
+
+	filter := c.SourceFilter
+	if f, ok := c.IndexSourceFilters[index]; ok {
+		filter = f
+	}
+	if filter != nil {
+		return false
+	}
+
+	if c.Join.Enabled() {
+		return false
+	}
+	if c.TypeSplitter != nil && len(c.TypeSplitter.typeField) > 0 {
+		return false
+	}
+	return true
+}
+
+/*
+把流式解码得到的一个 hit 转换成写入 DocChan 的文档。
+元数据字段（_index、_id、_version 等）正常解码；_source 在允许的情况下保持为 json.RawMessage，否则解码成 map。
+*/
+func (c *Migrator) decodeHit(hit map[string]json.RawMessage) (map[string]interface{}, error) {
+	doc := make(map[string]interface{}, len(hit))
+	for key, value := range hit {
+		if key == "_source" {
+			continue
+		}
+		var v interface{}
+		if err := DecodeJsonBytes(value, &v); err != nil {
+			return nil, err
+		}
+		doc[key] = v
+	}
+
+	source, ok := hit["_source"]
+	if !ok {
+		return doc, nil
+	}
+
+	index, _ := doc["_index"].(string)
+	if c.rawSourceAllowed(index) {
+		doc["_source"] = source
+		return doc, nil
+	}
+
+	m := map[string]interface{}{}
+	if err := DecodeJsonBytes(source, &m); err != nil {
+		return nil, fmt.Errorf("invalid _source of document %v: %v", doc["_id"], err)
+	}
+	doc["_source"] = m
+	return doc, nil
+}
+
+/*
+返回可以修改的 _source：文档保留了原始的 _source 时，先解码成 map，之后写入 bulk 请求的是修改后的 map。
+*/
+func (doc *Document) sourceMap() (map[string]interface{}, error) {
+	if doc.rawSource != nil {
+		m := map[string]interface{}{}
+		if err := DecodeJsonBytes(doc.rawSource, &m); err != nil {
+			return nil, fmt.Errorf("invalid _source of document %s: %v", doc.Id, err)
+		}
+		doc.source = m
+		doc.rawSource = nil
+	}
+	if doc.source == nil {
+		doc.source = map[string]interface{}{}
+	}
+	return doc.source, nil
+}
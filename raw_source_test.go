@@ -0,0 +1,83 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRawSourceAllowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		migrator *Migrator
+		allowed  bool
+	}{
+		{"no transformation", &Migrator{Config: &Config{}}, true},
+		{"rename", &Migrator{Config: &Config{RenameFields: "a:b"}}, false},
+		{"csv output", &Migrator{Config: &Config{OutputFileType: "csv"}}, false},
+		{"index rename", &Migrator{Config: &Config{Indices: map[string]*IndexConfig{"logs-*": {Rename: "a:b"}}}}, false},
+		{"other index rename", &Migrator{Config: &Config{Indices: map[string]*IndexConfig{"orders": {Rename: "a:b"}}}}, true},
+		{"source filter", &Migrator{Config: &Config{}, SourceFilter: NewSourceFilter("", "a")}, false},
+		{"masker", &Migrator{Config: &Config{}, Masker: &Masker{}}, false},
+		{"join without relations", &Migrator{Config: &Config{}, Join: NewJoinTranslator("join", "_doc", nil)}, true},
+		{"join", &Migrator{Config: &Config{}, Join: NewJoinTranslator("join", "_doc", map[string]string{"q": "a"})}, false},
+		{"split types", &Migrator{Config: &Config{}, TypeSplitter: &TypeSplitter{}}, true},
+		{"split types with type field", &Migrator{Config: &Config{}, TypeSplitter: &TypeSplitter{typeField: "type"}}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.migrator.rawSourceAllowed("logs-1"); got != tt.allowed {
+			t.Errorf("%s: got %v, expected %v", tt.name, got, tt.allowed)
+		}
+	}
+}
+
+func TestDecodeHit(t *testing.T) {
+	hit := map[string]json.RawMessage{
+		"_index":   json.RawMessage(`"logs"`),
+		"_id":      json.RawMessage(`"1"`),
+		"_version": json.RawMessage(`3`),
+		"_source":  json.RawMessage(`{"a":1}`),
+	}
+
+	raw := &Migrator{Config: &Config{}}
+	doc, err := raw.decodeHit(hit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source, ok := doc["_source"].(json.RawMessage); !ok || string(source) != `{"a":1}` {
+		t.Errorf("raw _source = %#v", doc["_source"])
+	}
+	if doc["_id"] != "1" || doc["_version"] != json.Number("3") {
+		t.Errorf("meta = %v", doc)
+	}
+
+	decoded := &Migrator{Config: &Config{RenameFields: "a:b"}}
+	doc, err = decoded.decodeHit(hit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source, ok := doc["_source"].(map[string]interface{}); !ok || source["a"] != json.Number("1") {
+		t.Errorf("decoded _source = %#v", doc["_source"])
+	}
+
+	hit["_source"] = json.RawMessage(`[1]`)
+	if _, err := decoded.decodeHit(hit); err == nil {
+		t.Errorf("expected error for invalid _source")
+	}
+}
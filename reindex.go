@@ -0,0 +1,342 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cheggaaa/pb"
+	log "github.com/cihub/seelog"
+)
+
+/*轮询 _tasks 的间隔*/
+const reindexPollInterval = 2 * time.Second
+
+/*_tasks 接口返回的任务状态，只解析 reindex 用到的字段*/
+type ReindexTask struct {
+	Completed bool `json:"completed"`
+	Task      struct {
+		Status ReindexStatus `json:"status"`
+	} `json:"task"`
+	Response struct {
+		Failures []json.RawMessage `json:"failures"`
+	} `json:"response"`
+	Error json.RawMessage `json:"error"`
+}
+
+/*reindex 任务的进度，total 是源索引中匹配查询的文档数，第一批读取完成之后才有值*/
+type ReindexStatus struct {
+	Total            int64  `json:"total"`
+	Created          int64  `json:"created"`
+	Updated          int64  `json:"updated"`
+	Deleted          int64  `json:"deleted"`
+	Noops            int64  `json:"noops"`
+	VersionConflicts int64  `json:"version_conflicts"`
+	Batches          int64  `json:"batches"`
+	Canceled         string `json:"canceled"`
+}
+
+/*已经处理的文档数，包括写入、跳过和版本冲突的文档*/
+func (s ReindexStatus) processed() int64 {
+	return s.Created + s.Updated + s.Deleted + s.Noops + s.VersionConflicts
+}
+
+/*一个源索引对应的 reindex 任务*/
+type reindexJob struct {
+	index    string
+	target   string
+	body     map[string]interface{}
+	task     string
+	status   ReindexStatus
+	failures int
+	started  time.Time
+	took     time.Duration
+	done     bool
+	err      error
+}
+
+/*
+为每个源索引生成一个 _reindex 请求，查询、字段过滤和索引配置与 scroll 模式相同（见 planScrolls），
+目标集群通过 remote 从源集群读取文档，目标索引名称和字段重命名与 bulk 模式相同。
+*/
+func (c *Migrator) planReindexJobs() ([]*reindexJob, error) {
+	plans, err := c.planScrolls()
+	if err != nil {
+		return nil, err
+	}
+
+	host := c.Config.ReindexRemoteHost
+	if len(host) == 0 {
+		host = c.Config.SourceEs
+	}
+	remote := map[string]interface{}{"host": strings.TrimRight(host, "/")}
+	if c.SourceAuth != nil {
+		remote["username"] = c.SourceAuth.User
+		remote["password"] = c.SourceAuth.Pass
+	}
+
+	var jobs []*reindexJob
+	for _, plan := range plans {
+		for _, index := range splitFieldList(plan.indexNames) {
+			source := map[string]interface{}{
+				"remote": remote,
+				"index":  index,
+				"size":   c.Config.DocBufferCount,
+			}
+			if plan.query != nil {
+				source["query"] = plan.query
+			}
+			if filter := buildSourceFilter(plan.fields, plan.excludeFields); filter != nil {
+				source["_source"] = filter
+			}
+
+			dest := map[string]interface{}{"index": c.targetIndexName(index)}
+			if len(c.Config.OverrideTypeName) > 0 {
+				dest["type"] = c.Config.OverrideTypeName
+			}
+			if c.Config.OpType == "create" {
+				dest["op_type"] = "create"
+			}
+			if c.Config.PreserveVersion {
+				dest["version_type"] = "external"
+			}
+
+			/*和 bulk 模式一样，版本冲突的文档计数之后跳过，不中断任务*/
+			body := map[string]interface{}{
+				"source":    source,
+				"dest":      dest,
+				"conflicts": "proceed",
+			}
+			if script := renameScript(c.renameFields(index)); len(script) > 0 {
+				body["script"] = map[string]interface{}{"lang": "painless", "source": script}
+			}
+
+			jobs = append(jobs, &reindexJob{index: index, target: c.targetIndexName(index), body: body})
+		}
+	}
+	return jobs, nil
+}
+
+/*索引的字段重命名规则，配置文件中为索引单独指定的优先于 --rename*/
+func (c *Migrator) renameFields(index string) string {
+	if ic := c.Config.indexConfig(index); ic != nil && len(ic.Rename) > 0 {
+		return ic.Rename
+	}
+	return c.Config.RenameFields
+}
+
+/*
+把 --rename 的规则转换成 painless 脚本，和 bulk 模式一样 _type:type 把文档的 _type 写入 type 字段，
+其他规则把字段移动到新的名称。
+*/
+func renameScript(renameFields string) string {
+	var lines []string
+	for _, kv := range strings.Split(renameFields, ",") {
+		fvs := strings.Split(kv, ":")
+		if len(fvs) != 2 {
+			continue
+		}
+		oldField := strings.TrimSpace(fvs[0])
+		newField := strings.TrimSpace(fvs[1])
+		if len(oldField) == 0 || len(newField) == 0 {
+			continue
+		}
+		if oldField == "_type" {
+			lines = append(lines, fmt.Sprintf("ctx._source[%s] = ctx._type;", painlessString(newField)))
+		} else {
+			lines = append(lines, fmt.Sprintf("if (ctx._source.containsKey(%s)) { ctx._source[%s] = ctx._source.remove(%s); }",
+				painlessString(oldField), painlessString(newField), painlessString(oldField)))
+		}
+	}
+	return strings.Join(lines, " ")
+}
+
+func painlessString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+/*
+--reindex_remote 模式：文档不经过 esm，由目标集群通过 reindex-from-remote 直接从源集群读取。
+每个源索引提交一个 wait_for_completion=false 的 _reindex 任务，remote reindex 不支持 slices，
+--sliced_scroll_size 作为同时执行的任务数量，auto 表示所有索引同时执行。
+轮询 _tasks 更新进度条，Ctrl-C 时取消正在执行的任务，等待它们停止；再次 Ctrl-C 直接退出。
+返回失败的任务数量。
+*/
+func (c *Migrator) runReindexRemote(showBar bool) int {
+	if _, ok := c.TargetESAPI.(*ESAPIV0); ok {
+		log.Error("reindex from remote requires destination elasticsearch 5.x or above")
+		return 1
+	}
+
+	jobs, err := c.planReindexJobs()
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	concurrency := int(c.Config.ScrollSliceSize)
+	if c.Config.ScrollSliceSize.IsAuto() || concurrency > len(jobs) {
+		concurrency = len(jobs)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	log.Infof("start %d reindex tasks, concurrency: %d", len(jobs), concurrency)
+
+	var fetchBar, outputBar *pb.ProgressBar
+	var pool *pb.Pool
+	if showBar {
+		fetchBar = pb.New(1).Prefix("Remote")
+		outputBar = pb.New(1).Prefix("Reindex ")
+		pool, err = pb.StartPool(fetchBar, outputBar)
+		if err != nil {
+			log.Error(err)
+			pool = nil
+		}
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	ticker := time.NewTicker(reindexPollInterval)
+	defer ticker.Stop()
+
+	pending := jobs
+	var running []*reindexJob
+	cancelled := false
+	for {
+		for !cancelled && len(running) < concurrency && len(pending) > 0 {
+			job := pending[0]
+			pending = pending[1:]
+			job.started = time.Now()
+			job.task, job.err = c.TargetESAPI.Reindex(job.body)
+			if job.err != nil {
+				job.done = true
+				log.Errorf("failed to submit reindex of index %s: %v", job.index, job.err)
+				continue
+			}
+			log.Infof("reindex %s -> %s, task: %s", job.index, job.target, job.task)
+			running = append(running, job)
+		}
+		if len(running) == 0 {
+			break
+		}
+
+		select {
+		case <-interrupt:
+			if cancelled {
+				log.Warn("interrupted again, exit without waiting for the reindex tasks")
+				log.Flush()
+				os.Exit(1)
+			}
+			cancelled = true
+			log.Warnf("interrupted, cancel %d running reindex tasks", len(running))
+			for _, job := range running {
+				if err := c.TargetESAPI.CancelTask(job.task); err != nil {
+					log.Errorf("failed to cancel task %s: %v", job.task, err)
+				}
+			}
+		case <-ticker.C:
+		}
+
+		running = c.pollReindexJobs(running)
+		if pool != nil {
+			var total, processed, written int64
+			for _, job := range jobs {
+				total += job.status.Total
+				processed += job.status.processed()
+				written += job.status.Created + job.status.Updated
+			}
+			fetchBar.Total = total
+			outputBar.Total = total
+			fetchBar.Set64(processed)
+			outputBar.Set64(written)
+		}
+	}
+
+	if pool != nil {
+		fetchBar.Finish()
+		outputBar.Finish()
+		pool.Stop()
+	}
+
+	failed := 0
+	for _, job := range jobs {
+		if !job.done {
+			failed++
+			log.Warnf("index %s was not reindexed", job.index)
+			continue
+		}
+		c.BulkStats.AddCount("created", int(job.status.Created))
+		c.BulkStats.AddCount("updated", int(job.status.Updated))
+		c.BulkStats.AddCount("deleted", int(job.status.Deleted))
+		c.BulkStats.AddCount("noop", int(job.status.Noops))
+		c.BulkStats.AddCount("conflict", int(job.status.VersionConflicts))
+		c.BulkStats.AddCount("failed", job.failures)
+		if job.err != nil {
+			failed++
+			log.Errorf("reindex %s -> %s failed: %v", job.index, job.target, job.err)
+			continue
+		}
+		log.Infof("reindex %s -> %s finished in %v, %d documents, created: %d, updated: %d, conflict: %d",
+			job.index, job.target, job.took.Truncate(time.Second), job.status.processed(),
+			job.status.Created, job.status.Updated, job.status.VersionConflicts)
+	}
+	if failed > 0 {
+		log.Errorf("%d of %d reindex tasks failed", failed, len(jobs))
+	}
+	return failed
+}
+
+/*查询正在执行的任务的进度，返回还没有结束的任务；查询失败的任务下次继续查询。*/
+func (c *Migrator) pollReindexJobs(running []*reindexJob) []*reindexJob {
+	var remaining []*reindexJob
+	for _, job := range running {
+		task, err := c.TargetESAPI.GetTask(job.task)
+		if err != nil {
+			log.Warnf("failed to get task %s: %v", job.task, err)
+			remaining = append(remaining, job)
+			continue
+		}
+		job.status = task.Task.Status
+		if !task.Completed {
+			remaining = append(remaining, job)
+			continue
+		}
+
+		job.done = true
+		job.took = time.Since(job.started)
+		job.failures = len(task.Response.Failures)
+		switch {
+		case len(task.Error) > 0 && string(task.Error) != "null":
+			job.err = errors.New(string(task.Error))
+		case len(job.status.Canceled) > 0:
+			job.err = errors.New("cancelled, " + job.status.Canceled)
+		case job.failures > 0:
+			job.err = fmt.Errorf("%d documents failed, first failure: %s", job.failures, task.Response.Failures[0])
+		}
+	}
+	return remaining
+}
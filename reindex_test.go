@@ -0,0 +1,46 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestRenameScript(t *testing.T) {
+	tests := []struct {
+		rename   string
+		expected string
+	}{
+		{"", ""},
+		{"a:b", "if (ctx._source.containsKey('a')) { ctx._source['b'] = ctx._source.remove('a'); }"},
+		{"_type:type", "ctx._source['type'] = ctx._type;"},
+		{" a : b ,_type:t", "if (ctx._source.containsKey('a')) { ctx._source['b'] = ctx._source.remove('a'); } ctx._source['t'] = ctx._type;"},
+		{"it's:x", `if (ctx._source.containsKey('it\'s')) { ctx._source['x'] = ctx._source.remove('it\'s'); }`},
+		{"a,b:,:c,x:y:z", ""},
+	}
+
+	for _, tt := range tests {
+		if got := renameScript(tt.rename); got != tt.expected {
+			t.Errorf("renameScript(%q) = %q, expected %q", tt.rename, got, tt.expected)
+		}
+	}
+}
+
+func TestReindexStatusProcessed(t *testing.T) {
+	s := ReindexStatus{Total: 100, Created: 10, Updated: 5, Deleted: 1, Noops: 2, VersionConflicts: 3, Batches: 4}
+	if got := s.processed(); got != 21 {
+		t.Errorf("processed = %d, expected 21", got)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+/*
+DocSampler 实现 --sample_rate 和 --max_docs，用于从生产环境复制一部分数据到测试环境。
+5.x 及以上的源集群在 scroll 的查询外面包一层带 seed 的 function_score/random_score，由服务端完成采样；
+1.x/2.x 和文件输入在客户端按照 seed、_index 和 _id 的哈希值采样，相同的 seed 选出的文档相同。
+--max_docs 限制每个索引写入的文档数，所有索引都达到上限之后 scroll 提前结束，不再读取剩余的文档。
+*/
+type DocSampler struct {
+	rate       float64
+	seed       int64
+	maxDocs    int64
+	serverSide bool /*源集群是 5.x 及以上版本时，采样由 scroll 的查询完成*/
+
+	lock   sync.Mutex
+	counts map[string]int64
+}
+
+/*没有采样也没有数量限制时返回 nil。没有指定 --sample_seed 时随机生成一个，并在日志中输出，方便重复相同的采样。*/
+func NewDocSampler(config *Config) *DocSampler {
+	if config.SampleRate >= 1 && config.MaxDocs <= 0 {
+		return nil
+	}
+	s := &DocSampler{rate: config.SampleRate, seed: config.SampleSeed, maxDocs: int64(config.MaxDocs), counts: map[string]int64{}}
+	if s.sampling() {
+		if s.seed == 0 {
+			s.seed = time.Now().UnixNano() % 1000000
+		}
+		log.Infof("sample %.4g of the documents, seed: %d, use --sample_seed=%d to repeat the sample", s.rate, s.seed, s.seed)
+	}
+	if s.maxDocs > 0 {
+		log.Infof("migrate at most %d documents per index", s.maxDocs)
+	}
+	return s
+}
+
+func (s *DocSampler) sampling() bool {
+	return s != nil && s.rate < 1
+}
+
+/*
+把 scroll 的查询改写成采样查询，random_score 的分数均匀分布在 [0, 1) 之间，min_score 过滤掉 1-rate 的文档。
+7.x 设置 seed 时必须指定 field，使用每个分片内唯一的 _seq_no；5.x/6.x 不需要 field。
+没有采样时原样返回 query。
+*/
+func (s *DocSampler) scrollQuery(query map[string]interface{}, field string) map[string]interface{} {
+	if !s.sampling() {
+		return query
+	}
+	if len(query) == 0 {
+		query = map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+	random := map[string]interface{}{"seed": s.seed}
+	if len(field) > 0 {
+		random["field"] = field
+	}
+	return map[string]interface{}{
+		"function_score": map[string]interface{}{
+			"query":        query,
+			"random_score": random,
+			"boost_mode":   "replace",
+			"min_score":    1 - s.rate,
+		},
+	}
+}
+
+/*
+判断文档是否需要迁移。服务端没有采样时在客户端采样，然后按照 _index 统计选中的数量，超过 --max_docs 的文档被丢弃。
+*/
+func (s *DocSampler) Accept(doc map[string]interface{}) bool {
+	if s == nil {
+		return true
+	}
+	index, _ := doc["_index"].(string)
+	if s.sampling() && !s.serverSide && !s.pick(index, fmt.Sprint(doc["_id"])) {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.maxDocs > 0 && s.counts[index] >= s.maxDocs {
+		return false
+	}
+	s.counts[index]++
+	return true
+}
+
+/*索引中被选中迁移的文档数量，--per_index 校验目标索引时用它代替源索引的文档总数。*/
+func (s *DocSampler) Accepted(index string) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.counts[index]
+}
+
+/*根据 seed、索引名称和文档 ID 的哈希值决定是否选中，结果和文档读取的顺序、slice 的划分无关。*/
+func (s *DocSampler) pick(index, id string) bool {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%s/%s", s.seed, index, id)
+	/*FNV 的高位在输入较短时分布很不均匀，先用 splitmix64 的终结步骤打散再取高 53 位*/
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11)/(1<<53) < s.rate
+}
+
+/*
+scroll 中的索引是否都已经达到 --max_docs，达到之后不需要继续读取。
+indexNames 是逗号分隔的具体索引名称，和 scrollPlan.indexNames 相同。
+*/
+func (s *DocSampler) Full(indexNames string) bool {
+	if s == nil || s.maxDocs <= 0 {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, index := range splitFieldList(indexNames) {
+		if s.counts[index] < s.maxDocs {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDocSamplerPick(t *testing.T) {
+	tests := []struct {
+		rate     float64
+		min, max int
+	}{
+		{0, 0, 0},
+		{0.1, 50, 150},
+		{0.5, 400, 600},
+		{1, 1000, 1000},
+	}
+
+	for _, tt := range tests {
+		s := &DocSampler{rate: tt.rate, seed: 42}
+		picked := 0
+		for i := 0; i < 1000; i++ {
+			if s.pick("logs", fmt.Sprint(i)) {
+				picked++
+			}
+		}
+		if picked < tt.min || picked > tt.max {
+			t.Errorf("rate %v: picked %d, expected between %d and %d", tt.rate, picked, tt.min, tt.max)
+		}
+	}
+
+	/*相同的 seed 选出相同的文档，不同的 seed 选出不同的文档*/
+	a, b, c := &DocSampler{rate: 0.5, seed: 1}, &DocSampler{rate: 0.5, seed: 1}, &DocSampler{rate: 0.5, seed: 2}
+	same, diff := true, false
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprint(i)
+		same = same && a.pick("logs", id) == b.pick("logs", id)
+		diff = diff || a.pick("logs", id) != c.pick("logs", id)
+	}
+	if !same || !diff {
+		t.Errorf("same seed: %v, different seed: %v", same, diff)
+	}
+}
+
+func TestDocSamplerAccept(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     Config
+		serverSide bool
+		accepted   int64
+	}{
+		{"max docs", Config{SampleRate: 1, MaxDocs: 3}, false, 3},
+		{"sample rate", Config{SampleRate: 0.5, SampleSeed: 7}, false, 0},
+		{"server side sample", Config{SampleRate: 0.5, SampleSeed: 7}, true, 10},
+		{"sample rate and max docs", Config{SampleRate: 0.5, SampleSeed: 7, MaxDocs: 2}, false, 2},
+	}
+
+	for _, tt := range tests {
+		s := NewDocSampler(&tt.config)
+		s.serverSide = tt.serverSide
+		var accepted int64
+		for i := 0; i < 10; i++ {
+			if s.Accept(map[string]interface{}{"_index": "logs", "_id": fmt.Sprint(i)}) {
+				accepted++
+			}
+		}
+		if tt.accepted > 0 && accepted != tt.accepted {
+			t.Errorf("%s: accepted %d, expected %d", tt.name, accepted, tt.accepted)
+		}
+		if got := s.Accepted("logs"); got != accepted {
+			t.Errorf("%s: Accepted() = %d, expected %d", tt.name, got, accepted)
+		}
+		if got := s.Accepted("other"); got != 0 {
+			t.Errorf("%s: Accepted(other) = %d", tt.name, got)
+		}
+	}
+
+	if s := NewDocSampler(&Config{SampleRate: 1}); s != nil || !s.Accept(map[string]interface{}{"_index": "logs"}) {
+		t.Errorf("expected nil sampler to accept every document")
+	}
+}
+
+func TestDocSamplerFull(t *testing.T) {
+	s := NewDocSampler(&Config{SampleRate: 1, MaxDocs: 1})
+	s.Accept(map[string]interface{}{"_index": "a", "_id": "1"})
+	if !s.Full("a") || s.Full("a,b") {
+		t.Errorf("Full(a) = %v, Full(a,b) = %v", s.Full("a"), s.Full("a,b"))
+	}
+	s.Accept(map[string]interface{}{"_index": "b", "_id": "1"})
+	if !s.Full("a,b") {
+		t.Errorf("expected a,b to be full")
+	}
+
+	var unlimited *DocSampler
+	if unlimited.Full("a") {
+		t.Errorf("nil sampler is never full")
+	}
+}
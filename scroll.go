@@ -29,7 +29,6 @@ Scroll API 的接口定义，帮助用户通过 Scroll API 获取 Elasticsearch
 type ScrollAPI interface {
 	GetScrollId() string
 	GetHitsTotal() int
-	GetDocs() []interface{}
 	ProcessScrollResult(c *Migrator, bar *pb.ProgressBar)
 	Next(c *Migrator, bar *pb.ProgressBar) (done bool)
 }
@@ -139,60 +138,37 @@ func (s *Scroll) ProcessScrollResult(c *Migrator, bar *pb.ProgressBar) {
 		所以这里强制类型转换的原因是将文档从 interface{} 类型转换为 map[string]interface{} 类型后，可以获取其中的每一个键值对，进而用于迁移数据。
 	*/
 	for _, docI := range s.Hits.Docs {
-		c.DocChan <- docI.(map[string]interface{})
+		c.filterSource(docI.(map[string]interface{}))
+		c.sendDoc(docI.(map[string]interface{}))
 	}
 }
 
 /*
-实现了从 Elasticsearch 中滚动查询并获取文档的过程。
-若结果为空，则返回 true，表示滚动查询结束。否则，代码调用 ProcessScrollResult() 方法将获取到的文档写入一个 channel，并更新进度条。
-最后，代码更新了 s.ScrollId，以便进行下一轮滚动查询。
-
-需要注意的是，这个方法中同样使用了类型断言 scroll.(ScrollAPI) 将接口类型转换成 ScrollAPI 类型对象，以便调用其 GetDocs()、ProcessScrollResult() 和 GetScrollId() 方法。
-这些方法都是 ScrollAPI 接口提供的，实现了对滚动查询结果的处理和解析。
+如果设置了客户端 _source 过滤器（源集群为 1.x/2.x 且指定了 --exclude_fields 或带通配符的 --fields），
+在文档写入 channel 之前完成过滤。
 */
-func (s *Scroll) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
-
-	/*
-		使用 Elasticsearch 的 Scroll API 进行滚动查询，并获取下一页的结果。
-		其中，SourceESAPI 是 Elasticsearch 的 API 客户端，Config.ScrollTime 是滚动查询的时间，s.ScrollId 是上一次滚动查询的 ID。
-		NextScroll 方法会返回滚动查询结果中的下一页数据和一个错误对象 (err)。
-	*/
-	scroll, err := c.SourceESAPI.NextScroll(c.Config.ScrollTime, s.ScrollId)
-	if err != nil {
-		log.Error(err)
-		return false
+func (c *Migrator) filterSource(doc map[string]interface{}) {
+	filter := c.SourceFilter
+	if index, ok := doc["_index"].(string); ok {
+		if f, ok := c.IndexSourceFilters[index]; ok {
+			filter = f
+		}
 	}
-
-	/*
-		这行代码是将前面获取到的滚动查询结果 scroll 转换为 ScrollAPI 类型，并以此调用 GetDocs 方法，获取该滚动查询结果页中的所有文档。
-		需要注意的是，这里的转换操作使用了类型断言 (ScrollAPI)，并且需要确保 GetDocs 方法在 ScrollAPI 接口中被定义。
-	*/
-	docs := scroll.(ScrollAPI).GetDocs()
-	/*
-		判断获取到的文档数量是否大于 0，来判断当前滚动查询是否结束。
-		如果查询结果为空，那么打印一条调试日志，并通过 return true 表示滚动查询结束。
-		其中，log.Debug() 方法是记录日志的函数，它基于已经初始化的 log 库实例，将错误信息以 DEBUG 级别输出。
-	*/
-	if docs == nil || len(docs) <= 0 {
-		log.Debug("scroll result is empty")
-		return true
+	if filter == nil {
+		return
 	}
-	/*
-	   将前面获取到的滚动查询结果 scroll 转换为 ScrollAPI 类型，并以此调用 ProcessScrollResult 方法来对该滚动查询结果页进行处理。
-	   c 和 bar 都是参数，c 是用于接收查询结果的 channel，而 bar 则是用于显示查询进度的进度条控件。
-	   需要注意的是，这里的转换操作使用了类型断言 (ScrollAPI)，并且需要确保 ProcessScrollResult 方法在 ScrollAPI 接口中被定义。
-	*/
-	scroll.(ScrollAPI).ProcessScrollResult(c, bar)
-
-	/*
-		s.ScrollId 是一个字符串类型的变量，scroll 是一个实现了 ScrollAPI 接口的对象，GetScrollId() 是 ScrollAPI 接口中定义的方法。
-		这行代码的作用是将 scroll 对象的 GetScrollId() 方法返回的滚动 ID 赋值给 s.ScrollId 变量。
-		滚动 ID 是 Elasticsearch 用来标识一次滚动请求的唯一标识符，以便在滚动的过程中能够持续获取数据。
-		在获取第一次滚动请求的结果后，需要将滚动 ID 保存下来，以便在后续的滚动请求中使用
-	*/
-	s.ScrollId = scroll.(ScrollAPI).GetScrollId()
+	if source, ok := doc["_source"].(map[string]interface{}); ok {
+		filter.Apply(source)
+	}
+}
 
+/*
+实现了从 Elasticsearch 中滚动查询并获取文档的过程。
+下一页的结果是流式解码的，每解析出一个文档就写入 DocChan，见 streamNextScroll。
+若结果为空，则返回 true，表示滚动查询结束；否则更新 s.ScrollId，以便进行下一轮滚动查询。
+*/
+func (s *Scroll) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
+	s.ScrollId, done = c.streamNextScroll(s.ScrollId, bar)
 	return
 }
 
@@ -215,28 +191,12 @@ func (s *ScrollV7) ProcessScrollResult(c *Migrator, bar *pb.ProgressBar) {
 
 	// write all the docs into a channel
 	for _, docI := range s.Hits.Docs {
-		c.DocChan <- docI.(map[string]interface{})
+		c.filterSource(docI.(map[string]interface{}))
+		c.sendDoc(docI.(map[string]interface{}))
 	}
 }
 
 func (s *ScrollV7) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
-
-	scroll, err := c.SourceESAPI.NextScroll(c.Config.ScrollTime, s.ScrollId)
-	if err != nil {
-		log.Error(err)
-		return false
-	}
-
-	docs := scroll.(ScrollAPI).GetDocs()
-	if docs == nil || len(docs) <= 0 {
-		log.Debug("scroll result is empty")
-		return true
-	}
-
-	scroll.(ScrollAPI).ProcessScrollResult(c, bar)
-
-	//update scrollId
-	s.ScrollId = scroll.(ScrollAPI).GetScrollId()
-
+	s.ScrollId, done = c.streamNextScroll(s.ScrollId, bar)
 	return
 }
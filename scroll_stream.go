@@ -0,0 +1,309 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/cheggaaa/pb"
+	log "github.com/cihub/seelog"
+)
+
+/*读取下一页 scroll 结果的请求失败时的重试次数*/
+const scrollRetryTimes = 3
+
+/*
+ScrollPage 是流式解码的一页 scroll 结果。
+hits 在解码的过程中逐个交给回调函数处理，不会保存在 ScrollPage 中，所以一页的文档不会同时留在内存里。
+*/
+type ScrollPage struct {
+	ScrollId string
+	Total    int
+	Docs     int
+	Failures []interface{}
+}
+
+/*
+流式解码 scroll 的响应，每解析出一个 hit 就调用一次 onHit，hit 中每个字段都是原始的 JSON，由调用方决定如何解码。
+同时兼容 1.x 到 6.x 的 "total": 100 和 7.x 的 "total": {"value": 100, "relation": "eq"}，
+其余不需要的字段直接跳过。解码出错时同时返回已经读取的部分和错误，page 不为 nil 表示响应已经开始读取。
+*/
+func decodeScrollStream(r io.Reader, onHit func(hit map[string]json.RawMessage)) (*ScrollPage, error) {
+	reader, err := newScrollReader(r)
+	if err != nil {
+		return &ScrollPage{}, err
+	}
+	return reader.Each(onHit)
+}
+
+/*
+scrollReader 逐个读取 scroll 响应中的文档。
+创建时先读取到 hits.hits 数组的开头，ES 总是先输出 _scroll_id、_shards 和 hits.total，所以这时已经可以拿到 scroll id 和命中总数，
+数组中的文档由 Each 逐个读取，NewScroll 的第一页和之后的页使用同样的方式读取。
+*/
+type scrollReader struct {
+	decoder *json.Decoder
+	page    *ScrollPage
+	inHits  bool /*是否停在 hits.hits 数组中*/
+}
+
+func newScrollReader(r io.Reader) (*scrollReader, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+
+	s := &scrollReader{decoder: decoder, page: &ScrollPage{}}
+	if err := expectDelim(decoder, '{'); err != nil {
+		return nil, err
+	}
+	if err := s.readResponse(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+/*读取剩余的文档，每读取一个就交给 onHit，然后读取响应中剩余的字段。*/
+func (s *scrollReader) Each(onHit func(hit map[string]json.RawMessage)) (*ScrollPage, error) {
+	if !s.inHits {
+		return s.page, nil
+	}
+	for s.decoder.More() {
+		hit := map[string]json.RawMessage{}
+		if err := s.decoder.Decode(&hit); err != nil {
+			return s.page, err
+		}
+		s.page.Docs++
+		onHit(hit)
+	}
+	if err := expectDelim(s.decoder, ']'); err != nil {
+		return s.page, err
+	}
+	s.inHits = false
+
+	if err := s.readHits(); err != nil {
+		return s.page, err
+	}
+	if s.inHits {
+		return s.page, errors.New("invalid scroll response, duplicate hits")
+	}
+	return s.page, s.readResponse()
+}
+
+/*读取响应最外层的字段，进入 hits.hits 数组时暂停，否则一直读取到响应结束。*/
+func (s *scrollReader) readResponse() error {
+	for s.decoder.More() {
+		key, err := s.decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "_scroll_id":
+			err = s.decoder.Decode(&s.page.ScrollId)
+		case "_shards":
+			shards := struct {
+				Failures []struct {
+					Reason interface{} `json:"reason,omitempty"`
+				} `json:"failures,omitempty"`
+			}{}
+			err = s.decoder.Decode(&shards)
+			for _, failure := range shards.Failures {
+				s.page.Failures = append(s.page.Failures, failure.Reason)
+			}
+		case "hits":
+			if err = expectDelim(s.decoder, '{'); err == nil {
+				err = s.readHits()
+			}
+			if err == nil && s.inHits {
+				return nil
+			}
+		default:
+			var skip json.RawMessage
+			err = s.decoder.Decode(&skip)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(s.decoder, '}')
+}
+
+/*读取 hits 对象中的字段，进入 hits.hits 数组时暂停。*/
+func (s *scrollReader) readHits() error {
+	for s.decoder.More() {
+		key, err := s.decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "total":
+			var total interface{}
+			if err := s.decoder.Decode(&total); err != nil {
+				return err
+			}
+			if v, ok := total.(map[string]interface{}); ok {
+				total = v["value"]
+			}
+			s.page.Total, _ = strconv.Atoi(fmt.Sprint(total))
+		case "hits":
+			if err := expectDelim(s.decoder, '['); err != nil {
+				return err
+			}
+			s.inHits = true
+			return nil
+		default:
+			var skip json.RawMessage
+			if err := s.decoder.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+	return expectDelim(s.decoder, '}')
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("invalid scroll response, expect %v but got %v", delim, token)
+	}
+	return nil
+}
+
+/*
+StreamedScroll 是 NewScroll 返回的 scroll，响应体在 NewScroll 中只读取到 hits.hits 数组的开头，
+第一页的文档在 ProcessScrollResult 中边读边写入 DocChan，之后的页由 Next 流式读取。
+*/
+type StreamedScroll struct {
+	body     io.ReadCloser
+	reader   *scrollReader
+	ScrollId string
+	done     bool /*第一页读取出错或者没有任何命中时，不再读取下一页*/
+}
+
+/*打开 scroll 的第一页，读取失败时关闭响应体。*/
+func newStreamedScroll(body io.ReadCloser) (*StreamedScroll, error) {
+	reader, err := newScrollReader(body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return &StreamedScroll{body: body, reader: reader, ScrollId: reader.page.ScrollId}, nil
+}
+
+func (s *StreamedScroll) GetScrollId() string {
+	return s.ScrollId
+}
+
+func (s *StreamedScroll) GetHitsTotal() int {
+	return s.reader.page.Total
+}
+
+/*读取第一页剩余的文档并写入 DocChan，中途出错时这个 scroll 不再继续读取。*/
+func (s *StreamedScroll) ProcessScrollResult(c *Migrator, bar *pb.ProgressBar) {
+	defer s.body.Close()
+	page, err := s.reader.Each(c.scrollHitHandler(bar))
+	c.logScrollFailures(page)
+	if err != nil {
+		s.done = true
+		c.scrollFailed("failed to read the first page of scroll after %d documents, the rest of the documents are not migrated: %v", page.Docs, err)
+		return
+	}
+	if len(page.ScrollId) > 0 {
+		s.ScrollId = page.ScrollId
+	}
+	s.done = page.Total == 0 && page.Docs == 0
+}
+
+func (s *StreamedScroll) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
+	if s.done {
+		return true
+	}
+	s.ScrollId, done = c.streamNextScroll(s.ScrollId, bar)
+	return
+}
+
+/*把读取到的文档解码、过滤 _source 之后写入 DocChan。*/
+func (c *Migrator) scrollHitHandler(bar *pb.ProgressBar) func(hit map[string]json.RawMessage) {
+	return func(hit map[string]json.RawMessage) {
+		doc, err := c.decodeHit(hit)
+		if err != nil {
+			c.scrollFailed("%v", err)
+			return
+		}
+		c.filterSource(doc)
+		c.sendDoc(doc)
+		bar.Increment()
+	}
+}
+
+func (c *Migrator) logScrollFailures(page *ScrollPage) {
+	for _, failure := range page.Failures {
+		reason, _ := json.Marshal(failure)
+		log.Errorf(string(reason))
+	}
+}
+
+/*记录读取源文档时的错误，有错误时迁移结束后以非 0 状态退出。*/
+func (c *Migrator) scrollFailed(format string, params ...interface{}) {
+	atomic.AddInt32(&c.ScrollErrors, 1)
+	log.Errorf(format, params...)
+}
+
+/*
+读取下一页 scroll 结果，每解码出一个文档就过滤 _source 并写入 DocChan，不需要等整页解码完成。
+返回下一次请求使用的 scroll id，以及 scroll 是否已经读取完毕。
+请求失败或者响应的状态码不是 200 时使用同一个 scroll id 重试；已经开始读取文档之后出错时，scroll 已经前进，这一页剩余的文档无法再次读取，
+所以记录为错误并结束这个 scroll，而不是跳到下一页。
+*/
+func (c *Migrator) streamNextScroll(scrollId string, bar *pb.ProgressBar) (string, bool) {
+	var page *ScrollPage
+	var err error
+	for retry := 0; ; retry++ {
+		c.ScrollLimiter.Wait(1)
+		page, err = c.SourceESAPI.StreamScroll(c.Config.ScrollTime, scrollId, c.scrollHitHandler(bar))
+		if err == nil || page != nil || retry >= scrollRetryTimes {
+			break
+		}
+		log.Warnf("failed to read next page of scroll, retry %d/%d: %v", retry+1, scrollRetryTimes, err)
+		time.Sleep(time.Duration(retry+1) * time.Second)
+	}
+
+	if err != nil {
+		docs := 0
+		if page != nil {
+			c.logScrollFailures(page)
+			docs = page.Docs
+		}
+		c.scrollFailed("failed to read next page of scroll after %d documents, the rest of the documents are not migrated: %v", docs, err)
+		return scrollId, true
+	}
+
+	c.logScrollFailures(page)
+
+	if page.Docs == 0 {
+		log.Debug("scroll result is empty")
+		return scrollId, true
+	}
+	return page.ScrollId, false
+}
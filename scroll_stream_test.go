@@ -0,0 +1,106 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDecodeScrollStream(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		scrollId string
+		total    int
+		ids      []string
+		failures int
+		valid    bool
+	}{
+		{
+			name:     "6.x total",
+			response: `{"_scroll_id":"s1","took":1,"_shards":{"total":1,"failures":[]},"hits":{"total":2,"max_score":1,"hits":[{"_id":"1","_source":{"a":1}},{"_id":"2","_source":{}}]}}`,
+			scrollId: "s1", total: 2, ids: []string{"1", "2"}, valid: true,
+		},
+		{
+			name:     "7.x total object",
+			response: `{"_scroll_id":"s2","hits":{"total":{"value":5,"relation":"eq"},"hits":[{"_id":"a"}]}}`,
+			scrollId: "s2", total: 5, ids: []string{"a"}, valid: true,
+		},
+		{
+			name:     "1.x scan without hits",
+			response: `{"_scroll_id":"s3","hits":{"total":10,"max_score":0,"hits":[]}}`,
+			scrollId: "s3", total: 10, valid: true,
+		},
+		{
+			name:     "fields after hits",
+			response: `{"hits":{"hits":[{"_id":"1"}],"total":1},"_scroll_id":"s4","_shards":{"failures":[{"reason":"x"}]}}`,
+			scrollId: "s4", total: 1, ids: []string{"1"}, failures: 1, valid: true,
+		},
+		{
+			name:     "truncated in the middle of hits",
+			response: `{"_scroll_id":"s5","hits":{"total":3,"hits":[{"_id":"1"},{"_id":"2"},{"_id":`,
+			scrollId: "s5", total: 3, ids: []string{"1", "2"},
+		},
+		{
+			name:     "not an object",
+			response: `[]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ids []string
+			page, err := decodeScrollStream(strings.NewReader(tt.response), func(hit map[string]json.RawMessage) {
+				var id string
+				json.Unmarshal(hit["_id"], &id)
+				ids = append(ids, id)
+			})
+			if (err == nil) != tt.valid {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if page == nil {
+				t.Fatalf("page is nil")
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.ids, ",") || page.Docs != len(tt.ids) {
+				t.Errorf("ids = %v, docs = %d, expected %v", ids, page.Docs, tt.ids)
+			}
+			if tt.valid && (page.ScrollId != tt.scrollId || page.Total != tt.total || len(page.Failures) != tt.failures) {
+				t.Errorf("page = %+v", page)
+			}
+		})
+	}
+}
+
+func TestStreamedScrollFirstPage(t *testing.T) {
+	body := `{"_scroll_id":"s1","hits":{"total":2,"hits":[{"_index":"a","_id":"1","_source":{"x":1}},{"_index":"a","_id":"2","_source":{"x":2}}]}}`
+	scroll, err := newStreamedScroll(ioutil.NopCloser(strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/*打开时只读取到文档数组的开头*/
+	if scroll.GetScrollId() != "s1" || scroll.GetHitsTotal() != 2 || scroll.reader.page.Docs != 0 {
+		t.Fatalf("scroll = %+v, page = %+v", scroll, scroll.reader.page)
+	}
+
+	if _, err := newStreamedScroll(ioutil.NopCloser(strings.NewReader(`{"_scroll_id":`))); err == nil {
+		t.Errorf("expected error for an invalid response")
+	}
+}
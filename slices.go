@@ -0,0 +1,213 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	log "github.com/cihub/seelog"
+)
+
+/*
+SliceSize 是 --sliced_scroll_size 的值，可以是一个数字，也可以是 auto。
+auto 表示根据源索引的主分片数量和文档数量为每个 scroll 计划自动选择 slice 数量。
+*/
+type SliceSize int
+
+const autoSliceSize SliceSize = -1
+
+const (
+	/*集群没有设置 search.max_open_scroll_context 时使用的上限，和 7.x 的默认值一致*/
+	defaultMaxOpenScrollContext = 500
+	/*auto 模式下每个 slice 至少分到的文档数，文档太少的索引没必要拆分*/
+	autoSliceMinDocs = 100000
+)
+
+func (s *SliceSize) UnmarshalFlag(value string) error {
+	if value == "auto" {
+		*s = autoSliceSize
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid sliced_scroll_size %s, expect a number or auto", value)
+	}
+	*s = SliceSize(n)
+	return nil
+}
+
+func (s SliceSize) MarshalFlag() (string, error) {
+	if s.IsAuto() {
+		return "auto", nil
+	}
+	return strconv.Itoa(int(s)), nil
+}
+
+func (s SliceSize) IsAuto() bool {
+	return s == autoSliceSize
+}
+
+/*
+为每个 scroll 计划确定 slice 数量。
+指定了数字时所有计划都使用这个数字；auto 时 slice 数量不超过主分片总数，并且每个 slice 至少分到 autoSliceMinDocs 个文档，
+所有同时打开的 scroll 在单个节点上占用的 search context 不超过集群的 search.max_open_scroll_context，估算方法见 contextsPerSlice。
+1.x/2.x 不支持 sliced scroll，每个 slice 通过 preference=_shards 读取一部分分片，所以 slice 数量不能超过单个索引的主分片数。
+*/
+func (c *Migrator) resolveSlices(plans []scrollPlan) {
+	_, shardScroll := c.SourceESAPI.(*ESAPIV0)
+
+	size := c.Config.ScrollSliceSize
+	if !size.IsAuto() {
+		slices := int(size)
+		if slices < 1 {
+			slices = 1
+		}
+		for i := range plans {
+			plans[i].slices = slices
+			if shardScroll && slices > 1 {
+				if _, maxShards, _ := c.primaryLayout(plans[i].indexNames); maxShards > 0 && maxShards < slices {
+					log.Infof("index %s only has %d primary shards, use %d slices", plans[i].indexNames, maxShards, maxShards)
+					plans[i].slices = maxShards
+				}
+			}
+		}
+		return
+	}
+
+	budget := c.maxOpenScrollContext() / c.concurrentJobs(len(plans))
+	if budget < 1 {
+		budget = 1
+	}
+	nodes := c.sourceDataNodes()
+
+	for i := range plans {
+		shards, maxShards, docs := c.primaryLayout(plans[i].indexNames)
+		slices := shards
+		if shardScroll {
+			slices = maxShards
+		}
+		if byDocs := int((docs + autoSliceMinDocs - 1) / autoSliceMinDocs); byDocs < slices {
+			slices = byDocs
+		}
+		if perSlice := c.contextsPerSlice(shards, nodes); slices*perSlice > budget {
+			slices = budget / perSlice
+		}
+		if slices < 1 {
+			slices = 1
+		}
+		plans[i].slices = slices
+		log.Infof("index %s has %d primary shards and %d documents, use %d slices", plans[i].indexNames, shards, docs, slices)
+	}
+}
+
+/*--per_index 模式下会有多个索引任务同时打开 scroll，每个任务有 plans 个 scroll 计划*/
+func (c *Migrator) concurrentJobs(plans int) int {
+	if c.Config.PerIndex && c.Config.IndexParallelism > 1 {
+		return plans * c.Config.IndexParallelism
+	}
+	return plans
+}
+
+/*
+一个 slice 在单个节点上打开的 search context 数量。
+sliced scroll 的每个 slice 都会在索引的每个分片上打开一个 search context，而 search.max_open_scroll_context 是单个节点的上限，
+所以按照 shards 个主分片平均分布在 nodes 个数据节点上估算，无法获取节点数量时按所有分片都在同一个节点上估算。
+1.x/2.x 的每个 slice 只读取一部分分片，按 1 个计算。
+*/
+func (c *Migrator) contextsPerSlice(shards, nodes int) int {
+	if _, shardScroll := c.SourceESAPI.(*ESAPIV0); shardScroll || shards < 1 {
+		return 1
+	}
+	if nodes < 1 {
+		return shards
+	}
+	return (shards + nodes - 1) / nodes
+}
+
+/*源集群数据节点的数量，获取失败时返回 0。*/
+func (c *Migrator) sourceDataNodes() int {
+	nodes, err := c.SourceESAPI.GetDataNodeCount()
+	if err != nil {
+		log.Warn("failed to get data nodes of source cluster, assume all shards are on one node: ", err)
+		return 0
+	}
+	return nodes
+}
+
+/*
+获取索引的主分片总数、单个索引最大的主分片数和文档总数，索引名称可以是通配符或者逗号分隔的列表，获取失败时返回 0。
+*/
+func (c *Migrator) primaryLayout(indexNames string) (int, int, int64) {
+	shards, maxShards := 0, 0
+	settings, err := c.SourceESAPI.GetIndexSettings(indexNames)
+	if err != nil {
+		log.Warnf("failed to get settings of index %s: %v", indexNames, err)
+	} else {
+		for _, n := range primaryShards(settings) {
+			shards += n
+			if n > maxShards {
+				maxShards = n
+			}
+		}
+	}
+
+	var docs int64
+	stats, err := c.SourceESAPI.GetIndexStats(indexNames)
+	if err != nil {
+		log.Warnf("failed to get stats of index %s: %v", indexNames, err)
+	}
+	for _, s := range stats {
+		docs += s.DocsCount
+	}
+	return shards, maxShards, docs
+}
+
+/*从 GetIndexSettings 的结果中读取每个索引的 number_of_shards。*/
+func primaryShards(settings *Indexes) map[string]int {
+	shards := map[string]int{}
+	if settings == nil {
+		return shards
+	}
+	for name, v := range *settings {
+		m, _ := v.(map[string]interface{})
+		s, _ := m["settings"].(map[string]interface{})
+		index, ok := s["index"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(fmt.Sprint(index["number_of_shards"])); err == nil {
+			shards[name] = n
+		}
+	}
+	return shards
+}
+
+/*读取源集群的 search.max_open_scroll_context，transient 优先于 persistent，没有设置时使用默认值。*/
+func (c *Migrator) maxOpenScrollContext() int {
+	settings, err := c.SourceESAPI.GetClusterSettings()
+	if err != nil {
+		log.Warn("failed to get cluster settings, use default max open scroll context: ", err)
+		return defaultMaxOpenScrollContext
+	}
+	if v, ok := settings["search.max_open_scroll_context"]; ok {
+		if n, err := strconv.Atoi(fmt.Sprint(v)); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultMaxOpenScrollContext
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+/*只实现 resolveSlices 用到的接口，索引的主分片数、文档数和集群设置都是固定的*/
+type testLayoutAPI struct {
+	ESAPI
+	shards   map[string]int
+	docs     map[string]int64
+	settings map[string]interface{}
+	nodes    int
+}
+
+func (api *testLayoutAPI) GetDataNodeCount() (int, error) {
+	return api.nodes, nil
+}
+
+func (api *testLayoutAPI) GetIndexSettings(indexNames string) (*Indexes, error) {
+	settings := Indexes{}
+	for _, name := range splitFieldList(indexNames) {
+		settings[name] = map[string]interface{}{"settings": map[string]interface{}{"index": map[string]interface{}{"number_of_shards": api.shards[name]}}}
+	}
+	return &settings, nil
+}
+
+func (api *testLayoutAPI) GetIndexStats(indexNames string) (map[string]IndexStats, error) {
+	stats := map[string]IndexStats{}
+	for _, name := range splitFieldList(indexNames) {
+		stats[name] = IndexStats{DocsCount: api.docs[name]}
+	}
+	return stats, nil
+}
+
+func (api *testLayoutAPI) GetClusterSettings() (map[string]interface{}, error) {
+	return api.settings, nil
+}
+
+func TestSliceSizeFlag(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected SliceSize
+		valid    bool
+	}{
+		{"auto", autoSliceSize, true},
+		{"4", 4, true},
+		{"x", 0, false},
+	}
+	for _, tt := range tests {
+		var s SliceSize
+		err := s.UnmarshalFlag(tt.value)
+		if (err == nil) != tt.valid || tt.valid && s != tt.expected {
+			t.Errorf("%q: got %d, %v", tt.value, s, err)
+			continue
+		}
+		if out, _ := s.MarshalFlag(); tt.valid && out != tt.value {
+			t.Errorf("%q: MarshalFlag() = %q", tt.value, out)
+		}
+	}
+}
+
+func TestResolveSlices(t *testing.T) {
+	api := &testLayoutAPI{
+		shards: map[string]int{"big": 6, "small": 5, "empty": 3, "wide": 200},
+		docs:   map[string]int64{"big": 1000000, "small": 150000, "wide": 100000000},
+	}
+
+	tests := []struct {
+		name     string
+		size     SliceSize
+		settings map[string]interface{}
+		nodes    int
+		indices  []string
+		expected []int
+	}{
+		{"fixed", 4, nil, 3, []string{"big", "small"}, []int{4, 4}},
+		{"fixed below one", 0, nil, 3, []string{"big"}, []int{1}},
+		{"auto", autoSliceSize, nil, 3, []string{"big", "small", "empty"}, []int{6, 2, 1}},
+		{"auto with multiple indices", autoSliceSize, nil, 3, []string{"big,small"}, []int{11}},
+		/*每个 slice 在每个节点上打开 2 个 context，每个计划的预算是 8 个*/
+		{"auto limited by open scroll contexts", autoSliceSize, map[string]interface{}{"search.max_open_scroll_context": "16"}, 3, []string{"big", "small"}, []int{4, 2}},
+		/*200 个分片分布在 4 个节点上，每个 slice 在每个节点上打开 50 个 context*/
+		{"auto with many shards", autoSliceSize, nil, 4, []string{"wide"}, []int{10}},
+		{"auto without node count", autoSliceSize, nil, 0, []string{"wide"}, []int{2}},
+		{"one slice at least", autoSliceSize, map[string]interface{}{"search.max_open_scroll_context": "10"}, 1, []string{"wide"}, []int{1}},
+	}
+
+	for _, tt := range tests {
+		api.settings = tt.settings
+		api.nodes = tt.nodes
+		c := &Migrator{Config: &Config{ScrollSliceSize: tt.size}, SourceESAPI: api}
+		var plans []scrollPlan
+		for _, indices := range tt.indices {
+			plans = append(plans, scrollPlan{indexNames: indices})
+		}
+		c.resolveSlices(plans)
+		for i, plan := range plans {
+			if plan.slices != tt.expected[i] {
+				t.Errorf("%s: %s uses %d slices, expected %d", tt.name, plan.indexNames, plan.slices, tt.expected[i])
+			}
+		}
+	}
+}
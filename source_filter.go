@@ -0,0 +1,195 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+/*
+SourceFilter 用于在客户端过滤 _source 字段。
+1.x 的集群对 _source 的 includes/excludes 支持并不完整，所以 ESAPIV0 不把这些规则发给服务端，
+而是在拿到 scroll 结果之后，由 ProcessScrollResult 调用 Apply 在本地完成过滤。
+字段使用点号分隔的完整路径表示，例如 attachment.content，支持 * 和 ? 通配符。
+*/
+type SourceFilter struct {
+	includes []string
+	excludes []string
+}
+
+/*把逗号分隔的字段列表拆成切片，去掉空白和空项。*/
+func splitFieldList(fields string) []string {
+	var list []string
+	for _, f := range strings.Split(fields, ",") {
+		f = strings.TrimSpace(f)
+		if len(f) > 0 {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+/*判断字段列表里是否存在通配符。*/
+func hasFieldWildcard(fields []string) bool {
+	for _, f := range fields {
+		if strings.ContainsAny(f, "*?") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+构造 scroll 请求体中的 _source 部分，供 5.x 及以上版本使用。
+没有 excludes 且没有通配符时，保持原来的写法（单个字段或字段数组），兼容旧的行为；
+否则使用 {"includes": [...], "excludes": [...]} 的对象写法。返回 nil 表示不需要过滤。
+*/
+func buildSourceFilter(fields, excludeFields string) interface{} {
+	includes := splitFieldList(fields)
+	excludes := splitFieldList(excludeFields)
+
+	if len(includes) == 0 && len(excludes) == 0 {
+		return nil
+	}
+
+	if len(excludes) == 0 && !hasFieldWildcard(includes) {
+		if len(includes) == 1 {
+			return includes[0]
+		}
+		return includes
+	}
+
+	source := map[string]interface{}{}
+	if len(includes) > 0 {
+		source["includes"] = includes
+	}
+	if len(excludes) > 0 {
+		source["excludes"] = excludes
+	}
+	return source
+}
+
+/*
+判断 ESAPIV0 是否需要在客户端过滤 _source：只要有 excludes 或者 includes 里带通配符，就需要。
+*/
+func needClientSourceFilter(fields, excludeFields string) bool {
+	return len(splitFieldList(excludeFields)) > 0 || hasFieldWildcard(splitFieldList(fields))
+}
+
+/*创建客户端 _source 过滤器，没有任何规则时返回 nil。*/
+func NewSourceFilter(fields, excludeFields string) *SourceFilter {
+	filter := &SourceFilter{
+		includes: splitFieldList(fields),
+		excludes: splitFieldList(excludeFields),
+	}
+	if len(filter.includes) == 0 && len(filter.excludes) == 0 {
+		return nil
+	}
+	return filter
+}
+
+/*判断字段路径是否命中任意一个规则。*/
+func matchFieldPath(patterns []string, fieldPath string) bool {
+	for _, p := range patterns {
+		if p == fieldPath {
+			return true
+		}
+		if matched, _ := path.Match(p, fieldPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+/*对一个文档的 _source 先做 includes 再做 excludes，直接修改传入的 map。*/
+func (f *SourceFilter) Apply(source map[string]interface{}) {
+	if f == nil || source == nil {
+		return
+	}
+	if len(f.includes) > 0 {
+		f.include("", source)
+	}
+	if len(f.excludes) > 0 {
+		f.exclude("", source)
+	}
+}
+
+/*
+保留命中 includes 的字段。对象类型的字段如果自身没有命中，就递归检查子字段，子字段全部被过滤掉时连同父字段一起删除。
+数组和 ES 的处理方式一样，对其中的每个对象使用同一个路径，例如 tags.name 会保留 tags 数组中每个对象的 name。
+*/
+func (f *SourceFilter) include(prefix string, obj map[string]interface{}) {
+	for k, v := range obj {
+		fieldPath := k
+		if prefix != "" {
+			fieldPath = prefix + "." + k
+		}
+		if matchFieldPath(f.includes, fieldPath) {
+			continue
+		}
+		if kept, ok := f.includeValue(fieldPath, v); ok {
+			obj[k] = kept
+			continue
+		}
+		delete(obj, k)
+	}
+}
+
+/*过滤没有直接命中的字段值，返回过滤后的值，false 表示整个字段都应该删除*/
+func (f *SourceFilter) includeValue(fieldPath string, v interface{}) (interface{}, bool) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		f.include(fieldPath, value)
+		return value, len(value) > 0
+	case []interface{}:
+		kept := value[:0]
+		for _, item := range value {
+			if item, ok := f.includeValue(fieldPath, item); ok {
+				kept = append(kept, item)
+			}
+		}
+		return kept, len(kept) > 0
+	}
+	return nil, false
+}
+
+/*删除命中 excludes 的字段，对象类型的字段和数组中的对象会继续递归处理。*/
+func (f *SourceFilter) exclude(prefix string, obj map[string]interface{}) {
+	for k, v := range obj {
+		fieldPath := k
+		if prefix != "" {
+			fieldPath = prefix + "." + k
+		}
+		if matchFieldPath(f.excludes, fieldPath) {
+			delete(obj, k)
+			continue
+		}
+		f.excludeValue(fieldPath, v)
+	}
+}
+
+func (f *SourceFilter) excludeValue(fieldPath string, v interface{}) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		f.exclude(fieldPath, value)
+	case []interface{}:
+		for _, item := range value {
+			f.excludeValue(fieldPath, item)
+		}
+	}
+}
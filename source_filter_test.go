@@ -0,0 +1,119 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSourceFilterApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   string
+		excludes string
+		source   string
+		expected string
+	}{
+		{
+			name:     "include top level",
+			fields:   "name",
+			source:   `{"name":"a","age":1}`,
+			expected: `{"name":"a"}`,
+		},
+		{
+			name:     "include nested wildcard",
+			fields:   "user.*",
+			source:   `{"user":{"name":"a","age":1},"other":true}`,
+			expected: `{"user":{"name":"a","age":1}}`,
+		},
+		{
+			name:     "include inside array of objects",
+			fields:   "tags.name",
+			source:   `{"tags":[{"name":"a","id":1},{"name":"b"},{"id":3}],"title":"t"}`,
+			expected: `{"tags":[{"name":"a"},{"name":"b"}]}`,
+		},
+		{
+			name:     "include drops array without matches",
+			fields:   "tags.name",
+			source:   `{"tags":[{"id":1},"x"]}`,
+			expected: `{}`,
+		},
+		{
+			name:     "include whole array",
+			fields:   "tags",
+			source:   `{"tags":["a","b"],"id":1}`,
+			expected: `{"tags":["a","b"]}`,
+		},
+		{
+			name:     "exclude nested",
+			excludes: "attachment.content",
+			source:   `{"attachment":{"content":"x","title":"t"}}`,
+			expected: `{"attachment":{"title":"t"}}`,
+		},
+		{
+			name:     "exclude inside array of objects",
+			excludes: "tags.id",
+			source:   `{"tags":[{"name":"a","id":1},{"id":2}]}`,
+			expected: `{"tags":[{"name":"a"},{}]}`,
+		},
+		{
+			name:     "include then exclude",
+			fields:   "user.*",
+			excludes: "user.password",
+			source:   `{"user":{"name":"a","password":"p"},"x":1}`,
+			expected: `{"user":{"name":"a"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var source, expected map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.source), &source); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.expected), &expected); err != nil {
+				t.Fatal(err)
+			}
+			NewSourceFilter(tt.fields, tt.excludes).Apply(source)
+			if !reflect.DeepEqual(source, expected) {
+				t.Errorf("got %v, expected %v", source, expected)
+			}
+		})
+	}
+}
+
+func TestBuildSourceFilter(t *testing.T) {
+	tests := []struct {
+		fields   string
+		excludes string
+		expected interface{}
+	}{
+		{"", "", nil},
+		{"name", "", "name"},
+		{"name, age", "", []string{"name", "age"}},
+		{"user.*", "", map[string]interface{}{"includes": []string{"user.*"}}},
+		{"", "content", map[string]interface{}{"excludes": []string{"content"}}},
+	}
+
+	for _, tt := range tests {
+		if got := buildSourceFilter(tt.fields, tt.excludes); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("buildSourceFilter(%q, %q) = %v, expected %v", tt.fields, tt.excludes, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/cihub/seelog"
+)
+
+/*
+SpillQueue 是位于 scroll 和 bulk worker 之间的磁盘队列，开启 --spill_dir 时使用。
+目标集群比源集群慢时，DocChan 写满之后的文档按行写入磁盘上的分段文件，scroll 不再被 bulk worker 阻塞，
+可以尽快读完源索引并释放 scroll context；后台的读取协程按顺序读取已经写完的分段，写入 DocChan，读完一个分段就删除。
+磁盘上的总大小超过 --spill_max_size 时，写入端等待，迁移结束后整个目录会被删除。
+*/
+type SpillQueue struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	segments []*spillSegment /*等待读取的分段，最后一个可能正在写入*/
+	writer   *bufio.Writer
+	file     *os.File
+	next     int
+
+	size    int64 /*磁盘上还没有读取完的字节数*/
+	peak    int64
+	spilled int64
+	closed  bool
+}
+
+type spillSegment struct {
+	path   string
+	size   int64
+	sealed bool
+}
+
+/*在 dir 下创建一个本次迁移独占的临时目录，用于保存分段文件。*/
+func NewSpillQueue(dir string, segmentSize, maxSize int64) (*SpillQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir(dir, "esm-spill-")
+	if err != nil {
+		return nil, err
+	}
+	q := &SpillQueue{dir: tmp, segmentSize: segmentSize, maxSize: maxSize}
+	q.cond = sync.NewCond(&q.lock)
+	return q, nil
+}
+
+/*
+把一个文档追加到正在写入的分段，分段写满之后切换到新的分段。
+磁盘上的总大小超过限制时阻塞，直到读取协程删除了已经读完的分段。
+*/
+func (q *SpillQueue) Put(doc map[string]interface{}) error {
+	line, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for q.maxSize > 0 && q.size > 0 && q.size+int64(len(line)) > q.maxSize {
+		q.cond.Wait()
+	}
+
+	current := q.current()
+	if current == nil || current.size >= q.segmentSize {
+		if err := q.seal(); err != nil {
+			return err
+		}
+		path := filepath.Join(q.dir, fmt.Sprintf("segment-%06d.jsonl", q.next))
+		q.next++
+		q.file, err = os.Create(path)
+		if err != nil {
+			return err
+		}
+		q.writer = bufio.NewWriter(q.file)
+		current = &spillSegment{path: path}
+		q.segments = append(q.segments, current)
+	}
+
+	if _, err := q.writer.Write(line); err != nil {
+		return err
+	}
+	current.size += int64(len(line))
+	q.size += int64(len(line))
+	q.spilled++
+	if q.size > q.peak {
+		q.peak = q.size
+	}
+	q.cond.Broadcast()
+	return nil
+}
+
+/*正在写入的分段，没有时返回 nil，调用时需要持有锁。*/
+func (q *SpillQueue) current() *spillSegment {
+	if len(q.segments) == 0 {
+		return nil
+	}
+	last := q.segments[len(q.segments)-1]
+	if last.sealed {
+		return nil
+	}
+	return last
+}
+
+/*结束正在写入的分段，之后它可以被读取，调用时需要持有锁。*/
+func (q *SpillQueue) seal() error {
+	current := q.current()
+	if current == nil {
+		return nil
+	}
+	current.sealed = true
+	if err := q.writer.Flush(); err != nil {
+		return err
+	}
+	return q.file.Close()
+}
+
+/*磁盘上是否没有等待读取的文档。*/
+func (q *SpillQueue) Empty() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.segments) == 0
+}
+
+/*所有的读取端都已经结束，读取协程读完剩余的分段之后关闭 DocChan。*/
+func (q *SpillQueue) Close() {
+	q.lock.Lock()
+	q.closed = true
+	q.lock.Unlock()
+	q.cond.Broadcast()
+}
+
+/*
+删除临时目录，在队列创建之后立即通过 defer 注册，迁移提前结束时也不会在 --spill_dir 下留下分段文件。
+正常结束时读取协程已经删除过，这里什么都不做。
+*/
+func (q *SpillQueue) Remove() {
+	if q == nil {
+		return
+	}
+	if err := os.RemoveAll(q.dir); err != nil {
+		log.Error("failed to remove spill dir: ", err)
+	}
+}
+
+/*
+等待下一个可以读取的分段。没有写完的分段时，如果正在写入的分段有数据就提前结束它，避免 bulk worker 空等；
+读取端已经结束并且没有剩余的分段时返回 nil。
+*/
+func (q *SpillQueue) nextSegment() (*spillSegment, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for {
+		if len(q.segments) > 0 {
+			if !q.segments[0].sealed && q.segments[0].size > 0 {
+				if err := q.seal(); err != nil {
+					return nil, err
+				}
+			}
+			if q.segments[0].sealed {
+				return q.segments[0], nil
+			}
+		}
+		if q.closed && len(q.segments) == 0 {
+			return nil, nil
+		}
+		q.cond.Wait()
+	}
+}
+
+/*删除已经读完的分段，唤醒等待磁盘空间的写入端。*/
+func (q *SpillQueue) remove(segment *spillSegment) {
+	os.Remove(segment.path)
+	q.lock.Lock()
+	q.segments = q.segments[1:]
+	q.size -= segment.size
+	q.lock.Unlock()
+	q.cond.Broadcast()
+}
+
+/*
+读取协程：按顺序读取分段中的文档写入 DocChan，DocChan 满了就等待 bulk worker。
+所有分段读完并且读取端已经结束之后，关闭 DocChan 并删除临时目录。
+无法读取的分段和无法解码的文档和 scroll 出错一样计入 ScrollErrors，迁移结束时以非 0 状态退出。
+*/
+func (q *SpillQueue) Run(c *Migrator) {
+	defer os.RemoveAll(q.dir)
+	defer close(c.DocChan)
+
+	for {
+		segment, err := q.nextSegment()
+		if err != nil {
+			c.scrollFailed("failed to read spill segment: %v", err)
+			return
+		}
+		if segment == nil {
+			break
+		}
+		if err := q.readSegment(c, segment.path); err != nil {
+			c.scrollFailed("failed to read spill segment %s: %v", segment.path, err)
+		}
+		q.remove(segment)
+	}
+
+	q.lock.Lock()
+	spilled, peak := q.spilled, q.peak
+	q.lock.Unlock()
+	if spilled > 0 {
+		log.Infof("%d documents were spilled to disk, peak disk usage: %.1fMB", spilled, float64(peak)/1024/1024)
+	}
+}
+
+/*读取一个分段中的所有文档，_source 是否保持为原始的 JSON 由 decodeHit 决定，无法解码的文档计入 ScrollErrors。*/
+func (q *SpillQueue) readSegment(c *Migrator, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			hit := map[string]json.RawMessage{}
+			if e := json.Unmarshal(line, &hit); e != nil {
+				c.scrollFailed("invalid spilled document in %s: %v", path, e)
+			} else if doc, e := c.decodeHit(hit); e != nil {
+				c.scrollFailed("invalid spilled document in %s: %v", path, e)
+			} else {
+				c.pushDoc(doc)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*开启 --spill_dir 时为当前的 DocChan 创建磁盘队列，并启动读取协程。*/
+func (c *Migrator) startSpill() error {
+	if len(c.Config.SpillDir) == 0 {
+		return nil
+	}
+	q, err := NewSpillQueue(c.Config.SpillDir, int64(c.Config.SpillSegmentSizeInMB)*1024*1024, int64(c.Config.SpillMaxSizeInMB)*1024*1024)
+	if err != nil {
+		return err
+	}
+	log.Debug("spill documents to ", q.dir)
+	c.Spill = q
+	go q.Run(c)
+	return nil
+}
+
+/*读取端结束时调用，使用磁盘队列时由读取协程在读完所有分段之后关闭 DocChan。*/
+func (c *Migrator) closeDocChan() {
+	if c.Spill != nil {
+		c.Spill.Close()
+		return
+	}
+	close(c.DocChan)
+}
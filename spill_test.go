@@ -0,0 +1,144 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpillQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esm-spill-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name        string
+		docs        int
+		segmentSize int64
+	}{
+		{"empty", 0, 1024},
+		{"one segment", 5, 1024 * 1024},
+		{"many segments", 50, 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewSpillQueue(dir, tt.segmentSize, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &Migrator{Config: &Config{}, DocChan: make(chan map[string]interface{}, tt.docs+1), Spill: q}
+
+			for i := 0; i < tt.docs; i++ {
+				doc := map[string]interface{}{"_index": "a", "_id": fmt.Sprint(i), "_source": map[string]interface{}{"n": i}}
+				if err := q.Put(doc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c.closeDocChan()
+			q.Run(c)
+
+			i := 0
+			for doc := range c.DocChan {
+				if doc["_id"] != fmt.Sprint(i) {
+					t.Errorf("doc %d has id %v", i, doc["_id"])
+				}
+				i++
+			}
+			if i != tt.docs {
+				t.Errorf("got %d docs, expected %d", i, tt.docs)
+			}
+			if _, err := os.Stat(q.dir); !os.IsNotExist(err) {
+				t.Errorf("spill dir %s was not removed", q.dir)
+			}
+		})
+	}
+}
+
+func TestSpillQueueRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esm-spill-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewSpillQueue(dir, 1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Put(map[string]interface{}{"_id": "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	/*没有读取就结束时，Remove 删除临时目录*/
+	q.Remove()
+	if _, err := os.Stat(q.dir); !os.IsNotExist(err) {
+		t.Errorf("spill dir %s was not removed", q.dir)
+	}
+
+	var nilQueue *SpillQueue
+	nilQueue.Remove()
+}
+
+func TestSpillQueueErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esm-spill-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	/*无法解码的文档被跳过并计入 ScrollErrors*/
+	q, err := NewSpillQueue(dir, 1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(q.dir, "broken.jsonl")
+	content := `{"_index":"a","_id":"1","_source":{}}` + "\n" + `{"_index":` + "\n" + `{"_index":"a","_id":"2","_source":[1]}` + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Migrator{Config: &Config{RenameFields: "a:b"}, DocChan: make(chan map[string]interface{}, 10)}
+	if err := q.readSegment(c, path); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.DocChan) != 1 || c.ScrollErrors != 2 {
+		t.Errorf("got %d docs and %d errors, expected 1 and 2", len(c.DocChan), c.ScrollErrors)
+	}
+	q.Remove()
+
+	/*分段文件丢失时，整个分段计为一次错误*/
+	q, err = NewSpillQueue(dir, 1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = &Migrator{Config: &Config{}, DocChan: make(chan map[string]interface{}, 10), Spill: q}
+	if err := q.Put(map[string]interface{}{"_index": "a", "_id": "1", "_source": map[string]interface{}{}}); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(q.segments[0].path)
+	c.closeDocChan()
+	q.Run(c)
+	if len(c.DocChan) != 0 || c.ScrollErrors != 1 {
+		t.Errorf("got %d docs and %d errors, expected 0 and 1", len(c.DocChan), c.ScrollErrors)
+	}
+}
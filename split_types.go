@@ -0,0 +1,161 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+/*
+TypeSplitter 把一个多 type 的索引拆分成每个 type 一个索引，用于从 5.x 及以下版本迁移到只支持单个 type 的 6.x/7.x。
+目标索引的名称由 --split_types_index 的对照表决定，没有找到时使用 --split_types_pattern，例如 {index}-{type}。
+拆分之后所有文档使用同一个 type 名称，原来的 type 可以通过 --type_field 保存在文档的字段中。
+*/
+type TypeSplitter struct {
+	pattern   string
+	table     map[string]string
+	typeName  string
+	typeField string
+}
+
+/*创建 TypeSplitter，typeName 是拆分之后使用的 type 名称，6.x 为 doc，7.x 为 _doc，--type_override 优先。*/
+func NewTypeSplitter(c *Config, typeName string) *TypeSplitter {
+	pattern := c.SplitTypesPattern
+	if len(pattern) == 0 {
+		pattern = "{index}-{type}"
+	}
+	return &TypeSplitter{
+		pattern:   pattern,
+		table:     c.SplitTypesIndex,
+		typeName:  typeName,
+		typeField: c.TypeField,
+	}
+}
+
+/*
+根据索引名称和 type 得到拆分之后的索引名称。
+对照表中先查找 索引/type，再查找 type，都没有时使用 pattern，索引名称只能是小写，所以结果会转换成小写。
+*/
+func (s *TypeSplitter) IndexName(index, typ string) string {
+	if name, ok := s.table[index+"/"+typ]; ok {
+		return name
+	}
+	if name, ok := s.table[typ]; ok {
+		return name
+	}
+	name := strings.Replace(s.pattern, "{index}", index, -1)
+	name = strings.Replace(name, "{type}", typ, -1)
+	return strings.ToLower(name)
+}
+
+/*把文档写到 type 对应的索引中，index 是拆分之前的目标索引名称。*/
+func (s *TypeSplitter) Apply(doc *Document, index, sourceType string) {
+	if s == nil {
+		return
+	}
+	doc.Index = s.IndexName(index, sourceType)
+	doc.Type = s.typeName
+	if len(s.typeField) > 0 {
+		source, err := doc.sourceMap()
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		source[s.typeField] = sourceType
+	}
+}
+
+/*
+为源索引中的每个 type 创建对应的目标索引，mapping 使用该 type 在 GetIndexMappings 中的 mapping。
+sourceSettings 不为 nil 时（--copy_settings），同时复制源索引的 settings；shards 大于 0 时覆盖分片数。
+renameIndex 是 -y 指定的目标索引名称，只有一个源索引时用来替换 {index}。
+6.x 的 mapping 需要带上 type 名称，7.x 不需要。
+*/
+func (s *TypeSplitter) CreateIndices(api ESAPI, sourceMappings, sourceSettings *Indexes, renameIndex string, shards int, recreate bool, includeTypeName bool) {
+	if s == nil || sourceMappings == nil {
+		return
+	}
+
+	for index, idx := range *sourceMappings {
+		types, ok := idx.(map[string]interface{})["mappings"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		targetIndex := index
+		if len(renameIndex) > 0 && len(*sourceMappings) == 1 {
+			targetIndex = renameIndex
+		}
+
+		for typ, m := range types {
+			if typ == "_default_" {
+				continue
+			}
+			mapping, ok := m.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			name := s.IndexName(targetIndex, typ)
+
+			/*1.x 到 5.x 特有的 _parent，在 6.x 及以上版本中不再支持*/
+			delete(mapping, "_parent")
+			if len(s.typeField) > 0 {
+				properties, ok := mapping["properties"].(map[string]interface{})
+				if !ok {
+					properties = map[string]interface{}{}
+					mapping["properties"] = properties
+				}
+				properties[s.typeField] = map[string]interface{}{"type": "keyword"}
+			}
+
+			settings := getEmptyIndexSettings()
+			if sourceSettings != nil {
+				if src, ok := (*sourceSettings)[index].(map[string]interface{}); ok {
+					if indexSettings, ok := src["settings"].(map[string]interface{})["index"].(map[string]interface{}); ok {
+						for k, v := range indexSettings {
+							settings["settings"].(map[string]interface{})["index"].(map[string]interface{})[k] = v
+						}
+					}
+				}
+			}
+			if shards > 0 {
+				settings["settings"].(map[string]interface{})["index"].(map[string]interface{})["number_of_shards"] = shards
+			}
+
+			if includeTypeName {
+				settings["mappings"] = map[string]interface{}{s.typeName: mapping}
+			} else {
+				settings["mappings"] = mapping
+			}
+
+			if recreate {
+				api.DeleteIndex(name)
+			} else if _, err := api.GetIndexSettings(name); err == nil {
+				log.Infof("index %s already exists, skip creating it for type %s", name, typ)
+				continue
+			}
+
+			log.Infof("split type %s of index %s into index %s", typ, index, name)
+			if err := api.CreateIndex(name, settings); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestTypeSplitterIndexName(t *testing.T) {
+	s := NewTypeSplitter(&Config{SplitTypesIndex: map[string]string{"shop/user": "users", "order": "orders"}}, "_doc")
+
+	tests := []struct {
+		index, typ, expected string
+	}{
+		{"shop", "user", "users"},
+		{"shop", "order", "orders"},
+		{"Shop", "Item", "shop-item"},
+		{"other", "user", "other-user"},
+	}
+	for _, tt := range tests {
+		if got := s.IndexName(tt.index, tt.typ); got != tt.expected {
+			t.Errorf("IndexName(%q, %q) = %q, expected %q", tt.index, tt.typ, got, tt.expected)
+		}
+	}
+
+	s = NewTypeSplitter(&Config{SplitTypesPattern: "{type}_{index}"}, "doc")
+	if got := s.IndexName("shop", "user"); got != "user_shop" {
+		t.Errorf("IndexName with pattern = %q", got)
+	}
+}
+
+func TestTypeSplitterApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		typeField string
+		doc       Document
+		source    map[string]interface{}
+	}{
+		{"without type field", "", Document{rawSource: json.RawMessage(`{"a":1}`)}, nil},
+		{"decoded source", "type", Document{source: map[string]interface{}{"a": "x"}}, map[string]interface{}{"a": "x", "type": "user"}},
+		{"raw source", "type", Document{rawSource: json.RawMessage(`{"a":"y"}`)}, map[string]interface{}{"a": "y", "type": "user"}},
+		{"no source", "type", Document{}, map[string]interface{}{"type": "user"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewTypeSplitter(&Config{TypeField: tt.typeField}, "_doc")
+			doc := tt.doc
+			s.Apply(&doc, "shop", "user")
+			if doc.Index != "shop-user" || doc.Type != "_doc" {
+				t.Errorf("index = %q, type = %q", doc.Index, doc.Type)
+			}
+			if tt.source == nil {
+				if doc.rawSource == nil {
+					t.Errorf("raw source was decoded")
+				}
+				return
+			}
+			if doc.rawSource != nil || !reflect.DeepEqual(doc.source, tt.source) {
+				t.Errorf("source = %v, expected %v", doc.source, tt.source)
+			}
+		})
+	}
+}
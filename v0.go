@@ -24,6 +24,8 @@ import (
 	"io"
 	"io/ioutil"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	log "github.com/cihub/seelog"
@@ -34,6 +36,7 @@ type ESAPIV0 struct {
 	Auth      *Auth  //eg: user:pass
 	HttpProxy string //eg: http://proxyIp:proxyPort
 	Compress  bool
+	Sampler   *DocSampler /*源集群是 5.x 及以上版本时，NewScroll 使用它生成采样查询*/
 }
 
 /*获取 Elasticsearch 集群的健康状况。*/
@@ -76,13 +79,13 @@ func (s *ESAPIV0) ClusterHealth() *ClusterHealth {
 
 /*
 	这段代码是一个名为 Bulk 的函数，它是 ESAPIV0 结构体的一个方法。
-	该方法接受一个 *bytes.Buffer 类型的参数
+	该方法接受一个 *bytes.Buffer 类型的参数，返回解析后的 bulk 响应，供调用方统计耗时、拒绝等信息
 */
-func (s *ESAPIV0) Bulk(data *bytes.Buffer) {
+func (s *ESAPIV0) Bulk(data *bytes.Buffer) (*BulkResponse, error) {
 	/*如果该参数为空或长度为0，则跳过该函数*/
 	if data == nil || data.Len() == 0 {
 		log.Trace("data is empty, skip")
-		return
+		return nil, nil
 	}
 	/*
 		否则，该函数会在数据末尾写入一个换行符，并将请求发送到 _bulk 端点。
@@ -97,7 +100,7 @@ func (s *ESAPIV0) Bulk(data *bytes.Buffer) {
 
 	if err != nil {
 		log.Error(err)
-		return
+		return nil, err
 	}
 	/*BulkResponse{} 是一个结构体，是用于解析 Elasticsearch 返回的 bulk API 的响应的*/
 	response := BulkResponse{}
@@ -105,13 +108,14 @@ func (s *ESAPIV0) Bulk(data *bytes.Buffer) {
 	/*如果请求成功，*/
 	if err == nil {
 		/*则会解码响应并检查是否存在错误*/
-		if response.Errors {
+		if response.Errors || response.Error != nil {
 			/*如果存在错误，则会打印响应体*/
 			fmt.Println(body)
 		}
 	}
 	/*最后，该函数会重置数据缓冲区。*/
 	data.Reset()
+	return &response, err
 }
 
 /*
@@ -490,6 +494,122 @@ func (s *ESAPIV0) Refresh(name string) (err error) {
 }
 
 
+/*
+获取索引主分片的文档数和存储大小，1.x 到 7.x 的 _stats 接口格式相同：
+{"indices": {"index": {"primaries": {"docs": {"count": 1}, "store": {"size_in_bytes": 1}}}}}
+*/
+func (s *ESAPIV0) GetIndexStats(indexNames string) (map[string]IndexStats, error) {
+	url := fmt.Sprintf("%s/%s/_stats/docs,store", s.Host, indexNames)
+	resp, body, errs := Get(url, s.Auth, s.HttpProxy)
+
+	if resp != nil && resp.Body != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		defer resp.Body.Close()
+	}
+
+	if errs != nil {
+		log.Error(errs)
+		return nil, errs[0]
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New(body)
+	}
+
+	response := struct {
+		Indices map[string]struct {
+			Primaries struct {
+				Docs struct {
+					Count int64 `json:"count"`
+				} `json:"docs"`
+				Store struct {
+					SizeInBytes int64 `json:"size_in_bytes"`
+				} `json:"store"`
+			} `json:"primaries"`
+		} `json:"indices"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return nil, err
+	}
+
+	stats := map[string]IndexStats{}
+	for name, idx := range response.Indices {
+		stats[name] = IndexStats{
+			DocsCount:        idx.Primaries.Docs.Count,
+			StoreSizeInBytes: idx.Primaries.Store.SizeInBytes,
+		}
+	}
+	return stats, nil
+}
+
+/*使用 _count 接口获取索引中的文档数量，和 _stats 不同，nested 文档不会被重复计算。*/
+func (s *ESAPIV0) Count(indexNames string) (int64, error) {
+	url := fmt.Sprintf("%s/%s/_count", s.Host, indexNames)
+	resp, body, errs := Get(url, s.Auth, s.HttpProxy)
+
+	if resp != nil && resp.Body != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		defer resp.Body.Close()
+	}
+
+	if errs != nil {
+		log.Error(errs)
+		return 0, errs[0]
+	}
+
+	if resp.StatusCode != 200 {
+		return 0, errors.New(body)
+	}
+
+	response := struct {
+		Count int64 `json:"count"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return 0, err
+	}
+	return response.Count, nil
+}
+
+/*
+获取集群设置，flat_settings 从 1.x 开始支持，返回的 key 形如 search.max_open_scroll_context。
+persistent 和 transient 合并在一起，transient 优先。
+*/
+func (s *ESAPIV0) GetClusterSettings() (map[string]interface{}, error) {
+	url := fmt.Sprintf("%s/_cluster/settings?flat_settings=true", s.Host)
+	resp, body, errs := Get(url, s.Auth, s.HttpProxy)
+
+	if resp != nil && resp.Body != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		defer resp.Body.Close()
+	}
+
+	if errs != nil {
+		log.Error(errs)
+		return nil, errs[0]
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New(body)
+	}
+
+	response := struct {
+		Persistent map[string]interface{} `json:"persistent"`
+		Transient  map[string]interface{} `json:"transient"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return nil, err
+	}
+
+	settings := map[string]interface{}{}
+	for k, v := range response.Persistent {
+		settings[k] = v
+	}
+	for k, v := range response.Transient {
+		settings[k] = v
+	}
+	return settings, nil
+}
+
 /*
 	这段代码是一个用于创建 Elasticsearch 滚动查询（scroll query）的函数，它使用了 Elasticsearch 的搜索 API，查询符合特定条件的文档并返回一个指向查询结果的“指针”，
 	之后可以使用这个指针来一次次地从 Elasticsearch 中获取查询结果，直到没有结果为止。
@@ -497,12 +617,14 @@ func (s *ESAPIV0) Refresh(name string) (err error) {
 		indexNames：string 数据类型，指定用于查询的 Elasticsearch 索引名称，可以指定一个或多个索引名称，多个名称之间用逗号分隔。
 		scrollTime: string 数据类型，指定查询结果被缓存的时间，以便后续的滚动查询能够使用同一个缓存。可以设置为秒（s）或分钟（m），如 "10m"。
 		docBufferCount：int 数据类型，指定每次获取查询结果时获取多少个文档。
-		query：string 类型，指定查询的条件，可以使用 Elasticsearch 的 Query DSL 进行更复杂的查询。如果不传递该参数，会查询索引中的所有文档。
+		query：map 类型，查询条件的 Query DSL，由 --query 和 --query_file 组合而成。如果为 nil，会查询索引中的所有文档。
 		slicedId: int 类型，表示当前搜索操作的分片 ID。通过这个参数，我们可以在分片搜索过程中将搜索操作分割成多个并发任务，从而提高搜索的效率和响应速度。
 		maxSlicedCount: int 类型，表示搜索操作涉及的分片总数。通过这个参数，我们可以在分片搜索过程中将搜索操作分割成多个并发任务，从而提高搜索的效率和响应速度。
 		fields：string 类型，指定要返回的字段名称，可以指定多个字段，之间用逗号分隔。如果不传递该参数，会返回所有字段。
+		excludeFields：string 类型，指定要排除的字段名称，多个字段之间用逗号分隔。1.x 不在服务端排除，由客户端的 SourceFilter 处理。
+		version：bool 类型，是否在每个 hit 中返回 _version，用于 --preserve_version。
 */
-func (s *ESAPIV0) NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, slicedId, maxSlicedCount int, fields string) (scroll interface{}, err error) {
+func (s *ESAPIV0) NewScroll(indexNames string, scrollTime string, docBufferCount int, query map[string]interface{}, slicedId, maxSlicedCount int, fields, excludeFields string, version bool) (scroll interface{}, err error) {
 
 	// curl -XGET 'http://es-0.9:9200/_search?search_type=scan&scroll=10m&size=50'
 	/*
@@ -513,13 +635,28 @@ func (s *ESAPIV0) NewScroll(indexNames string, scrollTime string, docBufferCount
 	*/
 	url := fmt.Sprintf("%s/%s/_search?search_type=scan&scroll=%s&size=%d", s.Host, indexNames, scrollTime, docBufferCount)
 
+	/*
+		1.x/2.x 不支持 sliced scroll，多个 slice 时每个 scroll 通过 preference=_shards 只读取一部分分片，
+		编号对 maxSlicedCount 取余等于 slicedId 的分片属于这个 slice。
+	*/
+	if maxSlicedCount > 1 {
+		shards, err := s.sliceShards(indexNames, slicedId, maxSlicedCount)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		log.Tracef("shard scroll, %d of %d, shards: %s", slicedId, maxSlicedCount, shards)
+		url = fmt.Sprintf("%s&preference=_shards:%s", url, shards)
+	}
+
 	/*在 go 语言中，[]byte 是表示字节切片的数据类型，通常用于处理二进制数据或者字符数据。这里指定jsonBody 数据类型为 字节切片，通过 go 内置的标准函数，避免程序员手动进行转换。*/
 	var jsonBody []byte
 	
 	/*这段代码，将 fields 和 query 转换为对应的 Elasticsearch 查询语句。*/
-	if len(query) > 0 || len(fields) > 0 {
+	if len(query) > 0 || len(fields) > 0 || version {
 		queryBody := map[string]interface{}{}
-		if len(fields) > 0 {
+		/*fields 里带通配符时，服务端不做过滤，全部交给客户端的 SourceFilter 处理。*/
+		if len(fields) > 0 && !hasFieldWildcard(splitFieldList(fields)) {
 			if !strings.Contains(fields, ",") {
 				/*判断 fields 是否只有一个字段，如果只有一个字段，则 queryBody["_source"] = fields*/
 				queryBody["_source"] = fields
@@ -530,9 +667,11 @@ func (s *ESAPIV0) NewScroll(indexNames string, scrollTime string, docBufferCount
 		}
 
 		if len(query) > 0 {
-			queryBody["query"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"].(map[string]interface{})["query"] = query
+			queryBody["query"] = query
+		}
+
+		if version {
+			queryBody["version"] = true
 		}
 
 		jsonBody, err = json.Marshal(queryBody)
@@ -543,14 +682,14 @@ func (s *ESAPIV0) NewScroll(indexNames string, scrollTime string, docBufferCount
 
 	}
 	//resp, body, errs := Post(url, s.Auth,jsonBody,s.HttpProxy)
-	body, err := DoRequest(s.Compress, "POST", url, s.Auth, jsonBody, s.HttpProxy)
+	/*第一页和之后的页一样流式读取，这里只读取到文档数组的开头，文档由 ProcessScrollResult 读取*/
+	body, err := DoStreamRequest(s.Compress, "POST", url, s.Auth, jsonBody, s.HttpProxy)
 	if err != nil {
 		log.Error(err)
 		return nil, err
 	}
 
-	scroll = &Scroll{}
-	err = DecodeJson(body, scroll)
+	scroll, err = newStreamedScroll(body)
 	if err != nil {
 		log.Error(err)
 		return nil, err
@@ -559,6 +698,49 @@ func (s *ESAPIV0) NewScroll(indexNames string, scrollTime string, docBufferCount
 	return scroll, err
 }
 
+/*
+流式读取下一页 scroll 结果，1.x 到 7.x 的 scroll 接口相同，hits.total 的格式差异在解码时处理。
+响应体边读边解码，每读取出一个文档就交给 onHit，一页的文档不会同时留在内存里。
+请求失败时返回的 page 为 nil，响应读取到一半出错时返回已经读取的部分。
+*/
+func (s *ESAPIV0) StreamScroll(scrollTime string, scrollId string, onHit func(hit map[string]json.RawMessage)) (*ScrollPage, error) {
+	url := fmt.Sprintf("%s/_search/scroll?scroll=%s&scroll_id=%s", s.Host, scrollTime, scrollId)
+	body, err := DoStreamRequest(s.Compress, "GET", url, s.Auth, nil, s.HttpProxy)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return decodeScrollStream(body, onHit)
+}
+
+/*
+计算第 slicedId 个 slice 需要读取的分片编号，多个索引的分片数不同时按最大的分片数分配，
+不存在的分片编号会被 Elasticsearch 忽略。
+*/
+func (s *ESAPIV0) sliceShards(indexNames string, slicedId, maxSlicedCount int) (string, error) {
+	settings, err := s.GetIndexSettings(indexNames)
+	if err != nil {
+		return "", err
+	}
+
+	maxShards := 0
+	for _, n := range primaryShards(settings) {
+		if n > maxShards {
+			maxShards = n
+		}
+	}
+
+	var shards []string
+	for shard := slicedId; shard < maxShards; shard += maxSlicedCount {
+		shards = append(shards, strconv.Itoa(shard))
+	}
+	if len(shards) == 0 {
+		return "", fmt.Errorf("slice %d of %d has no shards, index %s only has %d primary shards", slicedId, maxSlicedCount, indexNames, maxShards)
+	}
+	return strings.Join(shards, ","), nil
+}
+
 /*这段代码，主要是用于获取 Elasticsearch 的 Scoll API 的下一页数据。*/
 func (s *ESAPIV0) NextScroll(scrollTime string, scrollId string) (interface{}, error) {
 	//  curl -XGET 'http://es-0.9:9200/_search/scroll?scroll=5m'
@@ -582,3 +764,188 @@ func (s *ESAPIV0) NextScroll(scrollTime string, scrollId string) (interface{}, e
 
 	return scroll, nil
 }
+
+/*
+从 _nodes/stats/fs 读取每个数据节点的磁盘可用空间。
+5.x 以上通过 roles 判断是否是数据节点，1.x/2.x 通过 attributes.data 判断，没有这些字段时都算作数据节点。
+*/
+func (s *ESAPIV0) dataNodesAvailable() ([]int64, error) {
+	url := fmt.Sprintf("%s/_nodes/stats/fs", s.Host)
+	resp, body, errs := Get(url, s.Auth, s.HttpProxy)
+
+	if resp != nil && resp.Body != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		defer resp.Body.Close()
+	}
+
+	if errs != nil {
+		log.Error(errs)
+		return nil, errs[0]
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New(body)
+	}
+
+	response := struct {
+		Nodes map[string]struct {
+			Roles      []string          `json:"roles"`
+			Attributes map[string]string `json:"attributes"`
+			Fs         struct {
+				Total struct {
+					AvailableInBytes int64 `json:"available_in_bytes"`
+				} `json:"total"`
+			} `json:"fs"`
+		} `json:"nodes"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return nil, err
+	}
+
+	var available []int64
+	for _, node := range response.Nodes {
+		if node.Attributes["data"] == "false" {
+			continue
+		}
+		if node.Roles != nil {
+			data := false
+			for _, role := range node.Roles {
+				if strings.HasPrefix(role, "data") {
+					data = true
+				}
+			}
+			if !data {
+				continue
+			}
+		}
+		available = append(available, node.Fs.Total.AvailableInBytes)
+	}
+	return available, nil
+}
+
+/*所有数据节点的磁盘可用空间之和*/
+func (s *ESAPIV0) GetDiskAvailable() (int64, error) {
+	nodes, err := s.dataNodesAvailable()
+	if err != nil {
+		return 0, err
+	}
+	var available int64
+	for _, n := range nodes {
+		available += n
+	}
+	return available, nil
+}
+
+func (s *ESAPIV0) GetDataNodeCount() (int, error) {
+	nodes, err := s.dataNodesAvailable()
+	return len(nodes), err
+}
+
+/*从 _nodes/plugins 读取插件列表，只返回每个节点上都安装了的插件。*/
+func (s *ESAPIV0) GetPlugins() ([]string, error) {
+	url := fmt.Sprintf("%s/_nodes/plugins", s.Host)
+	resp, body, errs := Get(url, s.Auth, s.HttpProxy)
+
+	if resp != nil && resp.Body != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		defer resp.Body.Close()
+	}
+
+	if errs != nil {
+		log.Error(errs)
+		return nil, errs[0]
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New(body)
+	}
+
+	response := struct {
+		Nodes map[string]struct {
+			Plugins []struct {
+				Name string `json:"name"`
+			} `json:"plugins"`
+		} `json:"nodes"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return nil, err
+	}
+
+	installed := map[string]int{}
+	for _, node := range response.Nodes {
+		for _, plugin := range node.Plugins {
+			installed[plugin.Name]++
+		}
+	}
+	var plugins []string
+	for name, nodes := range installed {
+		if nodes == len(response.Nodes) {
+			plugins = append(plugins, name)
+		}
+	}
+	sort.Strings(plugins)
+	return plugins, nil
+}
+
+/*
+提交 _reindex 请求，wait_for_completion=false 时集群立即返回任务 ID：{"task": "node:1234"}。
+*/
+func (s *ESAPIV0) Reindex(body map[string]interface{}) (string, error) {
+	url := fmt.Sprintf("%s/_reindex?wait_for_completion=false", s.Host)
+
+	data := bytes.Buffer{}
+	if err := json.NewEncoder(&data).Encode(body); err != nil {
+		return "", err
+	}
+	res, err := Request("POST", url, s.Auth, &data, s.HttpProxy)
+	if err != nil {
+		return "", err
+	}
+
+	response := struct {
+		Task string `json:"task"`
+	}{}
+	if err := json.Unmarshal([]byte(res), &response); err != nil {
+		return "", err
+	}
+	if len(response.Task) == 0 {
+		return "", errors.New("no task id in reindex response: " + res)
+	}
+	return response.Task, nil
+}
+
+/*
+通过 _tasks 接口获取任务的状态，5.x 以上的格式相同：
+{"completed": false, "task": {"status": {"total": 1, "created": 1, ...}, "cancelled": false}, "response": {...}, "error": {...}}
+*/
+func (s *ESAPIV0) GetTask(taskId string) (*ReindexTask, error) {
+	url := fmt.Sprintf("%s/_tasks/%s", s.Host, taskId)
+	resp, body, errs := Get(url, s.Auth, s.HttpProxy)
+
+	if resp != nil && resp.Body != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		defer resp.Body.Close()
+	}
+
+	if errs != nil {
+		log.Error(errs)
+		return nil, errs[0]
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New(body)
+	}
+
+	task := &ReindexTask{}
+	if err := json.Unmarshal([]byte(body), task); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+/*取消任务，reindex 会在当前批次写完之后停止。*/
+func (s *ESAPIV0) CancelTask(taskId string) error {
+	url := fmt.Sprintf("%s/_tasks/%s/_cancel", s.Host, taskId)
+	_, err := Request("POST", url, s.Auth, &bytes.Buffer{}, s.HttpProxy)
+	return err
+}
@@ -20,7 +20,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"strings"
 
 	log "github.com/cihub/seelog"
 )
@@ -33,8 +32,8 @@ func (s *ESAPIV5) ClusterHealth() *ClusterHealth {
 	return s.ESAPIV0.ClusterHealth()
 }
 
-func (s *ESAPIV5) Bulk(data *bytes.Buffer) {
-	s.ESAPIV0.Bulk(data)
+func (s *ESAPIV5) Bulk(data *bytes.Buffer) (*BulkResponse, error) {
+	return s.ESAPIV0.Bulk(data)
 }
 
 func (s *ESAPIV5) GetIndexSettings(indexNames string) (*Indexes, error) {
@@ -71,41 +70,45 @@ func (s *ESAPIV5) Refresh(name string) (err error) {
 		indexNames: string数据类型，用于表示索引名称。
 		scrollTime: string数据类型，用于表示滚动时间。
 		docBufferCount: int数据类型，文档缓冲区大小。
-		query: string数据类型，用于表示查询。
+		query: map数据类型，用于表示查询的 Query DSL。
 		slicedId: int数据类型，用于表示切片ID。
 		maxSlicedCount: int数据类型，用于表示最大切片数。
 		fields: string数据类型，用于表示字段。
 
 */
-func (s *ESAPIV5) NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, slicedId, maxSlicedCount int, fields string) (scroll interface{}, err error) {
+func (s *ESAPIV5) NewScroll(indexNames string, scrollTime string, docBufferCount int, query map[string]interface{}, slicedId, maxSlicedCount int, fields, excludeFields string, version bool) (scroll interface{}, err error) {
 
 	/*这段代码用来构建 Elasticsearch Scroll API 的 URL 的。*/
 	url := fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d", s.Host, indexNames, scrollTime, docBufferCount)
 
+	/*--sample_rate 时在查询外面包一层 random_score，由服务端完成采样*/
+	query = s.Sampler.scrollQuery(query, "")
+
 	var jsonBody []byte
 
 	/*判断是否有查询条件，是否有限制返回数据的数量，是否有需要返回的字段*/
-	if len(query) > 0 || maxSlicedCount > 0 || len(fields) > 0 {
+	if len(query) > 0 || maxSlicedCount > 0 || len(fields) > 0 || len(excludeFields) > 0 || version {
 		queryBody := map[string]interface{}{}
 
-		/*返回字段*/
-		if len(fields) > 0 {
-			/*如果 fields 是不包含由逗号分隔的字符串，它将被设置为 _source 查询参数的值*/
-			if !strings.Contains(fields, ",") {
-				queryBody["_source"] = fields
-			} else {
-				/*否则，字段名是一个由逗号分隔的字符串，则它将拆分成一个字符串切片，并赋值给 _source*/
-				queryBody["_source"] = strings.Split(fields, ",")
-			}
+		/*
+			返回字段，fields 是需要返回的字段，excludeFields 是需要排除的字段，
+			只有 fields 时沿用原来的写法，否则使用 includes/excludes 的对象写法，两者都支持通配符。
+		*/
+		if source := buildSourceFilter(fields, excludeFields); source != nil {
+			queryBody["_source"] = source
 		}
 		/*处理用户的查询参数*/
 		if len(query) > 0 {
-			/*如果用户设置了查询参数，则创建一个 queryBody["query"] 空 map类型变量*/
-			queryBody["query"] = map[string]interface{}{}
-			/*queryBody["query"] 的值设置为一个新的 query_string Map 类型变量*/
-			queryBody["query"].(map[string]interface{})["query_string"] = map[string]interface{}{}
-			/*并将用户提供的查询字符串设置为 queryBody["query"]["query_string"]["query"] 的值*/
-			queryBody["query"].(map[string]interface{})["query_string"].(map[string]interface{})["query"] = query
+			/*
+				如果用户设置了查询参数，query 已经是组装好的 Query DSL（--query 的 query_string 和 --query_file 的内容），
+				直接作为 queryBody["query"] 的值
+			*/
+			queryBody["query"] = query
+		}
+
+		/*需要保留版本号时，让每个 hit 都带上 _version*/
+		if version {
+			queryBody["version"] = true
 		}
 
 		/*使用 Scroll API 进行分片查询。当数据量较大的时候，es通常需要对数据进行分片处理以提高查询效率。*/
@@ -131,17 +134,17 @@ func (s *ESAPIV5) NewScroll(indexNames string, scrollTime string, docBufferCount
 	}
 
 	/*
-		这段代码是使用 "DoRequest" 方法来执行 HTTP 请求并发送 JSON 格式的请求正文（即"jsonBody"）。
+		这段代码是使用 "DoStreamRequest" 方法来执行 HTTP 请求并发送 JSON 格式的请求正文（即"jsonBody"），响应体不会一次性读入内存。
 		如果在发送请求时出现错误，将返回 "nil" 并将错误信息记录在日志中。
 	*/
-	body, err := DoRequest(s.Compress, "POST", url, s.Auth, jsonBody, s.HttpProxy)
+	body, err := DoStreamRequest(s.Compress, "POST", url, s.Auth, jsonBody, s.HttpProxy)
 	if err != nil {
 		log.Error(err)
 		return nil, err
 	}
 
-	scroll = &Scroll{}
-	err = DecodeJson(body, scroll)
+	/*第一页和之后的页一样流式读取，文档由 ProcessScrollResult 读取*/
+	scroll, err = newStreamedScroll(body)
 	if err != nil {
 		log.Error(err)
 		return nil, err
@@ -38,27 +38,28 @@ type ESAPIV6 struct {
 这段代码用于创建一个 Elasticsearch 的 Scroll API 请求，并获取第一页结果。
 这段代码和 v5.go 部分没啥区别，区别的地方就一个， *ESAPIV6
 */
-func (s *ESAPIV6) NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, slicedId, maxSlicedCount int, fields string) (scroll interface{}, err error) {
+func (s *ESAPIV6) NewScroll(indexNames string, scrollTime string, docBufferCount int, query map[string]interface{}, slicedId, maxSlicedCount int, fields, excludeFields string, version bool) (scroll interface{}, err error) {
 
 	/*这行代码，用于构建 Scroll API 的请求 URL。*/
 	url := fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d", s.Host, indexNames, scrollTime, docBufferCount)
 
+	/*--sample_rate 时在查询外面包一层 random_score，由服务端完成采样*/
+	query = s.Sampler.scrollQuery(query, "")
+
 	var jsonBody []byte
-	if len(query) > 0 || maxSlicedCount > 0 || len(fields) > 0 {
+	if len(query) > 0 || maxSlicedCount > 0 || len(fields) > 0 || len(excludeFields) > 0 || version {
 		queryBody := map[string]interface{}{}
 
-		if len(fields) > 0 {
-			if !strings.Contains(fields, ",") {
-				queryBody["_source"] = fields
-			} else {
-				queryBody["_source"] = strings.Split(fields, ",")
-			}
+		if source := buildSourceFilter(fields, excludeFields); source != nil {
+			queryBody["_source"] = source
 		}
 
 		if len(query) > 0 {
-			queryBody["query"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"].(map[string]interface{})["query"] = query
+			queryBody["query"] = query
+		}
+
+		if version {
+			queryBody["version"] = true
 		}
 
 		if maxSlicedCount > 1 {
@@ -75,14 +76,14 @@ func (s *ESAPIV6) NewScroll(indexNames string, scrollTime string, docBufferCount
 		}
 	}
 
-	body, err := DoRequest(s.Compress, "POST", url, s.Auth, jsonBody, s.HttpProxy)
+	body, err := DoStreamRequest(s.Compress, "POST", url, s.Auth, jsonBody, s.HttpProxy)
 	if err != nil {
 		log.Error(err)
 		return nil, err
 	}
 
-	scroll = &Scroll{}
-	err = DecodeJson(body, scroll)
+	/*第一页和之后的页一样流式读取，文档由 ProcessScrollResult 读取*/
+	scroll, err = newStreamedScroll(body)
 	if err != nil {
 		log.Error(err)
 		return nil, err
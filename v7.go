@@ -34,26 +34,29 @@ type ESAPIV7 struct {
 }
 
 /**/
-func (s *ESAPIV7) NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, slicedId, maxSlicedCount int, fields string) (scroll interface{}, err error) {
+func (s *ESAPIV7) NewScroll(indexNames string, scrollTime string, docBufferCount int, query map[string]interface{}, slicedId, maxSlicedCount int, fields, excludeFields string, version bool) (scroll interface{}, err error) {
 	url := fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d", s.Host, indexNames, scrollTime, docBufferCount)
 
+	/*--sample_rate 时在查询外面包一层 random_score，7.x 指定 seed 时必须同时指定 field*/
+	query = s.Sampler.scrollQuery(query, "_seq_no")
+
 	/*这里和 v5，v6都不同，前2者都是 var jsonBody []byte */
 	jsonBody := ""
-	if len(query) > 0 || maxSlicedCount > 0 || len(fields) > 0 {
+	if len(query) > 0 || maxSlicedCount > 0 || len(fields) > 0 || len(excludeFields) > 0 || version {
 		queryBody := map[string]interface{}{}
 
-		if len(fields) > 0 {
-			if !strings.Contains(fields, ",") {
-				queryBody["_source"] = fields
-			} else {
-				queryBody["_source"] = strings.Split(fields, ",")
-			}
+		if source := buildSourceFilter(fields, excludeFields); source != nil {
+			queryBody["_source"] = source
 		}
 
 		if len(query) > 0 {
-			queryBody["query"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"].(map[string]interface{})["query"] = query
+			queryBody["query"] = query
+		}
+
+		/*7.x 还可以返回 _seq_no 和 _primary_term，随文档一起保存到导出文件中*/
+		if version {
+			queryBody["version"] = true
+			queryBody["seq_no_primary_term"] = true
 		}
 
 		if maxSlicedCount > 1 {
@@ -73,38 +76,16 @@ func (s *ESAPIV7) NewScroll(indexNames string, scrollTime string, docBufferCount
 	}
 
 	/*
-		v5.go v6.go:
-			body, err := DoRequest(s.Compress,"POST",url, s.Auth,jsonBody,s.HttpProxy)
+		v5.go v6.go 也一样使用 DoStreamRequest，状态码不是 200 时返回响应中的错误信息。
+		第一页和之后的页一样流式读取，这里只读取到文档数组的开头，文档由 ProcessScrollResult 读取。
 	*/
-	resp, body, errs := Post(url, s.Auth, jsonBody, s.HttpProxy)
-
-	/* 和 v5.go v6.go 相比较，这段是新增的，v7新增这部分的处理更好。*/
-	if resp != nil && resp.Body != nil {
-		io.Copy(ioutil.Discard, resp.Body)
-		defer resp.Body.Close()
-	}
-
-	if errs != nil {
-		log.Error(errs)
-		return nil, errs[0]
-	}
-
-	/* 和 v5.go v6.go 相比较，这段是新增的，v7新增这部分的处理更好。*/
-	if resp.StatusCode != 200 {
-		return nil, errors.New(body)
-	}
-
-	/* 和 v5.go v6.go 相比较，这段是新增的，v7新增这部分的处理更好。*/
-	log.Trace("new scroll,", body)
-
+	body, err := DoStreamRequest(s.Compress, "POST", url, s.Auth, []byte(jsonBody), s.HttpProxy)
 	if err != nil {
 		log.Error(err)
 		return nil, err
 	}
 
-	/*v5.go v6.go scroll = &Scroll{}, v7.go 不同*/
-	scroll = &ScrollV7{}
-	err = DecodeJson(body, scroll)
+	scroll, err = newStreamedScroll(body)
 	if err != nil {
 		log.Error(err)
 		return nil, err